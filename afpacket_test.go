@@ -0,0 +1,22 @@
+//go:build afpackettest && linux
+
+package dgrams_test
+
+import (
+	"testing"
+
+	"github.com/soypat/dgrams/link"
+)
+
+func TestAFPacket(t *testing.T) {
+	dev, err := link.OpenAFPacket(link.AFPacketConfig{
+		Interface:  "veth1",
+		Filter:     link.StackFilter(stackAddr),
+		RingFrames: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	serveStack(t, dev)
+}
@@ -0,0 +1,26 @@
+#!/bin/bash
+# Build binary.
+go test -c -tags=afpackettest -o=dgrams.test .
+
+# Create a veth pair in a network namespace: the kernel owns veth0 and the stack
+# attaches to veth1, whose hardware address it uses.
+NS=dgrams
+sudo ip netns add $NS
+trap "sudo ip netns del $NS" EXIT
+sudo ip netns exec $NS ip link add veth0 type veth peer name veth1
+sudo ip netns exec $NS ip link set veth1 address 02:00:00:00:00:03
+sudo ip netns exec $NS ip addr add 192.168.0.2/24 dev veth0
+sudo ip netns exec $NS ip link set up dev veth0
+sudo ip netns exec $NS ip link set up dev veth1
+# The stack does not answer ARP requests, add its hardware address statically.
+sudo ip netns exec $NS ip neigh add 192.168.0.3 lladdr 02:00:00:00:00:03 dev veth0
+
+echo "start tests"
+sudo ip netns exec $NS ./dgrams.test & # Send test job to background.
+pid=$! # Get PID of our test.
+sleep 1
+sudo ip netns exec $NS curl http://192.168.0.3:80 & # Start TCP connection on veth0.
+echo "sent curl"
+
+trap "kill $pid; sudo ip netns del $NS" INT TERM
+wait $pid
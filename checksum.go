@@ -0,0 +1,70 @@
+package dgrams
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrIPv4HeaderChecksum is returned by VerifyChecksumsIPv4 for datagrams
+	// whose header checksum does not match the header.
+	ErrIPv4HeaderChecksum = errors.New("bad IPv4 header checksum")
+	// ErrChecksum is returned by VerifyChecksumsIPv4 for datagrams whose TCP,
+	// UDP or ICMP checksum does not match their contents.
+	ErrChecksum = errors.New("bad TCP, UDP or ICMP checksum")
+
+	errShortIPv4  = errors.New("buffer too short to contain IPv4 datagram")
+	errShortProto = errors.New("IPv4 payload too short for its protocol")
+)
+
+// VerifyChecksumsIPv4 verifies the header checksum of the IPv4 datagram in buf
+// and the checksum of its TCP, UDP or ICMP payload. The payload of fragments and
+// of other protocols is not verified, nor that of UDP datagrams without
+// checksum. buf may extend past the end of the datagram, i.e. into padding of
+// the link layer.
+func VerifyChecksumsIPv4(buf []byte) error {
+	if len(buf) < SizeIPHeader {
+		return errShortIPv4
+	}
+	ihl := int(buf[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(buf[2:]))
+	if ihl < SizeIPHeader || total < ihl || total > len(buf) {
+		return errShortIPv4
+	}
+	var crc CRC_RFC791
+	crc.Write(buf[:ihl])
+	if crc.Sum() != 0 {
+		return ErrIPv4HeaderChecksum
+	}
+	flags := IPFlags(binary.BigEndian.Uint16(buf[6:]))
+	if flags.MoreFragments() || flags.FragmentOffset() != 0 {
+		return nil // The checksum covers the reassembled datagram.
+	}
+	proto, payload := buf[9], buf[ihl:total]
+	crc.Reset()
+	switch proto {
+	case 1: // ICMP, without pseudo-header.
+		if len(payload) < SizeICMPv4Header {
+			return errShortProto
+		}
+	case 6, 17: // TCP and UDP.
+		if proto == 6 && len(payload) < SizeTCPHeaderNoOptions || proto == 17 && len(payload) < 8 {
+			return errShortProto
+		}
+		if proto == 17 && binary.BigEndian.Uint16(payload[6:]) == 0 {
+			return nil // Sender did not compute a checksum.
+		}
+		var pseudo [12]byte
+		copy(pseudo[:8], buf[12:20])
+		pseudo[9] = proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(payload)))
+		crc.Write(pseudo[:])
+	default:
+		return nil
+	}
+	crc.Write(payload)
+	if crc.Sum() != 0 {
+		return ErrChecksum
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ module github.com/soypat/dgrams
 
 go 1.19
 
-require (
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
-	golang.org/x/sys v0.7.0 // indirect
-)
+require github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+
+require golang.org/x/sys v0.7.0 // indirect
@@ -76,7 +76,8 @@ type ARPv4Header struct {
 
 // IPv4Header is the Internet Protocol header. 20 bytes in size. Does not include options.
 type IPv4Header struct {
-	Version uint8 // 0:1
+	// Version is the IP version, 4 for IPv4. It is the upper 4 bits of the first octet.
+	Version uint8 // 0:1 bits 4:8
 	// Internet Header Length (IHL) The IPv4 header is variable in size due to the
 	// optional 14th field (options). The IHL field contains the size of the IPv4 header;
 	// it has 4 bits that specify the number of 32-bit words in the header.
@@ -84,7 +85,11 @@ type IPv4Header struct {
 	// The minimum value for this field is 5, which indicates a length of
 	// 5 × 32 bits = 160 bits = 20 bytes. As a 4-bit field, the maximum value is 15;
 	// this means that the maximum size of the IPv4 header is 15 × 32 bits = 480 bits = 60 bytes.
-	IHL uint8 // 1:2
+	IHL uint8 // 0:1 bits 0:4
+	// ToS is the Type of Service octet. Its upper 6 bits are the Differentiated
+	// Services Code Point (RFC 2474) and its lower 2 bits the ECN codepoint
+	// (RFC 3168), see DSCP and ECN.
+	ToS uint8 // 1:2
 	// This 16-bit field defines the entire packet size in bytes, including header and data.
 	// The minimum size is 20 bytes (header without data) and the maximum is 65,535 bytes.
 	// All hosts are required to be able to reassemble datagrams of size up to 576 bytes,
@@ -150,7 +155,7 @@ const (
 	SizeIPHeader             = 20
 	SizeTCPHeaderNoOptions   = 20
 	ipflagDontFrag           = 0x4000
-	ipFlagMoreFrag           = 0x8000
+	ipFlagMoreFrag           = 0x2000
 	ipVersion4               = 0x45
 	ipProtocolTCP            = 6
 )
@@ -258,7 +263,23 @@ func (iphdr *IPv4Header) FrameLength() int {
 }
 
 func (iphdr *IPv4Header) PayloadLength() int {
-	return int(iphdr.TotalLength) - 20
+	return int(iphdr.TotalLength) - iphdr.HeaderLength()
+}
+
+// HeaderLength returns the length of the header in bytes including options,
+// as given by IHL.
+func (iphdr *IPv4Header) HeaderLength() int {
+	return int(iphdr.IHL) * 4
+}
+
+// DSCP returns the Differentiated Services Code Point of the datagram, RFC 2474.
+func (iphdr *IPv4Header) DSCP() uint8 {
+	return iphdr.ToS >> 2
+}
+
+// ECN returns the Explicit Congestion Notification codepoint of the datagram, RFC 3168.
+func (iphdr *IPv4Header) ECN() ECN {
+	return ECN(iphdr.ToS & 0b11)
 }
 
 func (ip *IPv4Header) String() string {
@@ -268,8 +289,9 @@ func (ip *IPv4Header) String() string {
 // DecodeIPv4Header decodes a 20 byte IPv4 header from buf.
 func DecodeIPv4Header(buf []byte) (iphdr IPv4Header) {
 	_ = buf[19]
-	iphdr.Version = buf[0]
-	iphdr.IHL = buf[1]
+	iphdr.Version = buf[0] >> 4
+	iphdr.IHL = buf[0] & 0xf
+	iphdr.ToS = buf[1]
 	iphdr.TotalLength = binary.BigEndian.Uint16(buf[2:])
 	iphdr.ID = binary.BigEndian.Uint16(buf[4:])
 	iphdr.Flags = IPFlags(binary.BigEndian.Uint16(buf[6:]))
@@ -284,8 +306,8 @@ func DecodeIPv4Header(buf []byte) (iphdr IPv4Header) {
 // Put marshals the IPv4 frame onto buf. buf needs to be 20 bytes in length or Put panics.
 func (iphdr *IPv4Header) Put(buf []byte) {
 	_ = buf[19]
-	buf[0] = iphdr.Version
-	buf[1] = iphdr.IHL
+	buf[0] = iphdr.Version<<4 | iphdr.IHL&0xf
+	buf[1] = iphdr.ToS
 	binary.BigEndian.PutUint16(buf[2:], iphdr.TotalLength)
 	binary.BigEndian.PutUint16(buf[4:], iphdr.ID)
 	binary.BigEndian.PutUint16(buf[6:], uint16(iphdr.Flags))
@@ -302,15 +324,35 @@ func (iphdr *IPv4Header) PutPseudo(buf []byte) {
 	// |8 TTL |9 Proto |10 Checksum |12  Source  |16  Destination |20
 	// |set 0 |  nop   | set length | nop        | nop            |
 	_ = buf[11]
+	// The pseudo-header carries the length of the transport segment, not that of the datagram.
+	ihl := uint16(iphdr.IHL) * 4
+	if ihl < SizeIPHeader {
+		ihl = SizeIPHeader
+	}
 	buf[0] = 0
 	buf[1] = iphdr.Protocol
-	binary.BigEndian.PutUint16(buf[2:], iphdr.TotalLength)
+	binary.BigEndian.PutUint16(buf[2:], iphdr.TotalLength-ihl)
 	copy(buf[4:8], iphdr.Source[:])
 	copy(buf[8:12], iphdr.Destination[:])
 }
 
+// CalculateChecksum calculates the checksum of the IPv4 header, which has no options.
+func (iphdr *IPv4Header) CalculateChecksum() uint16 {
+	var buf [SizeIPHeader]byte
+	iphdr.Put(buf[:])
+	// Zero out checksum field.
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+	crc := CRC_RFC791{}
+	crc.Write(buf[:])
+	return crc.Sum()
+}
+
 type IPFlags uint16
 
+// IPFlagDontFragment is the Don't Fragment flag. Routers drop datagrams with
+// DF set that need fragmentation, which is used for Path MTU Discovery.
+const IPFlagDontFragment IPFlags = ipflagDontFrag
+
 func (f IPFlags) DontFragment() bool     { return f&ipflagDontFrag != 0 }
 func (f IPFlags) MoreFragments() bool    { return f&ipFlagMoreFrag != 0 }
 func (f IPFlags) FragmentOffset() uint16 { return uint16(f) & 0x1fff }
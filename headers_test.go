@@ -0,0 +1,89 @@
+package dgrams_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/soypat/dgrams"
+)
+
+func TestIPv4HeaderPutPseudo(t *testing.T) {
+	for _, test := range []struct {
+		ihl     uint8
+		total   uint16
+		wantLen uint16
+	}{
+		{ihl: 5, total: 60, wantLen: 40},
+		// Options are part of the IP header, not of the transport segment.
+		{ihl: 6, total: 60, wantLen: 36},
+		// Headers built without IHL have no options.
+		{ihl: 0, total: 60, wantLen: 40},
+	} {
+		ip := dgrams.IPv4Header{
+			Version:     4,
+			IHL:         test.ihl,
+			TotalLength: test.total,
+			Protocol:    6,
+			Source:      [4]byte{192, 168, 1, 112},
+			Destination: [4]byte{192, 168, 1, 5},
+		}
+		var got [12]byte
+		ip.PutPseudo(got[:])
+		want := []byte{0, 6, byte(test.wantLen >> 8), byte(test.wantLen), 192, 168, 1, 112, 192, 168, 1, 5}
+		if !bytes.Equal(got[:], want) {
+			t.Errorf("IHL %d: want pseudo-header %v, got %v", test.ihl, want, got)
+		}
+	}
+}
+
+func TestIPv4HeaderChecksums(t *testing.T) {
+	payload := []byte("hello")
+	buf := make([]byte, dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions+len(payload))
+	ip := dgrams.IPv4Header{
+		Version:     4,
+		IHL:         5,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    6,
+		Source:      [4]byte{192, 168, 1, 112},
+		Destination: [4]byte{192, 168, 1, 5},
+	}
+	ip.Checksum = ip.CalculateChecksum()
+	ip.Put(buf)
+	tcp := dgrams.TCPHeader{SourcePort: 58920, DestinationPort: 80, Seq: 1, WindowSize: 1024}
+	tcp.SetFlags(dgrams.FlagTCP_ACK | dgrams.FlagTCP_PSH)
+	tcp.SetOffset(5)
+	tcp.Checksum = tcp.CalculateChecksumIPv4(&ip, nil, payload)
+	tcp.Put(buf[dgrams.SizeIPHeader:])
+	copy(buf[dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions:], payload)
+	if err := dgrams.VerifyChecksumsIPv4(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := dgrams.DecodeIPv4Header(buf); got != ip {
+		t.Fatalf("header does not round trip: put %+v, decoded %+v", ip, got)
+	}
+}
+
+func TestIPFlags(t *testing.T) {
+	for _, test := range []struct {
+		flags  dgrams.IPFlags
+		df, mf bool
+		offset uint16
+	}{
+		{flags: 0x4000, df: true},
+		// First fragment and a later one, offsets are in 8 octet units.
+		{flags: 0x2000, mf: true},
+		{flags: 0x2000 | 185, mf: true, offset: 185},
+		{flags: 185, offset: 185},
+		// Reserved bit.
+		{flags: 0x8000},
+	} {
+		if test.flags.DontFragment() != test.df || test.flags.MoreFragments() != test.mf || test.flags.FragmentOffset() != test.offset {
+			t.Errorf("flags %#04x: got DF=%v MF=%v offset=%d", uint16(test.flags),
+				test.flags.DontFragment(), test.flags.MoreFragments(), test.flags.FragmentOffset())
+		}
+	}
+	if dgrams.IPFlagDontFragment != 0x4000 {
+		t.Error("Don't Fragment is bit 1 of the flags")
+	}
+}
@@ -0,0 +1,62 @@
+package dgrams
+
+import "encoding/binary"
+
+// SizeICMPv4Header is the size of the ICMPv4 header, including the 4 octets
+// whose meaning depends on the message type.
+const SizeICMPv4Header = 8
+
+// ICMPv4Type identifies the kind of an ICMPv4 message, RFC 792.
+type ICMPv4Type uint8
+
+const (
+	ICMPv4EchoReply              ICMPv4Type = 0
+	ICMPv4DestinationUnreachable ICMPv4Type = 3
+	ICMPv4Redirect               ICMPv4Type = 5
+	ICMPv4Echo                   ICMPv4Type = 8
+	ICMPv4TimeExceeded           ICMPv4Type = 11
+	ICMPv4ParameterProblem       ICMPv4Type = 12
+)
+
+const (
+	// ICMPv4CodeFragmentationNeeded is the code of a Destination Unreachable
+	// message sent by a router which had to fragment a datagram with the
+	// Don't Fragment flag set. Used for Path MTU Discovery, RFC 1191.
+	ICMPv4CodeFragmentationNeeded uint8 = 4
+)
+
+// ICMPv4Header is the 8 byte header of ICMPv4 messages. Error messages are followed
+// by the IP header and first 8 octets of data of the datagram which caused the error.
+type ICMPv4Header struct {
+	Type     ICMPv4Type // 0:1
+	Code     uint8      // 1:2
+	Checksum uint16     // 2:4
+	// Rest of the header, its contents depend on the type of message.
+	Data [4]byte // 4:8
+}
+
+// DecodeICMPv4Header decodes an 8 byte ICMPv4 header from buf.
+func DecodeICMPv4Header(buf []byte) (icmp ICMPv4Header) {
+	_ = buf[7]
+	icmp.Type = ICMPv4Type(buf[0])
+	icmp.Code = buf[1]
+	icmp.Checksum = binary.BigEndian.Uint16(buf[2:])
+	copy(icmp.Data[:], buf[4:8])
+	return icmp
+}
+
+// Put marshals the ICMPv4 header onto buf. buf needs to be 8 bytes in length or Put panics.
+func (icmp *ICMPv4Header) Put(buf []byte) {
+	_ = buf[7]
+	buf[0] = byte(icmp.Type)
+	buf[1] = icmp.Code
+	binary.BigEndian.PutUint16(buf[2:], icmp.Checksum)
+	copy(buf[4:8], icmp.Data[:])
+}
+
+// NextHopMTU returns the MTU of the next-hop network reported in a
+// Fragmentation Needed message as described in RFC 1191. Routers predating
+// RFC 1191 set it to zero.
+func (icmp *ICMPv4Header) NextHopMTU() uint16 {
+	return binary.BigEndian.Uint16(icmp.Data[2:])
+}
@@ -0,0 +1,19 @@
+package siphash
+
+import "testing"
+
+func TestHash24(t *testing.T) {
+	// Test vector from appendix A of the SipHash paper.
+	var key [16]byte
+	var msg [15]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	const want = 0xa129ca6149be45e5
+	if got := Hash24(&key, msg[:]); got != want {
+		t.Errorf("want %#x, got %#x", uint64(want), got)
+	}
+}
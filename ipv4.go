@@ -0,0 +1,154 @@
+package dgrams
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/soypat/dgrams/internal/siphash"
+)
+
+// DefaultTTL is the Time To Live of datagrams sent by an IPv4Sender without
+// a TTL set, as recommended by RFC 1700.
+const DefaultTTL = 64
+
+// ECN is the Explicit Congestion Notification codepoint in the lower 2 bits
+// of the IPv4 ToS octet, RFC 3168.
+type ECN uint8
+
+const (
+	// ECNNotECT marks datagrams of transports not capable of ECN.
+	ECNNotECT ECN = 0b00
+	// ECNECT1 and ECNECT0 mark datagrams of ECN capable transports.
+	ECNECT1 ECN = 0b01
+	ECNECT0 ECN = 0b10
+	// ECNCE is set by routers experiencing congestion on datagrams of ECN
+	// capable transports instead of dropping them.
+	ECNCE ECN = 0b11
+)
+
+// DFPolicy is the policy an IPv4Sender follows to set the Don't Fragment flag.
+type DFPolicy uint8
+
+const (
+	// DFAlways sets the Don't Fragment flag on all datagrams, so that routers
+	// report the MTU of the path instead of fragmenting them as Path MTU
+	// Discovery requires (RFC 1191). It is the default.
+	DFAlways DFPolicy = iota
+	// DFNever lets routers fragment datagrams too large for the next hop.
+	DFNever
+)
+
+// IPv4Sender writes the headers of IPv4 datagrams sent by a transport. The zero
+// value sends datagrams with a TTL of DefaultTTL, DSCP zero (best effort) and
+// the Don't Fragment flag set, identified by a package level IPv4IDGenerator.
+type IPv4Sender struct {
+	// TTL is the Time To Live of datagrams sent. Zero uses DefaultTTL.
+	TTL uint8
+	// DSCP is the Differentiated Services Code Point of datagrams sent, RFC 2474.
+	// Only its lower 6 bits are used.
+	DSCP uint8
+	// DF is the policy for setting the Don't Fragment flag.
+	DF DFPolicy
+	// IDs generates the Identification field of datagrams sent. If nil a
+	// package level generator keyed with crypto/rand is used.
+	IDs *IPv4IDGenerator
+}
+
+// PutHeader writes the 20 byte header of a datagram from src to dst carrying
+// protocol proto onto buf, which spans the whole datagram, and returns it. The
+// header checksum is set, the payload must be written after the header by the caller.
+// ecn is the ECN codepoint of the datagram, chosen by the transport.
+func (o *IPv4Sender) PutHeader(buf []byte, src, dst [4]byte, proto uint8, ecn ECN) (IPv4Header, error) {
+	if len(buf) < SizeIPHeader {
+		return IPv4Header{}, io.ErrShortBuffer
+	} else if len(buf) > math.MaxUint16 {
+		return IPv4Header{}, errors.New("datagram too long for IPv4")
+	}
+	ip := IPv4Header{
+		Version:     4,
+		IHL:         SizeIPHeader / 4,
+		ToS:         o.DSCP<<2 | uint8(ecn&0b11),
+		TotalLength: uint16(len(buf)),
+		TTL:         o.TTL,
+		Protocol:    proto,
+		Source:      src,
+		Destination: dst,
+	}
+	if ip.TTL == 0 {
+		ip.TTL = DefaultTTL
+	}
+	if o.DF != DFNever {
+		ip.Flags = IPFlagDontFragment
+	}
+	ids := o.IDs
+	if ids == nil {
+		ids = defaultIPv4IDGenerator()
+	}
+	ip.ID = ids.ID(src, dst, proto)
+	ip.Checksum = ip.CalculateChecksum()
+	ip.Put(buf)
+	return ip, nil
+}
+
+// ipv4IDBuckets is the number of counters of an IPv4IDGenerator.
+const ipv4IDBuckets = 64
+
+// IPv4IDGenerator generates the Identification field of IPv4 datagrams as
+// described by RFC 7739 section 5.3. Datagrams are assigned one of a fixed
+// number of counters by a keyed hash of their addresses and protocol, which
+// also offsets the IDs, so that IDs sent to a destination do not repeat within
+// the lifetime of a datagram while revealing nothing of the datagrams sent to
+// other destinations. The hash is SipHash-2-4. It is safe for concurrent use.
+type IPv4IDGenerator struct {
+	key      [16]byte
+	counters [ipv4IDBuckets]uint32
+}
+
+// NewIPv4IDGenerator returns an IPv4IDGenerator with the given secret key, which
+// should be chosen at random on startup, i.e. from a hardware RNG.
+func NewIPv4IDGenerator(key [16]byte) *IPv4IDGenerator {
+	return &IPv4IDGenerator{key: key}
+}
+
+// NewRandomIPv4IDGenerator returns an IPv4IDGenerator whose secret key is read
+// from rand, which is usually crypto/rand.Reader or a hardware RNG.
+func NewRandomIPv4IDGenerator(rand io.Reader) (*IPv4IDGenerator, error) {
+	var key [16]byte
+	_, err := io.ReadFull(rand, key[:])
+	if err != nil {
+		return nil, err
+	}
+	return NewIPv4IDGenerator(key), nil
+}
+
+// ID returns the Identification of the next datagram from src to dst carrying protocol proto.
+func (g *IPv4IDGenerator) ID(src, dst [4]byte, proto uint8) uint16 {
+	var buf [9]byte
+	copy(buf[:4], src[:])
+	copy(buf[4:8], dst[:])
+	buf[8] = proto
+	h := siphash.Hash24(&g.key, buf[:])
+	n := atomic.AddUint32(&g.counters[h%ipv4IDBuckets], 1)
+	return uint16(h>>48) + uint16(n)
+}
+
+var (
+	defaultIPv4IDsOnce sync.Once
+	defaultIPv4IDs     *IPv4IDGenerator
+)
+
+// defaultIPv4IDGenerator returns a package level IPv4IDGenerator keyed with crypto/rand.
+func defaultIPv4IDGenerator() *IPv4IDGenerator {
+	defaultIPv4IDsOnce.Do(func() {
+		var err error
+		defaultIPv4IDs, err = NewRandomIPv4IDGenerator(rand.Reader)
+		if err != nil {
+			panic("dgrams: generating IPv4 ID key: " + err.Error())
+		}
+	})
+	return defaultIPv4IDs
+}
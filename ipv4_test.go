@@ -0,0 +1,88 @@
+package dgrams_test
+
+import (
+	"testing"
+
+	"github.com/soypat/dgrams"
+)
+
+func TestIPv4SenderPutHeader(t *testing.T) {
+	src, dst := [4]byte{192, 168, 1, 5}, [4]byte{192, 168, 1, 112}
+	const proto = 253 // Experimental, payload not verified.
+	for _, test := range []struct {
+		sender  dgrams.IPv4Sender
+		ecn     dgrams.ECN
+		wantTTL uint8
+		wantToS uint8
+		wantDF  bool
+	}{
+		{wantTTL: dgrams.DefaultTTL, wantDF: true},
+		{sender: dgrams.IPv4Sender{DF: dgrams.DFAlways}, wantTTL: dgrams.DefaultTTL, wantDF: true},
+		{sender: dgrams.IPv4Sender{DF: dgrams.DFNever, TTL: 1}, wantTTL: 1},
+		// Expedited Forwarding from an ECN capable transport.
+		{sender: dgrams.IPv4Sender{DSCP: 46}, ecn: dgrams.ECNECT0, wantTTL: dgrams.DefaultTTL, wantToS: 0xb8 | 0b10, wantDF: true},
+		{sender: dgrams.IPv4Sender{DSCP: 0xff}, ecn: dgrams.ECNCE, wantTTL: dgrams.DefaultTTL, wantToS: 0xff, wantDF: true},
+	} {
+		buf := make([]byte, dgrams.SizeIPHeader+8)
+		ip, err := test.sender.PutHeader(buf, src, dst, proto, test.ecn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != 0x45 || buf[1] != test.wantToS {
+			t.Errorf("%+v: want first octets %#x %#x, got %#x %#x", test.sender, 0x45, test.wantToS, buf[0], buf[1])
+		}
+		if ip != dgrams.DecodeIPv4Header(buf) {
+			t.Errorf("%+v: header returned differs from that written", test.sender)
+		}
+		if ip.TTL != test.wantTTL || ip.Flags.DontFragment() != test.wantDF || ip.TotalLength != uint16(len(buf)) || ip.Protocol != proto {
+			t.Errorf("%+v: got TTL %d, flags %#x, length %d and protocol %d", test.sender, ip.TTL, ip.Flags, ip.TotalLength, ip.Protocol)
+		}
+		if ip.DSCP() != test.wantToS>>2 || ip.ECN() != test.ecn {
+			t.Errorf("%+v: got DSCP %d and ECN %d", test.sender, ip.DSCP(), ip.ECN())
+		}
+		if err := dgrams.VerifyChecksumsIPv4(buf); err != nil {
+			t.Errorf("%+v: %v", test.sender, err)
+		}
+	}
+	var sender dgrams.IPv4Sender
+	if _, err := sender.PutHeader(make([]byte, dgrams.SizeIPHeader-1), src, dst, proto, 0); err == nil {
+		t.Error("expected error writing header to short buffer")
+	}
+	if _, err := sender.PutHeader(make([]byte, 1<<16), src, dst, proto, 0); err == nil {
+		t.Error("expected error writing datagram longer than 65535 bytes")
+	}
+}
+
+func TestIPv4IDGenerator(t *testing.T) {
+	src, dst := [4]byte{192, 168, 1, 5}, [4]byte{192, 168, 1, 112}
+	key := [16]byte{1, 2, 3}
+	g := dgrams.NewIPv4IDGenerator(key)
+	id := g.ID(src, dst, 6)
+	if id != dgrams.NewIPv4IDGenerator(key).ID(src, dst, 6) {
+		t.Error("ID not deterministic for same key and destination")
+	}
+	if id == dgrams.NewIPv4IDGenerator([16]byte{3, 2, 1}).ID(src, dst, 6) {
+		t.Error("ID should depend on the key")
+	}
+	// Datagrams to other destinations mostly fall in other buckets, leaving
+	// the sequence of IDs to dst undisturbed.
+	independent := 0
+	for i := 0; i < 16; i++ {
+		other := [4]byte{10, 0, 0, byte(i)}
+		g.ID(src, other, 6)
+		next := g.ID(src, dst, 6)
+		if next == id+1 {
+			independent++
+		}
+		id = next
+	}
+	if independent < 14 {
+		t.Fatalf("expected IDs to a destination independent of those to others, got %d of 16", independent)
+	}
+	// So do datagrams of other protocols to dst.
+	first := g.ID(src, dst, 17)
+	g.ID(src, dst, 6)
+	if second := g.ID(src, dst, 17); second != first+1 {
+		t.Fatalf("expected consecutive IDs for UDP, got %d and %d", first, second)
+	}
+}
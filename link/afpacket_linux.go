@@ -0,0 +1,313 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// Constants of linux/if_packet.h missing from package syscall.
+const (
+	packetVersion        = 10
+	packetIgnoreOutgoing = 23
+	tpacketV2            = 1
+	tpStatusKernel       = 0
+	tpStatusUser         = 1
+	// tpacketFrameOverhead bounds the offset of the frame data in a ring frame:
+	// the aligned tpacket2Hdr and sockaddr_ll followed by padding for a VLAN tag.
+	tpacketFrameOverhead = 128
+)
+
+// tpacket2Hdr is struct tpacket2_hdr, which precedes each frame of a
+// PACKET_MMAP ring set up with TPACKET_V2.
+type tpacket2Hdr struct {
+	status   uint32
+	len      uint32
+	snaplen  uint32
+	mac      uint16
+	net      uint16
+	sec      uint32
+	nsec     uint32
+	vlanTCI  uint16
+	vlanTPID uint16
+	_        [4]byte
+}
+
+// tpacketReq is struct tpacket_req, the geometry of a PACKET_MMAP ring.
+type tpacketReq struct {
+	blockSize uint32
+	blockNr   uint32
+	frameSize uint32
+	frameNr   uint32
+}
+
+// packetMreq is struct packet_mreq.
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+// AFPacketConfig contains the parameters of an AFPacket device.
+type AFPacketConfig struct {
+	// Interface is the name of the network interface to attach to.
+	Interface string
+	// HardwareAddr is the hardware address of the stack. Default is that of
+	// the interface. A different address requires Promiscuous for the interface
+	// to accept the frames sent to the stack.
+	HardwareAddr net.HardwareAddr
+	// Promiscuous puts the interface in promiscuous mode while the device is open.
+	Promiscuous bool
+	// Filter is a classic BPF program run by the kernel on every frame of the
+	// interface, so that only the frames it accepts are read, see StackFilter.
+	// Nil reads all frames.
+	Filter []syscall.SockFilter
+	// RingFrames is the number of frames of a PACKET_MMAP receive ring shared with
+	// the kernel, which saves a system call per frame read under load. Zero reads
+	// frames with a system call each.
+	RingFrames int
+}
+
+// AFPacket attaches a stack to an existing Linux network interface through an
+// AF_PACKET socket. The stack is another host on the link of the interface,
+// sharing it with the kernel, so it should use an IP address the kernel does
+// not. Opening an AFPacket requires CAP_NET_RAW.
+type AFPacket struct {
+	f    *os.File
+	rc   syscall.RawConn
+	name string
+	hw   net.HardwareAddr
+	mtu  int
+
+	mu        sync.Mutex // Guards the ring, which is unmapped on Close.
+	ring      []byte
+	frameSize int
+	head      int // Index of the next frame of the ring to read.
+}
+
+var _ tcpctl.Device = (*AFPacket)(nil)
+
+// OpenAFPacket opens an AF_PACKET socket on the interface configured by cfg.
+// The filter and receive ring are set up before the socket is bound to the
+// interface so no frame is read unfiltered.
+func OpenAFPacket(cfg AFPacketConfig) (*AFPacket, error) {
+	ifi, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	dev := &AFPacket{name: ifi.Name, hw: ifi.HardwareAddr, mtu: ifi.MTU}
+	if cfg.HardwareAddr != nil {
+		dev.hw = cfg.HardwareAddr
+	}
+	if len(dev.hw) != 6 {
+		return nil, errors.New("hardware address must be an EUI-48")
+	}
+	dev.hw = append(net.HardwareAddr{}, dev.hw...)
+	if dev.mtu <= 0 {
+		dev.mtu = 1500
+	}
+	// Protocol 0 receives no frames until bound.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := dev.setup(fd, ifi.Index, &cfg); err != nil {
+		syscall.Close(fd)
+		if dev.ring != nil {
+			syscall.Munmap(dev.ring)
+		}
+		return nil, err
+	}
+	dev.f = os.NewFile(uintptr(fd), "afpacket:"+ifi.Name)
+	dev.rc, err = dev.f.SyscallConn()
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func (dev *AFPacket) setup(fd, ifindex int, cfg *AFPacketConfig) error {
+	// Frames sent by the kernel on the interface are not for the stack.
+	// Older kernels lack the option, the filter should reject them then.
+	syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetIgnoreOutgoing, 1)
+	if cfg.Filter != nil {
+		if len(cfg.Filter) == 0 || len(cfg.Filter) > 0xffff {
+			return errors.New("invalid BPF program length")
+		}
+		prog := syscall.SockFprog{Len: uint16(len(cfg.Filter)), Filter: &cfg.Filter[0]}
+		err := setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, unsafe.Pointer(&prog), unsafe.Sizeof(prog))
+		runtime.KeepAlive(cfg.Filter) // Referenced by prog, which the kernel copies.
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Promiscuous {
+		mreq := packetMreq{ifindex: int32(ifindex), typ: syscall.PACKET_MR_PROMISC}
+		err := setsockopt(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq))
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.RingFrames > 0 {
+		if err := dev.mapRing(fd, cfg.RingFrames); err != nil {
+			return err
+		}
+	}
+	err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifindex})
+	if err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	return nil
+}
+
+// mapRing sets up a TPACKET_V2 receive ring of at least n frames, each large
+// enough for a frame of the MTU of the device, and maps it.
+func (dev *AFPacket) mapRing(fd, n int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetVersion, tpacketV2); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	// Frames are a power of two in size so that blocks, which are a multiple
+	// of the page size, hold a whole number of them and frames are contiguous.
+	frameSize := 1 << 4
+	for frameSize < tpacketFrameOverhead+dev.mtu+14 {
+		frameSize <<= 1
+	}
+	blockSize := os.Getpagesize()
+	if blockSize < frameSize {
+		blockSize = frameSize
+	}
+	perBlock := blockSize / frameSize
+	req := tpacketReq{
+		blockSize: uint32(blockSize),
+		blockNr:   uint32((n + perBlock - 1) / perBlock),
+		frameSize: uint32(frameSize),
+	}
+	req.frameNr = req.blockNr * uint32(perBlock)
+	err := setsockopt(fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, unsafe.Pointer(&req), unsafe.Sizeof(req))
+	if err != nil {
+		return err
+	}
+	ring, err := syscall.Mmap(fd, 0, int(req.blockSize*req.blockNr), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	dev.ring = ring
+	dev.frameSize = frameSize
+	return nil
+}
+
+// ReadFrame reads a frame from the interface, waiting for one to be received.
+func (dev *AFPacket) ReadFrame(dst []byte) (n int, err error) {
+	if dev.frameSize == 0 {
+		return dev.f.Read(dst)
+	}
+	rerr := dev.rc.Read(func(uintptr) bool {
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		if dev.ring == nil {
+			err = os.ErrClosed
+			return true
+		}
+		frame := dev.ring[dev.head*dev.frameSize:][:dev.frameSize]
+		hdr := (*tpacket2Hdr)(unsafe.Pointer(&frame[0]))
+		if atomic.LoadUint32(&hdr.status)&tpStatusUser == 0 {
+			return false // Wait for the kernel to fill the frame.
+		}
+		if end := int(hdr.mac) + int(hdr.snaplen); end <= len(frame) {
+			n = copy(dst, frame[hdr.mac:end])
+		}
+		// Hand the frame back to the kernel.
+		atomic.StoreUint32(&hdr.status, tpStatusKernel)
+		dev.head = (dev.head + 1) % (len(dev.ring) / dev.frameSize)
+		return true
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	return n, err
+}
+
+// WriteFrame writes a frame to the interface.
+func (dev *AFPacket) WriteFrame(frame []byte) error {
+	_, err := dev.f.Write(frame)
+	return err
+}
+
+// MTU returns the MTU of the interface.
+func (dev *AFPacket) MTU() int { return dev.mtu }
+
+// HardwareAddr returns the hardware address of the stack.
+func (dev *AFPacket) HardwareAddr() net.HardwareAddr { return dev.hw }
+
+// LinkType returns tcpctl.LinkEthernet.
+func (dev *AFPacket) LinkType() tcpctl.LinkType { return tcpctl.LinkEthernet }
+
+// Name returns the name of the interface.
+func (dev *AFPacket) Name() string { return dev.name }
+
+// Close closes the socket, unblocking ReadFrame, and unmaps the receive ring.
+// The interface leaves promiscuous mode unless other sockets requested it.
+func (dev *AFPacket) Close() error {
+	err := dev.f.Close()
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.ring != nil {
+		syscall.Munmap(dev.ring)
+		dev.ring = nil
+	}
+	return err
+}
+
+// StackFilter returns a classic BPF program for AFPacketConfig.Filter accepting
+// only the frames a stack with IPv4 address addr handles: ARP packets and IPv4
+// packets sent to addr. The kernel drops all other frames of the interface
+// without waking up the stack.
+func StackFilter(addr net.IP) []syscall.SockFilter {
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return nil
+	}
+	const (
+		accept = 0x40000 // Snapshot length, larger than any frame.
+		ldh    = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS
+		ldw    = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		ret    = syscall.BPF_RET | syscall.BPF_K
+	)
+	dst := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+	// Jump offsets are relative to the next instruction.
+	return []syscall.SockFilter{
+		{Code: ldh, K: 12},            // 0: A = EtherType.
+		{Code: jeq, K: 0x0806, Jt: 3}, // 1: ARP: accept.
+		{Code: jeq, K: 0x0800, Jf: 3}, // 2: Not IPv4: drop.
+		{Code: ldw, K: 14 + 16},       // 3: A = IPv4 destination address.
+		{Code: jeq, K: dst, Jf: 1},    // 4: Not addr: drop.
+		{Code: ret, K: accept},        // 5: Accept.
+		{Code: ret, K: 0},             // 6: Drop.
+	}
+}
+
+// setsockopt sets a socket option whose value is the size bytes at p.
+func setsockopt(fd, level, opt int, p unsafe.Pointer, size uintptr) error {
+	err := syscall.SetsockoptString(fd, level, opt, string(unsafe.Slice((*byte)(p), size)))
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// htons converts a 16 bit integer to network byte order on little and big endian hosts.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	b[0], b[1] = byte(v>>8), byte(v)
+	return *(*uint16)(unsafe.Pointer(&b))
+}
@@ -0,0 +1,100 @@
+package link
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+func TestAFPacket(t *testing.T) {
+	setupVeth(t)
+	stackIP := net.IPv4(10, 0, 0, 2)
+	for _, ring := range []int{0, 4} {
+		peer, err := OpenAFPacket(AFPacketConfig{Interface: "veth0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev, err := OpenAFPacket(AFPacketConfig{Interface: "veth1", Filter: StackFilter(stackIP), RingFrames: ring})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dev.MTU()+dgrams.SizeEthernetHeaderNoVLAN)
+		// Send more frames than the ring holds, each after a frame the filter rejects.
+		for i := 0; i < 10; i++ {
+			other := ipv4Frame(peer.HardwareAddr(), dev.HardwareAddr(), net.IPv4(10, 0, 0, 3), byte(i))
+			frame := ipv4Frame(peer.HardwareAddr(), dev.HardwareAddr(), stackIP, byte(i))
+			if i%3 == 0 {
+				frame[12], frame[13] = 0x08, 0x06 // ARP.
+			}
+			if err := peer.WriteFrame(other); err != nil {
+				t.Fatal(err)
+			}
+			if err := peer.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+			n, err := readTimeout(dev, buf, time.Second)
+			if err != nil {
+				t.Fatalf("ring %d frame %d: %v", ring, i, err)
+			}
+			if !bytes.Equal(buf[:n], frame) {
+				t.Fatalf("ring %d frame %d: got\n%x\nwant\n%x", ring, i, buf[:n], frame)
+			}
+		}
+		peer.Close()
+		if err := dev.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dev.ReadFrame(buf); err == nil {
+			t.Fatal("read from closed device")
+		}
+	}
+}
+
+// setupVeth creates a veth pair veth0-veth1 in a network namespace private to the
+// test goroutine, which stays locked to its thread. The test is skipped if the
+// namespace cannot be created.
+func setupVeth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread() // Not unlocked: the thread exits with the test goroutine.
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skip("creating network namespace:", err)
+	}
+	for _, args := range [][]string{
+		{"link", "add", "veth0", "type", "veth", "peer", "name", "veth1"},
+		{"link", "set", "veth0", "up"},
+		{"link", "set", "veth1", "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %v: %v: %s", args, err, out)
+		}
+	}
+}
+
+func ipv4Frame(src, dst net.HardwareAddr, dstIP net.IP, payload byte) []byte {
+	frame := make([]byte, dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader+1)
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	frame[12], frame[13] = 0x08, 0x00
+	ip := frame[dgrams.SizeEthernetHeaderNoVLAN:]
+	ip[0] = 0x45
+	ip[3] = dgrams.SizeIPHeader + 1
+	copy(ip[16:20], dstIP.To4())
+	ip[dgrams.SizeIPHeader] = payload
+	return frame
+}
+
+// readTimeout reads a frame from dev, closing dev if none is read within timeout.
+func readTimeout(dev *AFPacket, dst []byte, timeout time.Duration) (int, error) {
+	timer := time.AfterFunc(timeout, func() { dev.Close() })
+	defer timer.Stop()
+	return dev.ReadFrame(dst)
+}
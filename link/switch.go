@@ -0,0 +1,295 @@
+package link
+
+import (
+	"container/heap"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+const (
+	// defaultSwitchStep is the time a Switch advances per step when not configured.
+	defaultSwitchStep = time.Millisecond
+	// defaultSwitchMTU is the largest IP packet a Switch forwards when not configured.
+	defaultSwitchMTU = 1500
+)
+
+// Node is a host attached to a Switch, i.e. a tcpctl.Stack or tcpctl.Socket.
+type Node interface {
+	Tick(now time.Time)
+	RecvEthernet(buf []byte) (payloadStart, payloadEnd uint16, err error)
+	SendEthernet(dst []byte) (n int, err error)
+}
+
+// SimClock is a simulated clock which only advances when told to.
+// It is safe for concurrent use.
+type SimClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var _ tcpctl.Clock = (*SimClock)(nil)
+
+// NewSimClock returns a simulated clock set to start.
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+// Now returns the simulated time.
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the simulated time forward by d and returns the new time.
+func (c *SimClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// LinkConfig describes the impairments of the link between a Port and the
+// Switch, applied to the frames sent by the node of the port. The zero value
+// is an ideal link delivering frames in the next step.
+type LinkConfig struct {
+	// Latency is the time frames take to reach their destination.
+	Latency time.Duration
+	// Jitter is the maximum random variation of Latency, in both directions.
+	// Frames are reordered when the jitter exceeds the time between them.
+	Jitter time.Duration
+	// Loss is the probability of a frame being dropped.
+	Loss float64
+	// Duplicate is the probability of a frame being delivered twice.
+	Duplicate float64
+	// Reorder is the probability of a frame being delivered without Latency,
+	// overtaking frames sent before it.
+	Reorder float64
+	// Bandwidth is the rate of the link in bits per second. Frames are queued
+	// while the link transmits the frames preceding them. Zero is unlimited.
+	Bandwidth int64
+}
+
+// PortStats counts the frames sent and received by the node of a Port.
+type PortStats struct {
+	TxFrames   int
+	RxFrames   int
+	Lost       int
+	Duplicated int
+}
+
+// Port is the attachment of a Node to a Switch.
+type Port struct {
+	node  Node
+	cfg   LinkConfig
+	busy  time.Time // Transmission of the last frame sent ends.
+	stats PortStats
+}
+
+// Stats returns the frame counters of the port.
+func (p *Port) Stats() PortStats { return p.stats }
+
+// SwitchConfig contains the parameters of a Switch.
+type SwitchConfig struct {
+	// Clock is the simulated clock of the switch. Default is a clock
+	// starting at the Unix epoch.
+	Clock *SimClock
+	// Step is the time advanced per step. Default is 1ms.
+	Step time.Duration
+	// Seed seeds the random impairments of the links, making runs reproducible.
+	Seed int64
+	// MTU is the largest IP packet forwarded. Default is 1500.
+	MTU int
+}
+
+// Switch is an in-memory Ethernet segment connecting any number of nodes
+// through links with configurable impairments, driven by a simulated clock.
+// Frames are forwarded to the port the destination address was last seen on,
+// or to all ports if unknown. The switch runs step by step: the clock advances,
+// nodes are ticked, then frames are exchanged until none is due. A Switch is
+// not safe for concurrent use, though nodes may be used by other goroutines
+// while it runs.
+type Switch struct {
+	clock *SimClock
+	step  time.Duration
+	rng   *rand.Rand
+	ports []*Port
+	fdb   map[[6]byte]*Port
+	queue deliveryQueue
+	seq   uint64
+	buf   []byte
+}
+
+// NewSwitch returns a Switch with no ports.
+func NewSwitch(cfg SwitchConfig) *Switch {
+	if cfg.Clock == nil {
+		cfg.Clock = NewSimClock(time.Unix(0, 0))
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = defaultSwitchStep
+	}
+	if cfg.MTU <= 0 {
+		cfg.MTU = defaultSwitchMTU
+	}
+	return &Switch{
+		clock: cfg.Clock,
+		step:  cfg.Step,
+		rng:   rand.New(rand.NewSource(cfg.Seed)),
+		fdb:   make(map[[6]byte]*Port),
+		buf:   make([]byte, cfg.MTU+dgrams.SizeEthernetHeaderNoVLAN),
+	}
+}
+
+// Attach connects node to the switch through a link with impairments cfg.
+// The node is ticked with the simulated time right away.
+func (sw *Switch) Attach(node Node, cfg LinkConfig) *Port {
+	p := &Port{node: node, cfg: cfg}
+	sw.ports = append(sw.ports, p)
+	node.Tick(sw.clock.Now())
+	return p
+}
+
+// Now returns the simulated time.
+func (sw *Switch) Now() time.Time { return sw.clock.Now() }
+
+// Step advances the simulated time by one step, ticks the nodes and exchanges
+// the frames sent by the nodes and those due for delivery.
+func (sw *Switch) Step() {
+	now := sw.clock.Advance(sw.step)
+	for _, p := range sw.ports {
+		p.node.Tick(now)
+	}
+	for sw.exchange(now) {
+	}
+}
+
+// Run steps the switch for duration d of simulated time.
+func (sw *Switch) Run(d time.Duration) {
+	for end := sw.Now().Add(d); sw.Now().Before(end); {
+		sw.Step()
+	}
+}
+
+// RunUntil steps the switch until cond returns true or limit of simulated time
+// elapses, in which case it returns false. Other goroutines are given the chance
+// to run between steps so that cond may wait on users of the nodes.
+func (sw *Switch) RunUntil(cond func() bool, limit time.Duration) bool {
+	end := sw.Now().Add(limit)
+	for !cond() {
+		if !sw.Now().Before(end) {
+			return false
+		}
+		sw.Step()
+		runtime.Gosched()
+	}
+	return true
+}
+
+// exchange transmits the frames pending on the nodes and delivers the frames due
+// at now. It returns false if no frame was transmitted or delivered.
+func (sw *Switch) exchange(now time.Time) (moved bool) {
+	for _, p := range sw.ports {
+		for {
+			n, err := p.node.SendEthernet(sw.buf)
+			if err != nil || n == 0 {
+				break
+			}
+			sw.transmit(p, sw.buf[:n], now)
+			moved = true
+		}
+	}
+	for len(sw.queue) > 0 && !sw.queue[0].due.After(now) {
+		d := heap.Pop(&sw.queue).(delivery)
+		d.dst.stats.RxFrames++
+		d.dst.node.RecvEthernet(d.frame)
+		moved = true
+	}
+	return moved
+}
+
+// transmit schedules the delivery of frame sent by the node of src at now.
+func (sw *Switch) transmit(src *Port, frame []byte, now time.Time) {
+	if len(frame) < dgrams.SizeEthernetHeaderNoVLAN {
+		return
+	}
+	src.stats.TxFrames++
+	eth := dgrams.DecodeEthernetHeader(frame)
+	if eth.Source[0]&1 == 0 {
+		sw.fdb[eth.Source] = src
+	}
+	cfg := &src.cfg
+	if cfg.Loss > 0 && sw.rng.Float64() < cfg.Loss {
+		src.stats.Lost++
+		return
+	}
+	copies := 1
+	if cfg.Duplicate > 0 && sw.rng.Float64() < cfg.Duplicate {
+		src.stats.Duplicated++
+		copies = 2
+	}
+	sent := now
+	if cfg.Bandwidth > 0 {
+		if src.busy.After(sent) {
+			sent = src.busy
+		}
+		sent = sent.Add(time.Duration(int64(len(frame)) * 8 * int64(time.Second) / cfg.Bandwidth))
+		src.busy = sent
+	}
+	dst, known := sw.fdb[eth.Destination]
+	for i := 0; i < copies; i++ {
+		delay := cfg.Latency
+		if cfg.Jitter > 0 {
+			delay += time.Duration(sw.rng.Int63n(2*int64(cfg.Jitter)+1)) - cfg.Jitter
+		}
+		if delay < 0 || (cfg.Reorder > 0 && sw.rng.Float64() < cfg.Reorder) {
+			delay = 0
+		}
+		due := sent.Add(delay)
+		if known {
+			sw.deliver(dst, frame, due)
+			continue
+		}
+		for _, p := range sw.ports {
+			if p != src {
+				sw.deliver(p, frame, due)
+			}
+		}
+	}
+}
+
+func (sw *Switch) deliver(dst *Port, frame []byte, due time.Time) {
+	sw.seq++
+	heap.Push(&sw.queue, delivery{due: due, seq: sw.seq, dst: dst, frame: append([]byte{}, frame...)})
+}
+
+// delivery is a frame in flight to dst, delivered at due.
+type delivery struct {
+	due   time.Time
+	seq   uint64 // Frames due at the same time are delivered in order of transmission.
+	dst   *Port
+	frame []byte
+}
+
+// deliveryQueue is a min-heap of frames in flight ordered by delivery time.
+type deliveryQueue []delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q deliveryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *deliveryQueue) Push(x interface{}) { *q = append(*q, x.(delivery)) }
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
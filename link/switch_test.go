@@ -0,0 +1,240 @@
+package link_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/link"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// frameNode is a link.Node sending and recording raw Ethernet frames.
+type frameNode struct {
+	hw  [6]byte
+	now time.Time
+	out [][]byte
+	in  []arrival
+}
+
+type arrival struct {
+	at    time.Time
+	frame []byte
+}
+
+func (n *frameNode) Tick(now time.Time) { n.now = now }
+
+func (n *frameNode) RecvEthernet(buf []byte) (uint16, uint16, error) {
+	n.in = append(n.in, arrival{at: n.now, frame: append([]byte{}, buf...)})
+	return 0, 0, nil
+}
+
+func (n *frameNode) SendEthernet(dst []byte) (int, error) {
+	if len(n.out) == 0 {
+		return 0, nil
+	}
+	m := copy(dst, n.out[0])
+	n.out = n.out[1:]
+	return m, nil
+}
+
+// send queues a frame to dst of size bytes whose first payload byte is id.
+func (n *frameNode) send(dst [6]byte, id byte, size int) {
+	frame := make([]byte, size)
+	eth := dgrams.EthernetHeader{Destination: dst, Source: n.hw, SizeOrEtherType: uint16(dgrams.EtherTypeIPv4)}
+	eth.Put(frame)
+	frame[dgrams.SizeEthernetHeaderNoVLAN] = id
+	n.out = append(n.out, frame)
+}
+
+func (n *frameNode) ids() (ids []byte) {
+	for _, a := range n.in {
+		ids = append(ids, a.frame[dgrams.SizeEthernetHeaderNoVLAN])
+	}
+	return ids
+}
+
+func TestSwitchForwarding(t *testing.T) {
+	const latency = 10 * time.Millisecond
+	sw := link.NewSwitch(link.SwitchConfig{})
+	a, b, c := &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 1}}, &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 2}}, &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 3}}
+	for _, n := range []*frameNode{a, b, c} {
+		sw.Attach(n, link.LinkConfig{Latency: latency})
+	}
+	// Destination not yet seen: frame is flooded.
+	a.send(b.hw, 1, 64)
+	sent := sw.Now()
+	sw.Run(2 * latency)
+	if len(b.in) != 1 || len(c.in) != 1 {
+		t.Fatalf("expected flooded frame to reach b and c, got %d and %d", len(b.in), len(c.in))
+	}
+	if got := b.in[0].at.Sub(sent); got < latency || got > latency+time.Millisecond {
+		t.Fatal("expected frame delivered after latency, got", got)
+	}
+	b.send(a.hw, 2, 64)
+	sw.Step() // Switch learns port of b.
+	a.send(b.hw, 3, 64)
+	sw.Run(2 * latency)
+	if !bytes.Equal(a.ids(), []byte{2}) || !bytes.Equal(b.ids(), []byte{1, 3}) || len(c.in) != 1 {
+		t.Fatalf("expected frames forwarded to learned ports only, got a=%v b=%v c=%v", a.ids(), b.ids(), c.ids())
+	}
+}
+
+func TestSwitchImpairments(t *testing.T) {
+	const frames = 1000
+	for _, test := range []struct {
+		name  string
+		cfg   link.LinkConfig
+		check func(t *testing.T, stats link.PortStats, rx *frameNode)
+	}{
+		{name: "loss", cfg: link.LinkConfig{Loss: 0.3}, check: func(t *testing.T, stats link.PortStats, rx *frameNode) {
+			if stats.Lost < 250 || stats.Lost > 350 || len(rx.in) != frames-stats.Lost {
+				t.Errorf("lost %d frames, received %d", stats.Lost, len(rx.in))
+			}
+		}},
+		{name: "duplicate", cfg: link.LinkConfig{Duplicate: 0.2}, check: func(t *testing.T, stats link.PortStats, rx *frameNode) {
+			if stats.Duplicated < 150 || stats.Duplicated > 250 || len(rx.in) != frames+stats.Duplicated {
+				t.Errorf("duplicated %d frames, received %d", stats.Duplicated, len(rx.in))
+			}
+		}},
+		{name: "reorder", cfg: link.LinkConfig{Latency: 5 * time.Millisecond, Reorder: 0.1}, check: func(t *testing.T, stats link.PortStats, rx *frameNode) {
+			if len(rx.in) != frames || outOfOrder(rx.ids()) == 0 {
+				t.Errorf("expected all frames received with some reordered, got %d frames", len(rx.in))
+			}
+		}},
+		{name: "jitter", cfg: link.LinkConfig{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond}, check: func(t *testing.T, stats link.PortStats, rx *frameNode) {
+			if len(rx.in) != frames || outOfOrder(rx.ids()) == 0 {
+				t.Errorf("expected all frames received with some reordered, got %d frames", len(rx.in))
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sw := link.NewSwitch(link.SwitchConfig{Seed: 1})
+			tx, rx := &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 1}}, &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 2}}
+			port := sw.Attach(tx, test.cfg)
+			sw.Attach(rx, link.LinkConfig{})
+			for i := 0; i < frames; i++ {
+				tx.send(rx.hw, byte(i), 64)
+				sw.Step()
+			}
+			sw.Run(time.Second)
+			test.check(t, port.Stats(), rx)
+		})
+	}
+}
+
+func TestSwitchBandwidth(t *testing.T) {
+	const size = 1000
+	sw := link.NewSwitch(link.SwitchConfig{})
+	tx, rx := &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 1}}, &frameNode{hw: [6]byte{2, 0, 0, 0, 0, 2}}
+	sw.Attach(tx, link.LinkConfig{Bandwidth: 8 * size * 1000}) // 1000 frames per second.
+	sw.Attach(rx, link.LinkConfig{})
+	for i := 0; i < 10; i++ {
+		tx.send(rx.hw, byte(i), size)
+	}
+	start := sw.Now()
+	sw.Run(time.Second)
+	if len(rx.in) != 10 {
+		t.Fatal("expected all frames received, got", len(rx.in))
+	}
+	// Frames are sent in the first step.
+	if got := rx.in[9].at.Sub(start); got != 11*time.Millisecond {
+		t.Fatal("expected last frame received 10ms after first step, got", got)
+	}
+}
+
+func outOfOrder(ids []byte) (n int) {
+	for i := 1; i < len(ids); i++ {
+		if ids[i] != ids[i-1]+1 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSwitchTCP(t *testing.T) {
+	const size = 20000
+	lossy := link.LinkConfig{Latency: 5 * time.Millisecond, Jitter: time.Millisecond, Loss: 0.05}
+	sw := link.NewSwitch(link.SwitchConfig{Seed: 1})
+	server := newSimStack(t, sw, 1, lossy)
+	lfd, _ := server.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, tcpctl.IPPROTO_TCP)
+	server.Bind(lfd, nil, 80)
+	server.Listen(lfd, 2)
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	received := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			fd, err := server.Accept(lfd, nil, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				var got []byte
+				var buf [1024]byte
+				for {
+					n, err := server.Recv(fd, buf[:], 0, time.Time{})
+					got = append(got, buf[:n]...)
+					if err != nil {
+						break
+					}
+				}
+				server.Close(fd)
+				received <- got
+			}()
+		}
+	}()
+	for i := 2; i <= 3; i++ {
+		client := newSimStack(t, sw, byte(i), lossy)
+		go func() {
+			fd, _ := client.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, tcpctl.IPPROTO_TCP)
+			if err := client.Connect(fd, "192.168.0.1", nil, 80); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := client.Send(fd, data, 0, time.Time{}); err != nil {
+				t.Error(err)
+			}
+			client.Close(fd)
+		}()
+	}
+	var results [][]byte
+	ok := sw.RunUntil(func() bool {
+		select {
+		case got := <-received:
+			results = append(results, got)
+		default:
+		}
+		return len(results) == 2
+	}, 5*time.Minute)
+	if !ok {
+		t.Fatalf("transfers did not complete, %d done", len(results))
+	}
+	for _, got := range results {
+		if !bytes.Equal(got, data) {
+			t.Fatalf("data corrupted: got %d bytes, want %d", len(got), size)
+		}
+	}
+}
+
+// newSimStack attaches a stack with address 192.168.0.id to sw. Connections
+// are opened to the hardware address of the first stack.
+func newSimStack(t *testing.T, sw *link.Switch, id byte, cfg link.LinkConfig) *tcpctl.Stack {
+	t.Helper()
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:                net.IPv4(192, 168, 0, id),
+		HardwareAddr:        [6]byte{2, 0, 0, 0, 0, id},
+		GatewayHardwareAddr: [6]byte{2, 0, 0, 0, 0, 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.Attach(st, cfg)
+	return st
+}
@@ -0,0 +1,221 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// Constants of linux/if_tun.h missing from package syscall.
+const (
+	tunSetVnetLE = 0x400454dc // TUNSETVNETLE.
+	tunFCsum     = 0x01       // TUN_F_CSUM.
+	tunFTSO4     = 0x02       // TUN_F_TSO4.
+)
+
+// ifreqFlags is struct ifreq with the ifr_flags member of its union.
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// TUN is a Linux TUN interface exchanging IP packets preceded by virtio-net
+// headers (IFF_VNET_HDR), which offload checksums and segmentation to the
+// kernel. TCP segments the host sends arrive with their checksums verified and
+// coalesced up to 64KiB, and segments of up to 64KiB sent by the stack are
+// split by the kernel, which also completes their checksums. Run uses these
+// offloads since TUN implements tcpctl.OffloadDevice and tcpctl.TSODevice; the
+// stack should be configured with tcpctl.ChecksumTrustOffload not to verify
+// checksums again. Opening a TUN requires CAP_NET_ADMIN.
+type TUN struct {
+	f    *os.File
+	rc   syscall.RawConn
+	name string
+	mtu  int
+}
+
+var (
+	_ tcpctl.OffloadDevice = (*TUN)(nil)
+	_ tcpctl.TSODevice     = (*TUN)(nil)
+)
+
+// OpenTUN creates the TUN interface name, or attaches to it if it exists and
+// was created with virtio-net headers. If name is empty the kernel names the
+// interface, i.e. tun0, see Name. The interface must be configured and brought
+// up, i.e. with ip(8), for packets to flow.
+func OpenTUN(name string) (*TUN, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.New("interface name too long")
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+	req := ifreqFlags{flags: syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR}
+	copy(req.name[:], name)
+	err = ioctl(fd, syscall.TUNSETIFF, unsafe.Pointer(&req))
+	if err == nil {
+		// Headers are in the byte order of the host unless set to little-endian.
+		le := int32(1)
+		err = ioctl(fd, tunSetVnetLE, unsafe.Pointer(&le))
+	}
+	if err == nil {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETOFFLOAD, tunFCsum|tunFTSO4)
+		if errno != 0 {
+			err = os.NewSyscallError("ioctl", errno)
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	dev := &TUN{mtu: 1500}
+	for i, c := range req.name {
+		if c == 0 {
+			dev.name = string(req.name[:i])
+			break
+		}
+	}
+	if ifi, err := net.InterfaceByName(dev.name); err == nil && ifi.MTU > 0 {
+		dev.mtu = ifi.MTU
+	}
+	dev.f = os.NewFile(uintptr(fd), "tun:"+dev.name)
+	dev.rc, err = dev.f.SyscallConn()
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// ReadFrame reads a packet from the interface, waiting for one to be received.
+func (dev *TUN) ReadFrame(dst []byte) (int, error) {
+	n, _, err := dev.ReadFrameChecked(dst)
+	return n, err
+}
+
+// ReadFrameChecked reads a packet from the interface and reports whether the
+// kernel verified its checksums. Packets from the host carry a partial
+// checksum, which is completed. Packets larger than dst are truncated.
+func (dev *TUN) ReadFrameChecked(dst []byte) (n int, verified bool, err error) {
+	if len(dst) == 0 {
+		return 0, false, errors.New("empty buffer")
+	}
+	var hdr [dgrams.SizeVirtioNetHeader]byte
+	iov := [2]syscall.Iovec{{Base: &hdr[0]}, {Base: &dst[0]}}
+	iov[0].SetLen(len(hdr))
+	iov[1].SetLen(len(dst))
+	rerr := dev.rc.Read(func(fd uintptr) bool {
+		r, _, errno := syscall.Syscall(syscall.SYS_READV, fd, uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if errno == syscall.EAGAIN {
+			return false
+		} else if errno != 0 {
+			err = os.NewSyscallError("readv", errno)
+		}
+		n = int(r)
+		return true
+	})
+	if rerr != nil {
+		return 0, false, rerr
+	} else if err != nil {
+		return 0, false, err
+	}
+	if n < len(hdr) {
+		return 0, false, errors.New("packet without virtio-net header")
+	}
+	n -= len(hdr)
+	if n > len(dst) {
+		n = len(dst)
+	}
+	vnet := dgrams.DecodeVirtioNetHeader(hdr[:])
+	if vnet.Flags&dgrams.VirtioNetNeedsCsum != 0 && !vnet.CompleteChecksum(dst[:n]) {
+		return n, false, nil // Truncated, the stack drops it.
+	}
+	return n, vnet.Flags&(dgrams.VirtioNetNeedsCsum|dgrams.VirtioNetDataValid) != 0, nil
+}
+
+// WriteFrame writes a packet to the interface.
+func (dev *TUN) WriteFrame(frame []byte) error {
+	return dev.write(&dgrams.VirtioNetHeader{}, frame)
+}
+
+// WriteFrameOffload writes a TCP+IPv4 packet with a partial checksum to the
+// interface, which the kernel splits into segments of mss bytes of data if
+// larger.
+func (dev *TUN) WriteFrameOffload(frame []byte, mss int) error {
+	if len(frame) < dgrams.SizeIPHeader {
+		return errors.New("packet too short to contain IPv4")
+	}
+	ihl := int(frame[0]&0xf) * 4
+	vnet := dgrams.VirtioNetHeader{
+		Flags:      dgrams.VirtioNetNeedsCsum,
+		CsumStart:  uint16(ihl),
+		CsumOffset: 16, // TCP checksum.
+	}
+	if mss > 0 && len(frame) >= ihl+dgrams.SizeTCPHeaderNoOptions {
+		hdrlen := ihl + int(frame[ihl+12]>>4)*4
+		if len(frame)-hdrlen > mss {
+			vnet.GSOType = dgrams.VirtioGSOTCPv4
+			vnet.GSOSize = uint16(mss)
+			vnet.HdrLen = uint16(hdrlen)
+		}
+	}
+	return dev.write(&vnet, frame)
+}
+
+// write writes frame preceded by the virtio-net header vnet.
+func (dev *TUN) write(vnet *dgrams.VirtioNetHeader, frame []byte) error {
+	if len(frame) == 0 {
+		return errors.New("empty packet")
+	}
+	var hdr [dgrams.SizeVirtioNetHeader]byte
+	vnet.Put(hdr[:])
+	iov := [2]syscall.Iovec{{Base: &hdr[0]}, {Base: &frame[0]}}
+	iov[0].SetLen(len(hdr))
+	iov[1].SetLen(len(frame))
+	var err error
+	werr := dev.rc.Write(func(fd uintptr) bool {
+		_, _, errno := syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if errno == syscall.EAGAIN {
+			return false
+		} else if errno != 0 {
+			err = os.NewSyscallError("writev", errno)
+		}
+		return true
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+// MTU returns the MTU of the interface.
+func (dev *TUN) MTU() int { return dev.mtu }
+
+// HardwareAddr returns nil, TUN interfaces have no link layer.
+func (dev *TUN) HardwareAddr() net.HardwareAddr { return nil }
+
+// LinkType returns tcpctl.LinkIP.
+func (dev *TUN) LinkType() tcpctl.LinkType { return tcpctl.LinkIP }
+
+// Name returns the name of the interface.
+func (dev *TUN) Name() string { return dev.name }
+
+// Close closes the interface, unblocking ReadFrame. The interface is deleted
+// unless made persistent.
+func (dev *TUN) Close() error { return dev.f.Close() }
+
+// ioctl performs the ioctl request req on fd with a pointer argument.
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
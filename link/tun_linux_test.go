@@ -0,0 +1,97 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestTUNOffload(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread() // Not unlocked: the thread exits with the test goroutine.
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skip("creating network namespace:", err)
+	}
+	dev, err := OpenTUN("dgtun0")
+	if err != nil {
+		t.Skip("opening TUN:", err)
+	}
+	defer dev.Close()
+	for _, args := range [][]string{
+		{"addr", "add", "10.0.1.1/24", "dev", dev.Name()},
+		{"link", "set", dev.Name(), "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %v: %v: %s", args, err, out)
+		}
+	}
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:           net.IPv4(10, 0, 1, 2),
+		ChecksumPolicy: tcpctl.ChecksumTrustOffload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go st.Run(ctx, dev)
+	lfd, _ := st.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, tcpctl.IPPROTO_TCP)
+	st.SetSockOpt(lfd, tcpctl.SOL_SOCKET, tcpctl.SO_RCVBUF, 1<<18)
+	st.SetSockOpt(lfd, tcpctl.SOL_SOCKET, tcpctl.SO_SNDBUF, 1<<18)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+
+	// The stack echoes all it receives.
+	const size = 1 << 20
+	go func() {
+		fd, err := st.Accept(lfd, nil, 0)
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 1<<16)
+		for total := 0; total < size; {
+			n, err := st.Recv(fd, buf, 0, time.Now().Add(5*time.Second))
+			if err != nil {
+				return
+			}
+			st.Send(fd, buf[:n], 0, time.Now().Add(5*time.Second))
+			total += n
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", "10.0.1.2:80", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go conn.Write(data)
+	echo := make([]byte, size)
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatal("echoed data differs")
+	}
+	stats := st.Stats()
+	if mss := size / 1448; stats.InSegs > uint64(mss/2) || stats.OutSegs < uint64(mss) {
+		t.Fatalf("expected segments received coalesced and sent split, got %d in and %d out for %d bytes", stats.InSegs, stats.OutSegs, size)
+	}
+	if stats.InErrs != 0 || stats.InHdrErrors != 0 {
+		t.Fatalf("unexpected errors: %+v", stats)
+	}
+}
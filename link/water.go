@@ -0,0 +1,92 @@
+// Package link implements the network devices a tcpctl.Stack sends and receives
+// frames through, see tcpctl.Device.
+package link
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+
+	"github.com/songgao/water"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// Water is a TAP or TUN interface created with the water package. TAP
+// interfaces exchange Ethernet frames and TUN interfaces IP packets.
+type Water struct {
+	iface *water.Interface
+	hw    net.HardwareAddr
+	mtu   int
+}
+
+var _ tcpctl.Device = (*Water)(nil)
+
+// OpenWater creates a TAP or TUN interface as configured by cfg, see NewWater.
+func OpenWater(cfg water.Config, hw net.HardwareAddr) (*Water, error) {
+	iface, err := water.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := NewWater(iface, hw)
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// NewWater returns the device of a TAP or TUN interface. The stack is a host on
+// the link at the other end of a TAP interface, so its hardware address hw must
+// differ from that of the interface. If hw is nil a random locally administered
+// address is used. hw is not used on TUN interfaces. The MTU is that of the
+// interface, which is 1500 if the system does not report it.
+func NewWater(iface *water.Interface, hw net.HardwareAddr) (*Water, error) {
+	dev := &Water{iface: iface, mtu: 1500}
+	if ifi, err := net.InterfaceByName(iface.Name()); err == nil && ifi.MTU > 0 {
+		dev.mtu = ifi.MTU
+	}
+	if iface.IsTUN() {
+		return dev, nil
+	}
+	switch {
+	case hw == nil:
+		hw = make(net.HardwareAddr, 6)
+		if _, err := rand.Read(hw); err != nil {
+			return nil, err
+		}
+		hw[0] = hw[0]&^0b01 | 0b10 // Unicast, locally administered.
+	case len(hw) != 6:
+		return nil, errors.New("hardware address must be an EUI-48")
+	}
+	dev.hw = append(net.HardwareAddr{}, hw...)
+	return dev, nil
+}
+
+// ReadFrame reads a frame from the interface.
+func (dev *Water) ReadFrame(dst []byte) (int, error) { return dev.iface.Read(dst) }
+
+// WriteFrame writes a frame to the interface.
+func (dev *Water) WriteFrame(frame []byte) error {
+	_, err := dev.iface.Write(frame)
+	return err
+}
+
+// MTU returns the MTU of the interface.
+func (dev *Water) MTU() int { return dev.mtu }
+
+// HardwareAddr returns the hardware address of the stack on a TAP interface, nil on TUN.
+func (dev *Water) HardwareAddr() net.HardwareAddr { return dev.hw }
+
+// LinkType returns tcpctl.LinkEthernet for TAP interfaces and tcpctl.LinkIP for TUN.
+func (dev *Water) LinkType() tcpctl.LinkType {
+	if dev.iface.IsTAP() {
+		return tcpctl.LinkEthernet
+	}
+	return tcpctl.LinkIP
+}
+
+// Name returns the name of the interface.
+func (dev *Water) Name() string { return dev.iface.Name() }
+
+// Close closes the interface, unblocking ReadFrame.
+func (dev *Water) Close() error { return dev.iface.Close() }
@@ -0,0 +1,59 @@
+//go:build taptest || tuntest || afpackettest
+
+package dgrams_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+var (
+	// stackAddr is the address of the stack on the link set up by taptest.sh, tuntest.sh and afpackettest.sh.
+	stackAddr = net.IPv4(192, 168, 0, 3)
+	// stackHardwareAddr is the hardware address of the stack on a TAP link, and of veth1 in afpackettest.sh.
+	stackHardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+)
+
+// serveStack runs a stack on dev answering HTTP requests on port 80 until the test is killed.
+func serveStack(t *testing.T, dev tcpctl.Device) {
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{Addr: stackAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		err := st.Run(context.Background(), dev)
+		t.Error("stack stopped:", err)
+	}()
+	lfd, err := st.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, tcpctl.IPPROTO_TCP)
+	if err == nil {
+		err = st.Bind(lfd, nil, 80)
+	}
+	if err == nil {
+		err = st.Listen(lfd, 4)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		fd, err := st.Accept(lfd, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer st.Close(fd)
+			var buf [1024]byte
+			n, err := st.Recv(fd, buf[:], 0, time.Now().Add(10*time.Second))
+			if err != nil {
+				fmt.Println("[ERR]", err)
+				return
+			}
+			fmt.Println("[RCV] ", string(buf[:n]))
+			st.Send(fd, []byte("HTTP/1.0 200 OK\r\n\r\nHello world!\n"), 0, time.Time{})
+		}()
+	}
+}
@@ -0,0 +1,235 @@
+package tcpctl
+
+import (
+	"math"
+	"time"
+)
+
+// CongestionControl is implemented by congestion control algorithms. The
+// connection runs loss detection and recovery (RFC 6675 and RFC 6582) and
+// notifies the algorithm of the events which change the congestion window.
+// All sizes are in bytes. Implementations need not be safe for concurrent use,
+// they are called with the connection's lock held.
+type CongestionControl interface {
+	// Init resets the algorithm state for a new connection with sender
+	// maximum segment size mss.
+	Init(mss uint32)
+	// OnAck is called when acked bytes of new data are acknowledged outside
+	// of loss recovery. rtt is the smoothed round trip time, zero if unknown.
+	OnAck(acked uint32, rtt time.Duration, now time.Time)
+	// OnLoss is called when loss is detected by duplicate acknowledgments or
+	// SACK information and loss recovery starts. inflight is the amount of
+	// data outstanding in the network (FlightSize).
+	OnLoss(inflight uint32, now time.Time)
+	// OnRTO is called when the retransmission timer expires.
+	OnRTO(inflight uint32, now time.Time)
+	// Cwnd returns the congestion window.
+	Cwnd() uint32
+	// Ssthresh returns the slow start threshold.
+	Ssthresh() uint32
+}
+
+var (
+	_ CongestionControl = (*NewReno)(nil)
+	_ CongestionControl = (*Cubic)(nil)
+)
+
+// initialWindow returns the initial congestion window for a given maximum
+// segment size as described by RFC 5681 section 3.1.
+func initialWindow(mss uint32) uint32 {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	default:
+		return 4 * mss
+	}
+}
+
+// lossWindow returns the slow start threshold after a loss or timeout
+// as described by RFC 5681 equation (4).
+func lossWindow(inflight, mss uint32) uint32 {
+	ssthresh := inflight / 2
+	if ssthresh < 2*mss {
+		ssthresh = 2 * mss
+	}
+	return ssthresh
+}
+
+// NewReno implements the standard TCP congestion control algorithm: slow start
+// and congestion avoidance of RFC 5681 with appropriate byte counting, and the
+// window reduction of fast recovery. The NewReno modification to fast recovery
+// described in RFC 6582 is implemented by the connection, which keeps loss
+// recovery going on partial acknowledgments.
+type NewReno struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+	// acked counts bytes acknowledged during congestion avoidance.
+	acked uint32
+}
+
+// Init implements CongestionControl.
+func (r *NewReno) Init(mss uint32) {
+	*r = NewReno{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: math.MaxUint32,
+	}
+}
+
+// OnAck implements CongestionControl.
+func (r *NewReno) OnAck(acked uint32, rtt time.Duration, now time.Time) {
+	if r.cwnd < r.ssthresh {
+		// Slow start, increase by at most one segment per ACK (RFC 5681 eq. (2)).
+		if acked > r.mss {
+			acked = r.mss
+		}
+		r.cwnd += acked
+		return
+	}
+	// Congestion avoidance, increase by one segment per window acknowledged.
+	r.acked += acked
+	if r.acked >= r.cwnd {
+		r.acked -= r.cwnd
+		r.cwnd += r.mss
+	}
+}
+
+// OnLoss implements CongestionControl.
+func (r *NewReno) OnLoss(inflight uint32, now time.Time) {
+	r.ssthresh = lossWindow(inflight, r.mss)
+	r.cwnd = r.ssthresh
+	r.acked = 0
+}
+
+// OnRTO implements CongestionControl.
+func (r *NewReno) OnRTO(inflight uint32, now time.Time) {
+	r.ssthresh = lossWindow(inflight, r.mss)
+	r.cwnd = r.mss // Loss window is one segment.
+	r.acked = 0
+}
+
+// Cwnd implements CongestionControl.
+func (r *NewReno) Cwnd() uint32 { return r.cwnd }
+
+// Ssthresh implements CongestionControl.
+func (r *NewReno) Ssthresh() uint32 { return r.ssthresh }
+
+// CUBIC constants as recommended by RFC 8312.
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+	// cubicAlpha makes the TCP-friendly window grow at the same average rate as standard TCP.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// Cubic implements the CUBIC congestion control algorithm described by RFC 8312.
+// The window grows as a cubic function of the time elapsed since the last
+// congestion event, which makes it independent of RTT and better suited for
+// paths with a large bandwidth-delay product. Slow start and timeouts
+// follow standard TCP behaviour.
+type Cubic struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+	// wmax is the window in segments just before the last window reduction.
+	wmax float64
+	// k is the time in seconds the cubic function takes to increase the window to wmax.
+	k float64
+	// epoch is the start of the current congestion avoidance period. Zero if not started.
+	epoch time.Time
+	// west is the window in segments standard TCP would have (TCP-friendly region).
+	west float64
+	// inc accumulates fractional increases of the window in segments.
+	inc float64
+}
+
+// Init implements CongestionControl.
+func (c *Cubic) Init(mss uint32) {
+	*c = Cubic{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: math.MaxUint32,
+	}
+}
+
+// OnAck implements CongestionControl.
+func (c *Cubic) OnAck(acked uint32, rtt time.Duration, now time.Time) {
+	if c.cwnd < c.ssthresh {
+		if acked > c.mss {
+			acked = c.mss
+		}
+		c.cwnd += acked
+		return
+	}
+	mss := float64(c.mss)
+	cwnd := float64(c.cwnd) / mss
+	if c.epoch.IsZero() {
+		c.epoch = now
+		if cwnd < c.wmax {
+			c.k = math.Cbrt((c.wmax - cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wmax = cwnd
+		}
+		c.west = cwnd
+		c.inc = 0
+	}
+	// Target window one RTT into the future, equation (1).
+	t := now.Sub(c.epoch).Seconds() + rtt.Seconds() - c.k
+	target := cubicC*t*t*t + c.wmax
+	// TCP-friendly window estimate, equation (4).
+	segs := float64(acked) / mss
+	c.west += cubicAlpha * segs / cwnd
+	switch {
+	case target < c.west:
+		// TCP-friendly region, grow at least as fast as standard TCP.
+		c.inc += c.west - cwnd
+	case target > cwnd:
+		// Concave and convex regions.
+		c.inc += (target - cwnd) / cwnd * segs
+	default:
+		c.inc += segs / (100 * cwnd)
+	}
+	if c.inc >= 1.0/mss {
+		bytes := uint32(c.inc * mss)
+		c.cwnd += bytes
+		c.inc -= float64(bytes) / mss
+	}
+}
+
+// reduce records the window before a congestion event, applying fast convergence.
+func (c *Cubic) reduce() {
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	if cwnd < c.wmax {
+		// Fast convergence, release bandwidth for new flows.
+		c.wmax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wmax = cwnd
+	}
+	c.ssthresh = uint32(float64(c.cwnd) * cubicBeta)
+	if c.ssthresh < 2*c.mss {
+		c.ssthresh = 2 * c.mss
+	}
+	c.epoch = time.Time{}
+}
+
+// OnLoss implements CongestionControl.
+func (c *Cubic) OnLoss(inflight uint32, now time.Time) {
+	c.reduce()
+	c.cwnd = c.ssthresh
+}
+
+// OnRTO implements CongestionControl.
+func (c *Cubic) OnRTO(inflight uint32, now time.Time) {
+	c.reduce()
+	c.cwnd = c.mss
+}
+
+// Cwnd implements CongestionControl.
+func (c *Cubic) Cwnd() uint32 { return c.cwnd }
+
+// Ssthresh implements CongestionControl.
+func (c *Cubic) Ssthresh() uint32 { return c.ssthresh }
@@ -0,0 +1,166 @@
+package tcpctl_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+const simMSS = 1000
+
+// simulate drives cc with an ideal ACK clock for the given number of rounds: every
+// round trip the whole congestion window is sent and acknowledged one segment at
+// a time. event, if not nil, is called at the end of each round and may signal
+// a loss or timeout to cc.
+// The window in segments at the start of each round is returned.
+func simulate(cc tcpctl.CongestionControl, now time.Time, rounds int, rtt time.Duration, event func(round int, now time.Time)) (trace []float64) {
+	for round := 0; round < rounds; round++ {
+		cwnd := cc.Cwnd()
+		trace = append(trace, float64(cwnd)/simMSS)
+		segs := int(cwnd / simMSS)
+		for i := 0; i < segs; i++ {
+			cc.OnAck(simMSS, rtt, now.Add(rtt*time.Duration(i)/time.Duration(segs)))
+		}
+		now = now.Add(rtt)
+		if event != nil {
+			event(round, now)
+		}
+	}
+	return trace
+}
+
+func TestNewRenoTrace(t *testing.T) {
+	var cc tcpctl.NewReno
+	cc.Init(simMSS)
+	trace := simulate(&cc, time.Unix(0, 0), 15, 100*time.Millisecond, func(round int, now time.Time) {
+		switch round {
+		case 4:
+			cc.OnLoss(cc.Cwnd(), now) // Fast retransmit halves the window.
+		case 9:
+			cc.OnRTO(cc.Cwnd(), now) // Timeout collapses window to one segment.
+		}
+	})
+	want := []float64{
+		4, 8, 16, 32, 64, // Slow start from RFC 5681 initial window.
+		64, 65, 66, 67, 68, // Congestion avoidance grows by one segment per RTT.
+		1, 2, 4, 8, 16, // Slow start again after RTO.
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Fatalf("round %d: want cwnd %v, got %v\ntrace: %v", i, want[i], trace[i], trace)
+		}
+	}
+	if cc.Ssthresh() != 69*simMSS/2 {
+		t.Errorf("expected ssthresh of half the window on timeout, got %d", cc.Ssthresh())
+	}
+}
+
+func TestCubicTrace(t *testing.T) {
+	const (
+		wmax = 100
+		rtt  = 100 * time.Millisecond
+		C    = 0.4
+		beta = 0.7
+	)
+	var cc tcpctl.Cubic
+	cc.Init(simMSS)
+	start := time.Unix(0, 0)
+	for cc.Cwnd() < wmax*simMSS {
+		cc.OnAck(simMSS, rtt, start)
+	}
+	cc.OnLoss(cc.Cwnd(), start)
+	if cc.Cwnd() != beta*wmax*simMSS || cc.Ssthresh() != cc.Cwnd() {
+		t.Fatalf("expected multiplicative decrease to %v, got cwnd=%d ssthresh=%d", beta*wmax*simMSS, cc.Cwnd(), cc.Ssthresh())
+	}
+	// Time taken to reach wmax again, equation (2) of RFC 8312.
+	K := math.Cbrt(wmax * (1 - beta) / C)
+	rounds := int(2 * K / rtt.Seconds())
+	trace := simulate(&cc, start, rounds, rtt, nil)
+	for i, got := range trace {
+		tt := float64(i) * rtt.Seconds()
+		want := C*math.Pow(tt-K, 3) + wmax
+		if math.Abs(got-want) > 3 {
+			t.Fatalf("round %d: cwnd %.1f deviates from cubic function %.1f", i, got, want)
+		}
+	}
+	// Window plateaus around wmax: growth is concave before K and convex after.
+	k := int(K / rtt.Seconds())
+	growth := func(i int) float64 { return trace[i+1] - trace[i] }
+	if !(growth(1) > growth(k) && growth(rounds-2) > growth(k)) {
+		t.Errorf("expected cubic growth around K=%.2fs, got %v", K, trace)
+	}
+
+	// Fast convergence: a loss before regaining the previous wmax lowers wmax further.
+	cc.OnLoss(cc.Cwnd(), start)
+	w := float64(cc.Cwnd()) / simMSS
+	cc.OnLoss(cc.Cwnd(), start)
+	wmax2 := w * (1 + beta) / 2
+	K2 := math.Cbrt((wmax2 - float64(cc.Cwnd())/simMSS) / C)
+	trace = simulate(&cc, start, int(K2/rtt.Seconds())+1, rtt, nil)
+	if got := trace[len(trace)-1]; math.Abs(got-wmax2) > 0.05*wmax2 || got > w-5 {
+		t.Errorf("expected plateau at reduced wmax %.1f below %.1f, got %.1f", wmax2, w, got)
+	}
+}
+
+// fixedWindow is a congestion control algorithm with a constant window.
+type fixedWindow uint32
+
+func (w fixedWindow) Init(mss uint32)                                      {}
+func (w fixedWindow) OnAck(acked uint32, rtt time.Duration, now time.Time) {}
+func (w fixedWindow) OnLoss(inflight uint32, now time.Time)                {}
+func (w fixedWindow) OnRTO(inflight uint32, now time.Time)                 {}
+func (w fixedWindow) Cwnd() uint32                                         { return uint32(w) }
+func (w fixedWindow) Ssthresh() uint32                                     { return uint32(w) }
+
+func TestSocketSlowStart(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	const mss = 536        // MSS for an MTU of 576 without timestamps.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetBuffers(make([]byte, 20000), make([]byte, 2048))
+	s.SetMTU(mss + 40)
+	s.SetTimestamps(false)
+	s.SetSACK(false)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	s.Write(make([]byte, 20000))
+	sendAll := func() (segs []dgrams.TCPHeader) {
+		for {
+			n, _ := s.SendTCP(buf[:])
+			if n == 0 {
+				return segs
+			}
+			segs = append(segs, dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n]))
+		}
+	}
+	// Initial window of 4 segments for MSS of 536 (RFC 5681).
+	if segs := sendAll(); len(segs) != 4 {
+		t.Fatalf("expected initial window of 4 segments, sent %d", len(segs))
+	}
+	// Slow start: an ACK covering two segments grows the window by one segment.
+	recvTCP(t, &s, irs+1, iss+1+2*mss, dgrams.FlagTCP_ACK, 100, nil)
+	if segs := sendAll(); len(segs) != 3 {
+		t.Fatalf("expected 3 segments after ACK in slow start, sent %d", len(segs))
+	}
+
+	// Three duplicate ACKs trigger fast retransmit of the first unacknowledged segment.
+	una := iss + 1 + 2*mss
+	for i := 0; i < 3; i++ {
+		recvTCP(t, &s, irs+1, una, dgrams.FlagTCP_ACK, 100, nil)
+	}
+	segs := sendAll()
+	if len(segs) == 0 || segs[0].Seq != una {
+		t.Fatalf("expected fast retransmit of seq %d, got %v", una-iss, segs)
+	}
+	// NewReno: a partial ACK retransmits the next unacknowledged segment.
+	recvTCP(t, &s, irs+1, una+mss, dgrams.FlagTCP_ACK, 100, nil)
+	segs = sendAll()
+	if len(segs) == 0 || segs[0].Seq != una+mss {
+		t.Fatalf("expected retransmit on partial ACK of seq %d, got %v", una+mss-iss, segs)
+	}
+}
@@ -0,0 +1,73 @@
+package tcpctl
+
+import "github.com/soypat/dgrams"
+
+// ChecksumPolicy is how a Socket or Stack handles packets received with a bad
+// IPv4 header, TCP or ICMP checksum. Bad checksums are counted in Stats and
+// logged as EventBadChecksum whatever the policy.
+type ChecksumPolicy uint8
+
+const (
+	// ChecksumDrop verifies the checksums of every packet received and drops
+	// those with a bad checksum. It is the default.
+	ChecksumDrop ChecksumPolicy = iota
+	// ChecksumAccept verifies the checksums of every packet received and
+	// accepts those with a bad checksum, i.e. to diagnose a link corrupting
+	// packets or a peer miscomputing checksums.
+	ChecksumAccept
+	// ChecksumTrustOffload is like ChecksumDrop except for the packets whose
+	// checksums the link layer claims to have verified, which are not verified
+	// again. See OffloadDevice.
+	ChecksumTrustOffload
+)
+
+// SetChecksumPolicy sets how the socket handles packets received with a bad
+// checksum. Sockets of a Stack follow StackConfig.ChecksumPolicy instead.
+func (s *Socket) SetChecksumPolicy(p ChecksumPolicy) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.csum = p
+}
+
+// verifyChecksums verifies the checksums of the IPv4 packet in buf following
+// the checksum policy of the socket. It returns an error if the packet must be dropped.
+func (s *Socket) verifyChecksums(buf []byte) error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	drop, err := checkChecksums(buf, s.csum, &s.cs.stats)
+	if err == nil {
+		return nil
+	}
+	if s.cs.logEnabled(LevelWarn) {
+		e := Event{Kind: EventBadChecksum, Level: LevelWarn, Err: err}
+		if ihl := int(buf[0]&0xf) * 4; ihl >= dgrams.SizeIPHeader && len(buf) >= ihl+dgrams.SizeTCPHeaderNoOptions && buf[9] == 6 {
+			tcp := dgrams.DecodeTCPHeader(buf[ihl:])
+			e.Seq, e.Ack, e.Flags, e.Window = Seq(tcp.Seq), Seq(tcp.Ack), tcp.Flags(), tcp.WindowSize
+		}
+		s.cs.logEvent(e)
+	}
+	if drop {
+		return err
+	}
+	return nil
+}
+
+// checkChecksums verifies the checksums of the IPv4 packet in buf, counting bad
+// checksums and malformed packets in stats. It returns the reason the packet is
+// bad, if any, and whether it must be dropped following policy.
+func checkChecksums(buf []byte, policy ChecksumPolicy, stats *Stats) (drop bool, err error) {
+	err = dgrams.VerifyChecksumsIPv4(buf)
+	switch err {
+	case nil:
+		return false, nil
+	case dgrams.ErrIPv4HeaderChecksum:
+		stats.InHdrErrors++
+	case dgrams.ErrChecksum:
+		stats.InErrs++
+		stats.InCsumErrors++
+	default:
+		stats.InHdrErrors++
+		return true, err // Malformed, the checksums cannot be verified.
+	}
+	return policy != ChecksumAccept, err
+}
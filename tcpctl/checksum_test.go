@@ -0,0 +1,113 @@
+package tcpctl_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestSocketChecksumPolicy(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	iss := establish(t, &s, time.Unix(0, 0))
+	inSegs := s.Stats().InSegs
+	corrupt := tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil, []byte("data"))
+	corrupt[len(corrupt)-1] ^= 1
+	if _, _, err := s.RecvTCP(corrupt); err != dgrams.ErrChecksum {
+		t.Fatal("expected segment with bad checksum to be dropped, got", err)
+	}
+	badHeader := tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil, []byte("data"))
+	badHeader[8]-- // TTL.
+	if _, _, err := s.RecvTCP(badHeader); err != dgrams.ErrIPv4HeaderChecksum {
+		t.Fatal("expected packet with bad header checksum to be dropped, got", err)
+	}
+	var buf [8]byte
+	if n, _ := s.Read(buf[:]); n != 0 {
+		t.Fatal("expected no data from dropped segments")
+	}
+	stats := s.Stats()
+	if stats.InErrs != 1 || stats.InCsumErrors != 1 || stats.InHdrErrors != 1 {
+		t.Fatalf("expected bad checksums counted, got %+v", stats)
+	}
+	if stats.InSegs != inSegs {
+		t.Fatal("expected segments dropped for bad checksums not counted as received, got", stats.InSegs-inSegs)
+	}
+
+	s.SetChecksumPolicy(tcpctl.ChecksumAccept)
+	if _, _, err := s.RecvTCP(corrupt); err != nil {
+		t.Fatal("expected segment with bad checksum to be accepted, got", err)
+	}
+	if n, _ := s.Read(buf[:]); n != 4 {
+		t.Fatal("expected data of segment with bad checksum, got", n)
+	}
+	if stats = s.Stats(); stats.InCsumErrors != 2 {
+		t.Fatal("expected accepted bad checksum counted, got", stats.InCsumErrors)
+	}
+}
+
+// offloadFrame is a frame received by an offloadDevice.
+type offloadFrame struct {
+	frame    []byte
+	verified bool
+}
+
+// offloadDevice is a chanDevice whose link layer reports whether it verified
+// the checksums of the frames received on rxc.
+type offloadDevice struct {
+	chanDevice
+	rxc chan offloadFrame
+}
+
+func (d *offloadDevice) ReadFrameChecked(dst []byte) (int, bool, error) {
+	f, ok := <-d.rxc
+	if !ok {
+		return 0, false, io.EOF
+	}
+	return copy(dst, f.frame), f.verified, nil
+}
+
+func TestStackChecksumTrustOffload(t *testing.T) {
+	dev := &offloadDevice{
+		chanDevice: chanDevice{tx: make(chan []byte, 16), hw: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		rxc:        make(chan offloadFrame),
+	}
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:           net.IPv4(192, 168, 1, 5),
+		MaxSockets:     3,
+		ChecksumPolicy: tcpctl.ChecksumTrustOffload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- st.Run(ctx, dev) }()
+
+	const tcpChecksum = dgrams.SizeEthernetHeaderNoVLAN + dgrams.SizeIPHeader + 16
+	corrupt := append([]byte{}, packetSyn...)
+	corrupt[tcpChecksum] ^= 0xff
+	dev.rxc <- offloadFrame{frame: corrupt}
+	// Same SYN from another port, which the link layer claims is verified.
+	trusted := append([]byte{}, corrupt...)
+	trusted[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader+1]++
+	dev.rxc <- offloadFrame{frame: trusted, verified: true}
+	_, synack, _ := dev.next(t)
+	if synack.Flags() != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK || synack.DestinationPort != 58921 {
+		t.Fatalf("expected SYN-ACK to the trusted SYN only, got %s to port %d", synack.Flags(), synack.DestinationPort)
+	}
+	if stats := st.Stats(); stats.InCsumErrors != 1 {
+		t.Fatal("expected unverified SYN to be dropped, got", stats.InCsumErrors)
+	}
+
+	cancel()
+	<-done
+	close(dev.rxc)
+}
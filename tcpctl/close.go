@@ -0,0 +1,120 @@
+package tcpctl
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// timeWaitTimeout is the time a connection stays in TIME-WAIT, twice the
+// Maximum Segment Lifetime. An MSL of 30 seconds is used like most
+// implementations do instead of the 2 minutes of RFC 9293.
+const timeWaitTimeout = 2 * 30 * time.Second
+
+var (
+	errConnReset   = errors.New("connection reset by peer")
+	errConnRefused = errors.New("connection refused")
+)
+
+// Close closes the connection gracefully. Data already written is sent to the
+// remote peer followed by a FIN, after which no more data can be written.
+// Data received keeps being delivered by Read until the remote peer closes
+// its side of the connection. Close does not block and calling it on a
+// connection already closing or closed does nothing.
+func (s *Socket) Close() error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	if s.cs.closing {
+		return nil
+	}
+	switch s.cs.state {
+	case StateClosed:
+		return nil
+	case StateListen, StateSynSent:
+		s.cs.abort(nil)
+		return nil
+	case StateEstablished:
+		s.cs.setState(StateFinWait1)
+	case StateCloseWait:
+		s.cs.setState(StateLastAck)
+	case StateSynRcvd:
+		// FIN is sent once our SYN is acknowledged and the connection established.
+	default:
+		return errors.New("close on connection in state " + s.cs.state.String())
+	}
+	s.cs.closing = true
+	s.cs.notify()
+	return nil
+}
+
+// resetClose clears the connection termination state for a new connection. cs.mu must be held.
+func (cs *connState) resetClose() {
+	cs.closing = false
+	cs.finSent = false
+	cs.finRcvd = false
+	cs.timeWait = time.Time{}
+	cs.err = nil
+}
+
+// finRcv processes a FIN received with sequence number seq. FINs received out
+// of order are dropped, the remote peer retransmits them along with the data
+// preceding them. cs.mu must be held.
+func (cs *connState) finRcv(seq Seq) {
+	if cs.finRcvd || seq != cs.rcv.NXT {
+		return
+	}
+	cs.finRcvd = true
+	cs.rcv.NXT = cs.rcv.NXT.Add(1)
+	cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	switch cs.state {
+	case StateEstablished:
+		cs.setState(StateCloseWait)
+	case StateFinWait1:
+		// Our FIN is not yet acknowledged, else we would be in FIN-WAIT-2.
+		cs.setState(StateClosing)
+	case StateFinWait2:
+		cs.enterTimeWait()
+	}
+	cs.notify()
+}
+
+// finAcked is called when the remote peer acknowledges our FIN. cs.mu must be held.
+func (cs *connState) finAcked() {
+	switch cs.state {
+	case StateFinWait1:
+		cs.setState(StateFinWait2)
+	case StateClosing:
+		cs.enterTimeWait()
+	case StateLastAck:
+		cs.setState(StateClosed)
+	}
+	cs.notify()
+}
+
+// enterTimeWait moves the connection to TIME-WAIT, where it lingers so that
+// the ACK of the remote peer's FIN can be retransmitted if lost and old
+// duplicate segments die out before the connection is reused. cs.mu must be held.
+func (cs *connState) enterTimeWait() {
+	cs.setState(StateTimeWait)
+	cs.timeWait = cs.now.Add(timeWaitTimeout)
+}
+
+// timeWaitTick closes the connection once the TIME-WAIT timeout expires. cs.mu must be held.
+func (cs *connState) timeWaitTick(now time.Time) {
+	if cs.state == StateTimeWait && !now.Before(cs.timeWait) {
+		cs.setState(StateClosed)
+		cs.notify()
+	}
+}
+
+// notify wakes up a Conn blocked reading or writing. cs.mu must be held.
+func (cs *connState) notify() {
+	for _, ch := range [...]chan struct{}{cs.rdWake, cs.wrWake} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
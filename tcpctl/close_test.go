@@ -0,0 +1,114 @@
+package tcpctl_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+const timeWaitTimeout = 60 * time.Second
+
+func TestActiveClose(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	iss := establish(t, &s, now)
+	s.Write([]byte("bye"))
+	s.Close()
+	if s.State() != tcpctl.StateFinWait1 {
+		t.Fatal("expected FIN-WAIT-1 after close, got", s.State())
+	}
+	if _, err := s.Write([]byte("more")); err == nil {
+		t.Fatal("expected error writing to closed connection")
+	}
+	seg := sendTCP(t, &s, buf[:])
+	if !seg.Flags().HasFlags(dgrams.FlagTCP_FIN) || string(tcpPayload(buf[:], &seg)) != "bye" {
+		t.Fatalf("expected FIN to follow buffered data, got flags=%s", seg.Flags())
+	}
+	recvTCP(t, &s, irs+1, iss+5, dgrams.FlagTCP_ACK, 100, nil)
+	if s.State() != tcpctl.StateFinWait2 {
+		t.Fatal("expected FIN-WAIT-2 after FIN acknowledged, got", s.State())
+	}
+	// Remote peer keeps sending data until it closes too.
+	recvTCP(t, &s, irs+1, iss+5, dgrams.FlagTCP_ACK|dgrams.FlagTCP_FIN, 100, []byte("ok"))
+	if s.State() != tcpctl.StateTimeWait {
+		t.Fatal("expected TIME-WAIT after FIN received, got", s.State())
+	}
+	if ack := sendTCP(t, &s, buf[:]); ack.Ack != irs+4 {
+		t.Fatalf("expected ACK of data and FIN, got ack=%d", ack.Ack-irs)
+	}
+	var rbuf [8]byte
+	if n, _ := s.Read(rbuf[:]); string(rbuf[:n]) != "ok" {
+		t.Fatalf("expected data received while closing, got %q", rbuf[:n])
+	}
+	if _, err := s.Read(rbuf[:]); err != io.EOF {
+		t.Fatal("expected EOF after FIN, got", err)
+	}
+	s.Tick(now.Add(timeWaitTimeout - time.Millisecond))
+	if s.State() != tcpctl.StateTimeWait {
+		t.Fatal("left TIME-WAIT early")
+	}
+	s.Tick(now.Add(timeWaitTimeout))
+	if s.State() != tcpctl.StateClosed {
+		t.Fatal("expected closed after TIME-WAIT, got", s.State())
+	}
+}
+
+func TestPassiveClose(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	iss := establish(t, &s, time.Unix(0, 0))
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_FIN, 100, []byte("data"))
+	if s.State() != tcpctl.StateCloseWait {
+		t.Fatal("expected CLOSE-WAIT after FIN received, got", s.State())
+	}
+	if ack := sendTCP(t, &s, buf[:]); ack.Ack != irs+6 {
+		t.Fatalf("expected FIN to be acknowledged immediately, got ack=%d", ack.Ack-irs)
+	}
+	var rbuf [8]byte
+	if n, err := s.Read(rbuf[:]); string(rbuf[:n]) != "data" || err != nil {
+		t.Fatalf("expected buffered data before EOF, got %q %v", rbuf[:n], err)
+	}
+	if _, err := s.Read(rbuf[:]); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	// We may still send data before closing our side.
+	s.Write([]byte("reply"))
+	s.Close()
+	seg := sendTCP(t, &s, buf[:])
+	if !seg.Flags().HasFlags(dgrams.FlagTCP_FIN) || string(tcpPayload(buf[:], &seg)) != "reply" {
+		t.Fatalf("expected data with FIN, got flags=%s", seg.Flags())
+	}
+	if s.State() != tcpctl.StateLastAck {
+		t.Fatal("expected LAST-ACK, got", s.State())
+	}
+	recvTCP(t, &s, irs+6, iss+7, dgrams.FlagTCP_ACK, 100, nil)
+	if s.State() != tcpctl.StateClosed {
+		t.Fatal("expected closed after FIN acknowledged, got", s.State())
+	}
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	iss := establish(t, &s, time.Unix(0, 0))
+	s.Close()
+	if fin := sendTCP(t, &s, buf[:]); !fin.Flags().HasFlags(dgrams.FlagTCP_FIN) || fin.Seq != iss+1 {
+		t.Fatal("expected FIN")
+	}
+	// FINs cross in flight.
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_FIN, 100, nil)
+	if s.State() != tcpctl.StateClosing {
+		t.Fatal("expected CLOSING, got", s.State())
+	}
+	recvTCP(t, &s, irs+2, iss+2, dgrams.FlagTCP_ACK, 100, nil)
+	if s.State() != tcpctl.StateTimeWait {
+		t.Fatal("expected TIME-WAIT, got", s.State())
+	}
+}
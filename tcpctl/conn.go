@@ -0,0 +1,440 @@
+package tcpctl
+
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+var (
+	_ net.Conn     = (*Conn)(nil)
+	_ net.Listener = (*Listener)(nil)
+)
+
+// Conn implements net.Conn on top of a Socket so it can be used with the
+// standard library, i.e. bufio, net/http or crypto/tls. Unlike the Socket
+// methods, Read and Write block until they make progress, the connection
+// is closed or the deadline expires. The socket must be driven concurrently
+// by a loop calling its Tick, Recv and Send methods, or those of the Listener
+// which accepted the connection.
+type Conn struct {
+	s          *Socket
+	mu         sync.Mutex
+	rdDeadline time.Time
+	wrDeadline time.Time
+	closed     bool
+}
+
+// NewConn returns a Conn reading from and writing to s.
+func NewConn(s *Socket) *Conn {
+	s.initWake()
+	return &Conn{s: s}
+}
+
+// Socket returns the socket underlying the connection.
+func (c *Conn) Socket() *Socket { return c.s }
+
+// Read reads data received from the remote peer into b, blocking until data
+// is available. It returns io.EOF once the remote peer closed the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.s.readBlocking(b, func() (time.Time, error) { return c.deadline(&c.rdDeadline) })
+}
+
+// Write writes b to the send buffer of the connection, blocking until
+// all of b is buffered. Data is sent as the remote peer acknowledges data
+// previously sent, freeing space in the send buffer.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	return c.s.writeBlocking(b, func() (time.Time, error) { return c.deadline(&c.wrDeadline) })
+}
+
+// Close closes the connection gracefully, see Socket.Close. Blocked
+// Read and Write calls are unblocked and return net.ErrClosed.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+	err := c.s.Close()
+	c.s.wake()
+	return err
+}
+
+// CloseWrite shuts down the writing side of the connection by sending a FIN
+// after all data written. Data keeps being received until the remote peer closes.
+func (c *Conn) CloseWrite() error {
+	return c.s.Close()
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *Conn) LocalAddr() net.Addr { return c.s.LocalAddr() }
+
+// RemoteAddr returns the address of the remote peer of the connection.
+func (c *Conn) RemoteAddr() net.Addr { return c.s.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdDeadline = t
+	c.wrDeadline = t
+	c.mu.Unlock()
+	c.s.wake()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls, including blocked calls.
+// A zero value of t means Read does not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdDeadline = t
+	c.mu.Unlock()
+	c.s.wake()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls, including blocked calls.
+// A zero value of t means Write does not time out.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wrDeadline = t
+	c.mu.Unlock()
+	c.s.wake()
+	return nil
+}
+
+// deadline returns the deadline d points to, or an error if it expired or the connection is closed.
+func (c *Conn) deadline(d *time.Time) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		return time.Time{}, net.ErrClosed
+	case !d.IsZero() && !time.Now().Before(*d):
+		return time.Time{}, os.ErrDeadlineExceeded
+	}
+	return *d, nil
+}
+
+// initWake allocates the channels used to wait for the socket to become readable or writable.
+func (s *Socket) initWake() {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	if s.cs.rdWake == nil {
+		s.cs.rdWake = make(chan struct{}, 1)
+		s.cs.wrWake = make(chan struct{}, 1)
+	}
+}
+
+// wake wakes up blocked reads and writes so they check their deadlines again.
+func (s *Socket) wake() {
+	s.cs.mu.Lock()
+	s.cs.notify()
+	s.cs.mu.Unlock()
+}
+
+// readBlocking reads into b blocking until data is available. check is called
+// before every attempt and returns the deadline or an error to stop waiting.
+// initWake must have been called.
+func (s *Socket) readBlocking(b []byte, check func() (time.Time, error)) (int, error) {
+	for {
+		deadline, err := check()
+		if err != nil {
+			return 0, err
+		}
+		n, err := s.Read(b)
+		if n > 0 || err != nil || len(b) == 0 {
+			return n, err
+		}
+		err = wait(s.cs.rdWake, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeBlocking writes all of b blocking until it fits in the send buffer.
+// check is called before every attempt and returns the deadline or an error
+// to stop waiting. initWake must have been called.
+func (s *Socket) writeBlocking(b []byte, check func() (time.Time, error)) (n int, err error) {
+	for {
+		deadline, err := check()
+		if err != nil {
+			return n, err
+		}
+		m, err := s.Write(b[n:])
+		n += m
+		if err != errRingFull {
+			return n, err
+		}
+		err = wait(s.cs.wrWake, deadline)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// wait blocks until ch is signaled or the deadline expires. A zero deadline never expires.
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Listener implements net.Listener, accepting TCP connections on a local port.
+// Each connection is handled by a Socket created when its SYN arrives. The
+// Listener demultiplexes segments to its sockets by the address of the remote
+// peer, so its Recv, Send and Tick methods drive all of them, including those
+// already accepted.
+type Listener struct {
+	mu      sync.Mutex
+	addr    net.TCPAddr
+	backlog int
+	config  func(*Socket)
+	conns   []listenerConn
+	// next is the index of the connection SendTCP starts looking at so that connections get a fair share.
+	next   int
+	now    time.Time
+	wake   chan struct{}
+	closed bool
+	// done is closed by Close to wake up all blocked Accept calls.
+	done chan struct{}
+}
+
+type listenerConn struct {
+	s        *Socket
+	accepted bool
+}
+
+// NewListener returns a Listener accepting connections to addr. If the IP of
+// addr is nil connections to any address are accepted. backlog is the maximum
+// number of connections being established or waiting to be accepted, further
+// connection requests are dropped. config, if not nil, is called on every
+// Socket created before it starts listening to set its buffers and options.
+func NewListener(addr *net.TCPAddr, backlog int, config func(*Socket)) (*Listener, error) {
+	if addr == nil || addr.Port <= 0 || addr.Port > math.MaxUint16 {
+		return nil, errors.New("invalid listen port")
+	}
+	if backlog <= 0 {
+		return nil, errors.New("backlog must be positive")
+	}
+	l := &Listener{
+		addr:    net.TCPAddr{Port: addr.Port},
+		backlog: backlog,
+		config:  config,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return nil, errors.New("support only IPv4")
+		}
+		l.addr.IP = append(net.IP{}, ip...)
+	}
+	return l, nil
+}
+
+// Accept waits for the next connection to be established and returns it.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		for i := range l.conns {
+			c := &l.conns[i]
+			if !c.accepted && isEstablished(c.s.State()) {
+				c.accepted = true
+				l.mu.Unlock()
+				l.signal() // Let other Accept calls check for more connections.
+				return NewConn(c.s), nil
+			}
+		}
+		l.mu.Unlock()
+		select {
+		case <-l.wake:
+		case <-l.done:
+		}
+	}
+}
+
+// Close stops listening. Connections not yet accepted are aborted while
+// connections already accepted remain open.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	for i := range l.conns {
+		if c := &l.conns[i]; !c.accepted {
+			c.s.abortWith(net.ErrClosed)
+		}
+	}
+	close(l.done)
+	return nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *Listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: append(net.IP{}, l.addr.IP...), Port: l.addr.Port}
+}
+
+// Tick advances the time of all connections of the listener, see Socket.Tick.
+// Connections which have been closed are released.
+func (l *Listener) Tick(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = now
+	alive := l.conns[:0]
+	for _, c := range l.conns {
+		c.s.Tick(now)
+		state := c.s.State()
+		if state == StateClosed || (state == StateListen && !c.accepted) {
+			continue
+		}
+		alive = append(alive, c)
+	}
+	for i := len(alive); i < len(l.conns); i++ {
+		l.conns[i] = listenerConn{}
+	}
+	l.conns = alive
+}
+
+// RecvEthernet passes an Ethernet frame to the connection it belongs to, see Socket.RecvEthernet.
+func (l *Listener) RecvEthernet(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	if len(buf) < dgrams.SizeEthernetHeaderNoVLAN {
+		return 0, 0, errors.New("buffer too short to contain Ethernet")
+	}
+	s, err := l.socketFor(buf[dgrams.SizeEthernetHeaderNoVLAN:])
+	if err != nil {
+		return 0, 0, err
+	}
+	payloadStart, payloadEnd, err = s.RecvEthernet(buf)
+	l.signal()
+	return payloadStart, payloadEnd, err
+}
+
+// RecvTCP passes a TCP+IPv4 packet to the connection it belongs to, see Socket.RecvTCP.
+func (l *Listener) RecvTCP(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	s, err := l.socketFor(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	payloadStart, payloadEnd, err = s.RecvTCP(buf)
+	l.signal()
+	return payloadStart, payloadEnd, err
+}
+
+// SendEthernet writes the next pending Ethernet frame of any connection to dst, see Socket.SendEthernet.
+func (l *Listener) SendEthernet(dst []byte) (n int, err error) {
+	return l.send(dst, (*Socket).SendEthernet)
+}
+
+// SendTCP writes the next pending TCP+IPv4 packet of any connection to dst, see Socket.SendTCP.
+func (l *Listener) SendTCP(dst []byte) (n int, err error) {
+	return l.send(dst, (*Socket).SendTCP)
+}
+
+func (l *Listener) send(dst []byte, send func(*Socket, []byte) (int, error)) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < len(l.conns); i++ {
+		idx := (l.next + i) % len(l.conns)
+		n, err = send(l.conns[idx].s, dst)
+		if n > 0 || err != nil {
+			l.next = idx + 1
+			return n, err
+		}
+	}
+	return 0, nil
+}
+
+// socketFor returns the socket the TCP+IPv4 packet in buf is destined to. A new
+// socket is created for connection requests if the backlog is not full.
+func (l *Listener) socketFor(buf []byte) (*Socket, error) {
+	if len(buf) < sizeTCPIPv4 {
+		return nil, errors.New("buffer too short to contain TCP")
+	}
+	ip := dgrams.DecodeIPv4Header(buf)
+	ihl := int(ip.IHL) * 4
+	if ihl < dgrams.SizeIPHeader || ihl+dgrams.SizeTCPHeaderNoOptions > len(buf) {
+		return nil, errors.New("bad IP header length")
+	}
+	tcp := dgrams.DecodeTCPHeader(buf[ihl:])
+	if int(tcp.DestinationPort) != l.addr.Port ||
+		(l.addr.IP != nil && !l.addr.IP.Equal(ip.Destination[:])) {
+		return nil, errors.New("packet not destined to listener")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending := 0
+	for _, c := range l.conns {
+		if c.s.isRemote(ip.Source, tcp.SourcePort) {
+			return c.s, nil
+		}
+		if !c.accepted {
+			pending++
+		}
+	}
+	switch {
+	case tcp.Flags() != dgrams.FlagTCP_SYN:
+		return nil, errors.New("no connection for packet")
+	case l.closed:
+		return nil, net.ErrClosed
+	case pending >= l.backlog:
+		return nil, errors.New("listen backlog full")
+	}
+	s := new(Socket)
+	if l.config != nil {
+		l.config(s)
+	}
+	s.us = net.TCPAddr{IP: append(net.IP(nil), l.addr.IP...), Port: l.addr.Port}
+	s.Tick(l.now)
+	s.Listen()
+	l.conns = append(l.conns, listenerConn{s: s})
+	return s, nil
+}
+
+// signal wakes up a blocked Accept call.
+func (l *Listener) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// isRemote returns true if the remote peer of the connection has the given IP and port.
+func (s *Socket) isRemote(ip [4]byte, port uint16) bool {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	return s.cs.state != StateListen && s.cs.state != StateClosed &&
+		s.them.Port == int(port) && s.them.IP.Equal(ip[:])
+}
+
+// isEstablished returns true if the connection completed its handshake.
+func isEstablished(state State) bool {
+	switch state {
+	case StateClosed, StateListen, StateSynSent, StateSynRcvd:
+		return false
+	}
+	return true
+}
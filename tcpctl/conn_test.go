@@ -0,0 +1,174 @@
+package tcpctl_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// connectPeer completes the handshake of the peer of packetSyn with l and returns our ISS.
+func connectPeer(t *testing.T, l *tcpctl.Listener) (iss uint32) {
+	t.Helper()
+	var buf [1500]byte
+	l.Tick(time.Now())
+	if _, _, err := l.RecvEthernet(packetSyn); err != nil {
+		t.Fatal(err)
+	}
+	n, err := l.SendTCP(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected SYN-ACK", err)
+	}
+	iss = dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:]).Seq
+	if _, _, err = l.RecvTCP(tcpPacket(irsEstablished+1, iss+1, dgrams.FlagTCP_ACK, 65535, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	return iss
+}
+
+func newTestListener(t *testing.T, backlog int) *tcpctl.Listener {
+	t.Helper()
+	l, err := tcpctl.NewListener(&net.TCPAddr{Port: 80}, backlog, func(s *tcpctl.Socket) {
+		s.SetTimestamps(false)
+		s.SetWindowScaling(false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestListenerHTTP(t *testing.T) {
+	const irs = irsEstablished
+	l := newTestListener(t, 4)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path[1:])
+	}))
+	iss := connectPeer(t, l)
+	req := "GET /gopher HTTP/1.0\r\n\r\n"
+	l.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_PSH, 65535, nil, []byte(req)))
+	seq := uint32(irs + 1 + len(req))
+	// Acknowledge everything the server sends until it closes the connection.
+	var resp []byte
+	var buf [1500]byte
+	ack := iss + 1
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		l.Tick(time.Now())
+		n, err := l.SendTCP(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			continue
+		}
+		hdr := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+		if hdr.Seq != ack {
+			continue
+		}
+		payload := tcpPayload(buf[:], &hdr)
+		resp = append(resp, payload...)
+		ack += uint32(len(payload))
+		flags := dgrams.FlagTCP_ACK
+		if hdr.Flags().HasFlags(dgrams.FlagTCP_FIN) {
+			ack++
+			flags |= dgrams.FlagTCP_FIN
+		}
+		l.RecvTCP(tcpPacket(seq, ack, flags, 65535, nil, nil))
+		if flags.HasFlags(dgrams.FlagTCP_FIN) {
+			break
+		}
+	}
+	got := string(resp)
+	if !strings.HasPrefix(got, "HTTP/1.0 200 OK\r\n") || !strings.HasSuffix(got, "\r\n\r\nhello gopher") {
+		t.Fatalf("unexpected response %q", got)
+	}
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected Accept on closed listener to fail, got", err)
+	}
+}
+
+func TestConnDeadlineEOF(t *testing.T) {
+	const irs = irsEstablished
+	l := newTestListener(t, 1)
+	iss := connectPeer(t, l)
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.RemoteAddr().String(); addr != "192.168.1.112:58920" {
+		t.Fatal("unexpected remote address", addr)
+	}
+	var buf [16]byte
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = c.Read(buf[:])
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected timeout error, got", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	// A blocked Read returns once data arrives.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_FIN, 65535, nil, []byte("hi")))
+	}()
+	n, err := c.Read(buf[:])
+	if err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("expected data, got %q %v", buf[:n], err)
+	}
+	if _, err = c.Read(buf[:]); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	c.Close()
+	if _, err = c.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected write on closed Conn to fail, got", err)
+	}
+}
+
+func TestListenerBacklog(t *testing.T) {
+	l := newTestListener(t, 1)
+	connectPeer(t, l)
+	// A SYN from another port of the same host does not fit in the backlog.
+	syn := append([]byte{}, packetSyn...)
+	syn[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader+1]++
+	setChecksums(syn[dgrams.SizeEthernetHeaderNoVLAN:])
+	if _, _, err := l.RecvEthernet(syn); err == nil {
+		t.Fatal("expected SYN to be dropped with full backlog")
+	}
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.RecvEthernet(syn); err != nil {
+		t.Fatal("expected SYN to be accepted after Accept, got", err)
+	}
+}
+
+func TestListenerCloseAccept(t *testing.T) {
+	l := newTestListener(t, 1)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := l.Accept()
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // Let both Accept calls block.
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("want net.ErrClosed from Accept, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Accept %d still blocked after Close", i)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package tcpctl
 
 import (
 	"errors"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/soypat/dgrams"
 )
@@ -34,33 +36,105 @@ type connState struct {
 	//	3 - future sequence numbers which are not yet allowed
 	rcv             rcvSpace
 	pendingCtlFrame dgrams.TCPFlags
-	state           State
+	// rstSeq is the sequence number of the RST pending if pendingCtlFrame has
+	// the RST flag set, sent in response to an unacceptable ACK in SYN-RECEIVED.
+	rstSeq Seq
+	state  State
+	// rtx holds segments sent but not yet acknowledged.
+	rtx rtxQueue
+	// now is the time of the last call to Socket.Tick.
+	now time.Time
+	// sndBuf holds data written by the user starting at SND.UNA, this is
+	// both unacknowledged data and data not yet sent.
+	sndBuf ring
+	// rcvBuf holds data received up to RCV.NXT not yet read by the user.
+	// The free space in rcvBuf is the receive window.
+	rcvBuf ring
+	// ooo tracks data received out of order, held in the free space of rcvBuf.
+	ooo oooStore
+	// sackOK is set when both ends agreed to use selective acknowledgments.
+	sackOK bool
+	// wsOK is set when both ends agreed to use window scaling.
+	wsOK bool
+	// dupacks is the number of consecutive duplicate ACKs received.
+	dupacks int
+	// recovery is set during a loss recovery episode, which ends when
+	// all data sent before entering it is acknowledged (RecoveryPoint).
+	recovery   bool
+	recoverSeq Seq
+	// ts contains the state of the RFC 7323 Timestamps option.
+	ts tsState
+	// cc is the congestion control algorithm in use, set on connection start.
+	cc CongestionControl
+	// reno is the default congestion control algorithm, kept here to avoid allocating.
+	reno NewReno
+	// peerMSS is the maximum segment size the remote peer is willing to receive.
+	peerMSS uint16
+	pmtu    pmtuState
+	delack  delayedACK
+	// nodelay disables Nagle's algorithm.
+	nodelay bool
+	// smallEnd is the end of the last segment sent smaller than the MSS.
+	smallEnd  Seq
+	keepalive keepAlive
+	persist   persistTimer
+	// pendingProbe is set when a keepalive or zero window probe is due.
+	pendingProbe bool
+	// closing is set once the user closed the connection. A FIN is sent
+	// after all data in the send buffer.
+	closing bool
+	// finSent is set once our FIN was sent, it occupies sequence number finSeq.
+	finSent bool
+	finSeq  Seq
+	// finRcvd is set once the FIN of the remote peer was received, no more data follows.
+	finRcvd bool
+	// timeWait is the time the connection leaves the TIME-WAIT state.
+	timeWait time.Time
+	// err is the reason the connection was aborted, returned by Read and Write.
+	err error
+	// rdWake and wrWake are signaled when the connection may have become
+	// readable or writable. They are only set when a Conn blocks on the socket.
+	rdWake, wrWake chan struct{}
+	// log receives the events of the connection, nil if not logging.
+	log Logger
+	// id identifies the connection in events logged.
+	id connID
+	// stats counts the segments and connections of the socket.
+	stats Stats
+	// tracer receives probes of the connection, the last one being traced.
+	tracer Tracer
+	traced Probe
 }
 
 // sendSpace contains Send Sequence Space data.
 type sendSpace struct {
-	iss uint32 // initial send sequence number, defined on our side on connection start
-	UNA uint32 // send unacknowledged
-	NXT uint32 // send next
-	WL1 uint32 // segment sequence number used for last window update
-	WL2 uint32 // segment acknowledgment number used for last window update
-	WND uint16 // send window
+	iss Seq    // initial send sequence number, defined on our side on connection start
+	UNA Seq    // send unacknowledged
+	NXT Seq    // send next
+	WL1 Seq    // segment sequence number used for last window update
+	WL2 Seq    // segment acknowledgment number used for last window update
+	WND uint32 // send window, already scaled by the window scale of the remote peer.
 	UP  bool   // send urgent pointer (deprecated)
+	// shift is the window scale shift count received from the remote peer.
+	// Windows in segments received are shifted left by this amount.
+	shift uint8
 }
 
 // rcvSpace contains Receive Sequence Space data.
 type rcvSpace struct {
-	irs uint32 // initial receive sequence number, defined in SYN segment received
-	NXT uint32 // receive next
-	WND uint16 // receive window
+	irs Seq    // initial receive sequence number, defined in SYN segment received
+	NXT Seq    // receive next
+	WND uint32 // receive window
 	UP  bool   // receive urgent pointer (deprecated)
-
+	// shift is the window scale shift count we sent to the remote peer.
+	// Windows in segments sent are shifted right by this amount.
+	shift uint8
 }
 
 func (cs *connState) SetState(state State) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	cs.state = state
+	cs.setState(state)
 }
 func (cs *connState) State() State {
 	cs.mu.Lock()
@@ -68,12 +142,310 @@ func (cs *connState) State() State {
 	return cs.state
 }
 
+var (
+	errSegNotAcceptable = errors.New("segment not acceptable")
+	errAckNotSet        = errors.New("ACK bit not set")
+	errAckOld           = errors.New("seg.ack <= snd.UNA")
+	errAckUnsent        = errors.New("seg.ack > snd.NXT")
+)
+
+// abort closes the connection and discards all unacknowledged segments.
+// cs.mu must be held.
+func (cs *connState) abort(err error) {
+	cs.setState(StateClosed)
+	cs.err = err
+	cs.pendingCtlFrame = 0
+	cs.rtx.reset()
+	cs.ooo.reset()
+	cs.dupacks = 0
+	cs.recovery = false
+	cs.pendingProbe = false
+	cs.persist = persistTimer{}
+	cs.notify()
+}
+
+// initBuffers discards buffered data and allocates buffers if not set by the user.
+func (cs *connState) initBuffers() {
+	if cs.sndBuf.Size() == 0 {
+		cs.sndBuf = ring{buf: make([]byte, defaultBufferSize)}
+	}
+	if cs.rcvBuf.Size() == 0 {
+		cs.rcvBuf = ring{buf: make([]byte, defaultBufferSize)}
+	}
+	cs.sndBuf.Reset()
+	cs.rcvBuf.Reset()
+	cs.ooo.reset()
+}
+
+// sndBufStart returns the sequence number of the first byte in the send buffer.
+func (cs *connState) sndBufStart() Seq {
+	if cs.state == StateSynRcvd || cs.state == StateSynSent {
+		return cs.snd.iss.Add(1) // Our SYN is not yet acknowledged, data starts after it.
+	}
+	return cs.snd.UNA
+}
+
+// unsent returns the number of bytes in the send buffer not yet sent.
+func (cs *connState) unsent() uint32 {
+	inflight := cs.sndBufStart().Sizeof(cs.snd.NXT)
+	if cs.finSent && inflight > 0 {
+		inflight-- // FIN occupies sequence space but not the send buffer.
+	}
+	return uint32(cs.sndBuf.Buffered()) - inflight
+}
+
+// initCongestion sets the congestion control algorithm for a new connection,
+// using NewReno if cc is nil.
+func (cs *connState) initCongestion(cc CongestionControl) {
+	if cc == nil {
+		cc = &cs.reno
+	}
+	cs.cc = cc
+	cs.cc.Init(cs.smss())
+}
+
+// pipe returns the number of bytes estimated to be in the network. Without
+// SACK every duplicate ACK received during recovery signals a segment has left
+// the network, which is equivalent to the window inflation of RFC 6582.
+func (cs *connState) pipe() uint32 {
+	pipe := cs.rtx.pipe()
+	if cs.recovery && !cs.sackOK {
+		left := uint32(cs.dupacks) * cs.smss()
+		if left > pipe {
+			left = pipe
+		}
+		pipe -= left
+	}
+	return pipe
+}
+
+// cwndAvail returns the number of bytes the congestion window allows to be sent.
+func (cs *connState) cwndAvail() uint32 {
+	if cs.cc == nil {
+		return math.MaxUint32
+	}
+	cwnd, pipe := cs.cc.Cwnd(), cs.pipe()
+	if pipe >= cwnd {
+		return 0
+	}
+	return cwnd - pipe
+}
+
+// canRetransmit returns true if the congestion window allows retransmitting
+// a lost segment. The first retransmission after detecting loss is always sent.
+func (cs *connState) canRetransmit() bool {
+	return cs.rtx.force || cs.cwndAvail() > 0
+}
+
+// sendable returns the number of bytes of new data that can be sent in the
+// next segment, limited by the send window, the congestion window and max,
+// which is usually the segment size.
+func (cs *connState) sendable(max uint32) uint32 {
+	switch cs.state {
+	case StateEstablished, StateCloseWait, StateFinWait1, StateLastAck:
+		// Data written before closing is sent before our FIN.
+	default:
+		return 0
+	}
+	n := cs.unsent()
+	inflight := cs.snd.UNA.Sizeof(cs.snd.NXT)
+	wnd := cs.snd.WND
+	if inflight >= wnd {
+		return 0
+	}
+	if n > wnd-inflight {
+		n = wnd - inflight
+	}
+	if avail := cs.cwndAvail(); n > avail {
+		n = avail
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+// nagle implements Nagle's algorithm (RFC 1122 section 4.2.3.4). It returns
+// true if a segment with datalen bytes of new data should be held back since it
+// is smaller than full, the maximum segment size, and a previously sent small
+// segment is still unacknowledged. Small writes are then coalesced until it is
+// acknowledged. Only waiting on small segments is Minshall's refinement, which
+// lets the tail of a bulk write go out without waiting for an ACK.
+func (cs *connState) nagle(datalen, full uint32) bool {
+	return !cs.nodelay && datalen < full && cs.snd.UNA.LessThan(cs.smallEnd)
+}
+
+// ackRcv processes an acceptable acknowledgment, releasing acknowledged data
+// from the send buffer. rtt is a round trip time measurement made with the
+// Timestamps option or zero if none is available. cs.mu must be held.
+func (cs *connState) ackRcv(ack Seq, rtt time.Duration) {
+	start := cs.sndBufStart()
+	if start.LessThan(ack) {
+		acked := start.Sizeof(ack)
+		if buffered := uint32(cs.sndBuf.Buffered()); acked > buffered {
+			acked = buffered // FIN is acknowledged.
+		}
+		cs.sndBuf.Discard(int(acked))
+		cs.probeAcked(ack)
+		if cs.cc != nil && acked > 0 && !cs.recovery {
+			// The congestion window is not increased during loss recovery (RFC 6582).
+			cs.cc.OnAck(acked, cs.rtx.est.srtt, cs.now)
+		}
+	}
+	cs.snd.UNA = ack
+	cs.rtx.ack(ack, cs.now, rtt)
+	if cs.finSent && cs.finSeq.LessThan(ack) {
+		cs.finAcked()
+	}
+}
+
+// detectLoss runs the loss recovery algorithm of RFC 6675 after an ACK has been
+// processed. Recovery starts after DupThresh duplicate ACKs or when SACK
+// information shows the first unacknowledged segment is lost. During recovery
+// only segments deemed lost are marked for retransmission. Without SACK the
+// NewReno algorithm of RFC 6582 is followed instead: each partial acknowledgment
+// triggers the retransmission of the first unacknowledged segment. cs.mu must be held.
+func (cs *connState) detectLoss() {
+	mss := cs.smss()
+	if cs.recovery {
+		if !cs.snd.UNA.LessThan(cs.recoverSeq) {
+			cs.recovery = false // RecoveryPoint acknowledged.
+			return
+		}
+		if cs.sackOK {
+			cs.rtx.markLost(mss)
+		} else if first := cs.rtx.first(); first != nil && !first.rtxd && !first.lost {
+			first.lost = true
+			cs.rtx.force = true
+		}
+		if cs.probeIsLost() {
+			cs.probeLost()
+		}
+		return
+	}
+	if cs.rtx.Len() == 0 {
+		return
+	}
+	if cs.dupacks >= dupThresh || (cs.sackOK && cs.rtx.isLost(0, mss)) {
+		cs.recovery = true
+		cs.recoverSeq = cs.snd.NXT
+		cs.rtx.startRecovery()
+		cs.rtx.markLost(mss)
+		// Loss of an MTU probe alone is not a congestion signal (RFC 4821 section 7.6.2).
+		probeOnly := cs.probeIsLost() && cs.rtx.firstUnsacked().seq == cs.pmtu.probe.Start
+		if cs.probeIsLost() {
+			cs.probeLost()
+		}
+		if cs.cc != nil && !probeOnly {
+			cs.cc.OnLoss(cs.snd.UNA.Sizeof(cs.snd.NXT), cs.now)
+		}
+	}
+}
+
+// rtoExpired reacts to the expiry of the retransmission timer by ending loss
+// recovery and collapsing the congestion window. cs.mu must be held.
+func (cs *connState) rtoExpired() {
+	cs.pmtuTimeout()
+	cs.recovery = false
+	cs.dupacks = 0
+	if cs.cc != nil {
+		cs.cc.OnRTO(cs.snd.UNA.Sizeof(cs.snd.NXT), cs.now)
+	}
+}
+
+// updateSndWindow updates the send window from an acceptable segment as
+// described in RFC 793, preventing old segments from updating the window.
+func (cs *connState) updateSndWindow(hdr *dgrams.TCPHeader) {
+	seq, ack := Seq(hdr.Seq), Seq(hdr.Ack)
+	if cs.snd.WL1.LessThan(seq) || (cs.snd.WL1 == seq && cs.snd.WL2.LessThanEq(ack)) {
+		cs.snd.WND = cs.sndWindow(hdr)
+		cs.snd.WL1 = seq
+		cs.snd.WL2 = ack
+	}
+}
+
+// dataRcv buffers data starting at seq and acknowledges it. Data received
+// out of order is held until the data preceding it arrives. Data which does
+// not fit in the receive window is dropped. cs.mu must be held.
+func (cs *connState) dataRcv(seq Seq, payload []byte) {
+	if seq.LessThan(cs.rcv.NXT) {
+		// Trim data we have already received.
+		dup := seq.Sizeof(cs.rcv.NXT)
+		if dup >= uint32(len(payload)) {
+			cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+			return
+		}
+		payload = payload[dup:]
+		seq = cs.rcv.NXT
+	}
+	if seq != cs.rcv.NXT {
+		// Out of order data is written to its place past the buffered data and
+		// we keep acknowledging RCV.NXT until the gap is filled. The duplicate
+		// ACKs are sent right away to trigger fast retransmit (RFC 5681 4.2).
+		cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+		n := cs.rcvBuf.WriteAt(payload, int(cs.rcv.NXT.Sizeof(seq)))
+		if n > 0 {
+			cs.ooo.insert(seq, seq.Add(uint32(n)))
+		}
+		return
+	}
+	n, _ := cs.rcvBuf.Write(payload)
+	if n < len(payload) || cs.ooo.Len() > 0 {
+		// Data beyond the window or filling a gap is acknowledged immediately.
+		cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	} else {
+		cs.ackDelayed(uint32(n))
+	}
+	cs.rcv.NXT = cs.rcv.NXT.Add(uint32(n))
+	// Deliver out of order data now contiguous with RCV.NXT.
+	for {
+		block, ok := cs.ooo.pop(cs.rcv.NXT)
+		if !ok {
+			break
+		}
+		if cs.rcv.NXT.LessThan(block.End) {
+			cs.rcvBuf.Commit(int(cs.rcv.NXT.Sizeof(block.End)))
+			cs.rcv.NXT = block.End
+		}
+	}
+	cs.updateRcvWindow()
+}
+
+// sndWindow returns the window advertised in a segment received from the
+// remote peer. Windows of non-SYN segments are scaled as per RFC 7323.
+func (cs *connState) sndWindow(hdr *dgrams.TCPHeader) uint32 {
+	if hdr.Flags().HasFlags(dgrams.FlagTCP_SYN) {
+		return uint32(hdr.WindowSize)
+	}
+	return uint32(hdr.WindowSize) << cs.snd.shift
+}
+
+// updateRcvWindow sets the receive window to the free space in the
+// receive buffer. If the window opens considerably an ACK is scheduled
+// to notify the remote peer, avoiding silly window syndrome (RFC 1122 4.2.3.3).
+func (cs *connState) updateRcvWindow() {
+	free := uint32(cs.rcvBuf.Free())
+	if max := uint32(math.MaxUint16) << cs.rcv.shift; free > max {
+		free = max
+	}
+	old := cs.rcv.WND
+	cs.rcv.WND = free
+	opened := int(cs.rcv.WND) - int(old)
+	receiving := cs.state == StateEstablished || cs.state == StateFinWait1 || cs.state == StateFinWait2
+	if receiving && opened > 0 && (old == 0 || opened >= cs.rcvBuf.Size()/2) {
+		cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	}
+}
+
+// frameRcv checks the acknowledgment number of an incoming segment is
+// acceptable, which is to say SND.UNA < SEG.ACK =< SND.NXT modulo 2**32.
 func (cs *connState) frameRcv(hdr *dgrams.TCPHeader) (err error) {
+	ack := Seq(hdr.Ack)
 	switch {
-	case hdr.Ack <= cs.snd.UNA:
-		err = errors.New("seg.ack > snd.UNA")
-	case hdr.Ack > cs.snd.NXT:
-		err = errors.New("seg.ack <= snd.NXT")
+	case ack.LessThanEq(cs.snd.UNA):
+		err = errAckOld
+	case cs.snd.NXT.LessThan(ack):
+		err = errAckUnsent
 	}
 	if err != nil {
 		return err
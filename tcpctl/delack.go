@@ -0,0 +1,63 @@
+package tcpctl
+
+import (
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// delackTimeout is the maximum time an acknowledgment is delayed. RFC 1122
+// section 4.2.3.2 requires it to be less than 0.5 seconds.
+const delackTimeout = 200 * time.Millisecond
+
+// delayedACK holds the state of delayed acknowledgments as described in RFC 1122
+// section 4.2.3.2 and RFC 5681 section 4.2. Acknowledging every second full
+// sized segment halves the number of pure ACKs sent during bulk transfers,
+// and gives the user a chance to piggyback the ACK on a reply.
+type delayedACK struct {
+	// quick disables delayed acknowledgments, every segment is acknowledged immediately.
+	quick bool
+	// deadline is the time at which the delayed ACK must be sent. Zero if none pending.
+	deadline time.Time
+	// unacked is the number of in-order bytes received since the last ACK sent.
+	unacked uint32
+	// mss is the largest segment received, an estimate of the sender MSS of the remote peer.
+	mss uint32
+}
+
+// ackDelayed schedules the acknowledgment of n in-order bytes just received.
+// An ACK is sent right away once two full sized segments are unacknowledged.
+// cs.mu must be held.
+func (cs *connState) ackDelayed(n uint32) {
+	d := &cs.delack
+	seg := n
+	if max := uint32(cs.advertisedMSS()); cs.pmtu.link != 0 && seg > max {
+		// Segments larger than the MSS advertised were coalesced by the link
+		// layer (GRO) and are made of full sized segments.
+		seg = max
+	}
+	if seg > d.mss {
+		d.mss = seg
+	}
+	d.unacked += n
+	if d.quick || d.unacked >= 2*d.mss {
+		cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+		return
+	}
+	if d.deadline.IsZero() {
+		d.deadline = cs.now.Add(delackTimeout)
+	}
+}
+
+// ackSent records an ACK was sent, which acknowledges all data received. cs.mu must be held.
+func (cs *connState) ackSent() {
+	cs.delack.unacked = 0
+	cs.delack.deadline = time.Time{}
+}
+
+// delackTick sends the delayed ACK if its timer expired. cs.mu must be held.
+func (cs *connState) delackTick(now time.Time) {
+	if !cs.delack.deadline.IsZero() && !now.Before(cs.delack.deadline) {
+		cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	}
+}
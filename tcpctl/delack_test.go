@@ -0,0 +1,163 @@
+package tcpctl_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+const (
+	irsEstablished = 0x3eab64f7 // Sequence number of packetSyn.
+	delackTimeout  = 200 * time.Millisecond
+)
+
+// establish completes a passive open of s with the peer of packetSyn and returns our ISS.
+func establish(t *testing.T, s *tcpctl.Socket, now time.Time) (iss uint32) {
+	t.Helper()
+	var buf [1500]byte
+	s.Tick(now)
+	s.SetTimestamps(false)
+	s.SetBuffers(make([]byte, 8000), make([]byte, 8000))
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss = sendTCP(t, s, buf[:]).Seq
+	recvTCP(t, s, irsEstablished+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	return iss
+}
+
+// payloads returns the payload lengths of all packets pending in s.
+func payloads(s *tcpctl.Socket) (lens []int) {
+	var buf [1500]byte
+	for {
+		n, _ := s.SendTCP(buf[:])
+		if n == 0 {
+			return lens
+		}
+		hdr := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+		lens = append(lens, len(tcpPayload(buf[:], &hdr)))
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNagle(t *testing.T) {
+	const irs = irsEstablished
+	for _, nodelay := range []bool{false, true} {
+		var s tcpctl.Socket
+		iss := establish(t, &s, time.Unix(0, 0))
+		s.SetNoDelay(nodelay)
+		var sent []int
+		// Interactive traffic: a keystroke per write.
+		for i := 0; i < 4; i++ {
+			s.Write([]byte{'a'})
+			sent = append(sent, payloads(&s)...)
+		}
+		// Outstanding small data acknowledged, coalesced keystrokes go out.
+		recvTCP(t, &s, irs+1, iss+2, dgrams.FlagTCP_ACK, 100, nil)
+		sent = append(sent, payloads(&s)...)
+		// A bulk write is sent in full sized segments, its tail waits
+		// for the small segment in flight to be acknowledged.
+		s.Write(make([]byte, 3000))
+		sent = append(sent, payloads(&s)...)
+		recvTCP(t, &s, irs+1, iss+5, dgrams.FlagTCP_ACK, 100, nil)
+		sent = append(sent, payloads(&s)...)
+		want := []int{1, 3, 1460, 1460, 80}
+		if nodelay {
+			want = []int{1, 1, 1, 1, 1460, 1460, 80}
+		}
+		if !equalInts(sent, want) {
+			t.Errorf("nodelay=%v: want segments %v, got %v", nodelay, want, sent)
+		}
+	}
+}
+
+func TestDelayedACK(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	now := time.Unix(0, 0)
+	iss := establish(t, &s, now)
+	data := make([]byte, 1000)
+	seq := uint32(irs + 1)
+	recv := func(n int) {
+		recvTCP(t, &s, seq, iss+1, dgrams.FlagTCP_ACK, 100, data[:n])
+		seq += uint32(n)
+	}
+	// Every second full sized segment is acknowledged.
+	recv(1000)
+	if n, _ := s.SendTCP(make([]byte, 1500)); n != 0 {
+		t.Fatal("first segment should not be acknowledged immediately")
+	}
+	recv(1000)
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq {
+		t.Fatalf("expected ACK of second segment, got ack=%d", ack.Ack-irs)
+	}
+	// A lone segment is acknowledged when the delayed ACK timer expires.
+	recv(10)
+	now = now.Add(delackTimeout - time.Millisecond)
+	s.Tick(now)
+	if n, _ := s.SendTCP(make([]byte, 1500)); n != 0 {
+		t.Fatal("ACK sent before delayed ACK timeout")
+	}
+	now = now.Add(time.Millisecond)
+	s.Tick(now)
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq {
+		t.Fatal("expected ACK on delayed ACK timeout")
+	}
+	// Delayed ACK is piggybacked on data sent.
+	recv(10)
+	s.Write([]byte("reply"))
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq || !ack.Flags().HasFlags(dgrams.FlagTCP_ACK) {
+		t.Fatal("expected ACK piggybacked on data")
+	}
+	now = now.Add(delackTimeout)
+	s.Tick(now)
+	if n, _ := s.SendTCP(make([]byte, 1500)); n != 0 {
+		t.Fatal("piggybacked ACK should cancel delayed ACK")
+	}
+	// Out of order segments are acknowledged immediately.
+	seq += 10
+	recv(10)
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq-20 {
+		t.Fatal("expected immediate duplicate ACK on out of order segment")
+	}
+	seq -= 20
+	recv(10)
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq+10 {
+		t.Fatal("expected immediate ACK of segment filling gap")
+	}
+	// With quick ACKs every segment is acknowledged immediately.
+	s.SetQuickAck(true)
+	seq += 10
+	recv(10)
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != seq {
+		t.Fatal("expected immediate ACK with quick ACK enabled")
+	}
+}
+
+func TestDelayedACKCoalesced(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	iss := establish(t, &s, time.Unix(0, 0))
+	// A segment larger than the MSS advertised was coalesced by the link layer
+	// from full sized segments, which are acknowledged right away.
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, make([]byte, 4000))
+	if ack := sendTCP(t, &s, make([]byte, 1500)); ack.Ack != irs+1+4000 {
+		t.Fatal("expected immediate ACK of coalesced segment")
+	}
+	recvTCP(t, &s, irs+1+4000, iss+1, dgrams.FlagTCP_ACK, 100, make([]byte, 1460))
+	if n, _ := s.SendTCP(make([]byte, 1500)); n != 0 {
+		t.Fatal("full sized segment following a coalesced one should not be acknowledged immediately")
+	}
+}
@@ -0,0 +1,100 @@
+package tcpctl
+
+import "encoding/binary"
+
+// demuxKey identifies the connection a segment belongs to. The local address
+// is not part of the key since it is always that of the Stack. Listening
+// sockets are keyed by their local port with a zero remote address.
+type demuxKey struct {
+	port  uint16
+	rport uint16
+	rip   [4]byte
+}
+
+// demuxEntry is a slot of demuxTable. fd is the socket descriptor plus one so
+// that the zero value is an empty slot.
+type demuxEntry struct {
+	key demuxKey
+	fd  int
+}
+
+// demuxTable maps connections to socket descriptors. It is an open addressing
+// hash table with linear probing and backward shift deletion, so no tombstones
+// accumulate and it does not allocate after being created. It has room for
+// at least twice the entries it is created for, keeping probe sequences short.
+type demuxTable struct {
+	entries []demuxEntry
+	n       int
+	shift   uint8
+}
+
+// makeDemuxTable returns a table with room for n entries.
+func makeDemuxTable(n int) demuxTable {
+	size, bits := 2, uint8(1)
+	for size < 2*n {
+		size <<= 1
+		bits++
+	}
+	return demuxTable{entries: make([]demuxEntry, size), shift: 64 - bits}
+}
+
+// home returns the index of the slot where a probe for k starts.
+func (t *demuxTable) home(k demuxKey) int {
+	// Fibonacci hashing: multiply by 2^64/φ and keep the high bits.
+	h := uint64(k.port)<<48 | uint64(k.rport)<<32 | uint64(binary.BigEndian.Uint32(k.rip[:]))
+	return int((h * 0x9e3779b97f4a7c15) >> t.shift)
+}
+
+// find returns the index of the slot holding k, or of the empty slot ending its probe sequence.
+func (t *demuxTable) find(k demuxKey) int {
+	mask := len(t.entries) - 1
+	i := t.home(k)
+	for t.entries[i].fd != 0 && t.entries[i].key != k {
+		i = (i + 1) & mask
+	}
+	return i
+}
+
+// lookup returns the descriptor of the socket of k.
+func (t *demuxTable) lookup(k demuxKey) (fd int, ok bool) {
+	e := &t.entries[t.find(k)]
+	return e.fd - 1, e.fd != 0
+}
+
+// insert maps k to fd, replacing any previous mapping. It returns false if the table is full.
+func (t *demuxTable) insert(k demuxKey, fd int) bool {
+	i := t.find(k)
+	if t.entries[i].fd == 0 {
+		if 2*(t.n+1) > len(t.entries) {
+			return false
+		}
+		t.n++
+	}
+	t.entries[i] = demuxEntry{key: k, fd: fd + 1}
+	return true
+}
+
+// remove deletes the mapping of k if present.
+func (t *demuxTable) remove(k demuxKey) {
+	mask := len(t.entries) - 1
+	i := t.find(k)
+	if t.entries[i].fd == 0 {
+		return
+	}
+	t.n--
+	// Shift back entries following the removed one in its probe sequence
+	// unless their home slot lies cyclically within (i, j].
+	for j := i; ; {
+		j = (j + 1) & mask
+		if t.entries[j].fd == 0 {
+			break
+		}
+		h := t.home(t.entries[j].key)
+		if (i <= j && i < h && h <= j) || (i > j && (i < h || h <= j)) {
+			continue
+		}
+		t.entries[i] = t.entries[j]
+		i = j
+	}
+	t.entries[i] = demuxEntry{}
+}
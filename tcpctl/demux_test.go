@@ -0,0 +1,60 @@
+package tcpctl
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDemuxTable(t *testing.T) {
+	const n = 128 // Power of two: table is full with n entries.
+	rng := rand.New(rand.NewSource(1))
+	table := makeDemuxTable(n)
+	want := make(map[demuxKey]int)
+	keys := make([]demuxKey, 0, n)
+	for round := 0; round < 20; round++ {
+		// Fill the table then remove a random half of the keys.
+		for len(keys) < n {
+			k := demuxKey{port: uint16(rng.Intn(4)), rport: uint16(rng.Intn(1 << 16))}
+			rng.Read(k.rip[:])
+			if _, ok := want[k]; ok {
+				continue
+			}
+			if !table.insert(k, len(keys)) {
+				t.Fatal("table full with", len(keys), "entries")
+			}
+			want[k] = len(keys)
+			keys = append(keys, k)
+		}
+		if table.insert(demuxKey{port: 80}, 0) {
+			t.Fatal("expected insert to fail with table full")
+		}
+		rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		for _, k := range keys[n/2:] {
+			table.remove(k)
+			delete(want, k)
+		}
+		keys = keys[:n/2]
+		for k, fd := range want {
+			if got, ok := table.lookup(k); !ok || got != fd {
+				t.Fatalf("round %d: lookup %v got %d %v, want %d", round, k, got, ok, fd)
+			}
+			want[k] = fd + n
+			table.insert(k, fd+n) // Replace mapping.
+		}
+		for k, fd := range want {
+			want[k] = fd - n
+			table.insert(k, fd-n)
+		}
+	}
+	for _, k := range keys {
+		table.remove(k)
+	}
+	if table.n != 0 {
+		t.Fatal("expected empty table, got", table.n, "entries")
+	}
+	for i := range table.entries {
+		if table.entries[i].fd != 0 {
+			t.Fatal("expected all slots empty after removing all keys")
+		}
+	}
+}
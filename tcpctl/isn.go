@@ -0,0 +1,89 @@
+package tcpctl
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/soypat/dgrams/internal/siphash"
+)
+
+// ISNGenerator generates initial sequence numbers as described by RFC 6528:
+//
+//	ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+//
+// Where M is a timer that increments every 4 microseconds and F is a keyed
+// pseudorandom function over the connection 4-tuple. F is implemented with
+// SipHash-2-4, which is cheap enough to run on microcontrollers. Both the secret
+// key and the clock are provided by the user so tests can be made deterministic
+// and targets without an operating system can plug in their own entropy source.
+type ISNGenerator struct {
+	key   [16]byte
+	now   func() time.Time
+	epoch time.Time
+}
+
+// NewISNGenerator returns an ISNGenerator with the given secret key and clock.
+// The key must be kept secret and should be chosen at random on startup,
+// i.e. from a hardware RNG. If now is nil time.Now is used.
+func NewISNGenerator(key [16]byte, now func() time.Time) *ISNGenerator {
+	if now == nil {
+		now = time.Now
+	}
+	return &ISNGenerator{key: key, now: now, epoch: now()}
+}
+
+// NewRandomISNGenerator returns an ISNGenerator whose secret key is read from
+// rand, which is usually crypto/rand.Reader or a hardware RNG.
+func NewRandomISNGenerator(rand io.Reader, now func() time.Time) (*ISNGenerator, error) {
+	var key [16]byte
+	_, err := io.ReadFull(rand, key[:])
+	if err != nil {
+		return nil, err
+	}
+	return NewISNGenerator(key, now), nil
+}
+
+// ISN returns the initial sequence number for a connection between local and remote.
+func (g *ISNGenerator) ISN(local, remote *net.TCPAddr) Seq {
+	// 2*(4 byte address + 2 byte port) for IPv4.
+	// 2*(16 byte address + 2 byte port) for IPv6.
+	var buf [36]byte
+	n := putAddr(buf[:], local)
+	n += putAddr(buf[n:], remote)
+	F := siphash.Hash24(&g.key, buf[:n])
+	// Monotonic timer that increments every 4 microseconds.
+	M := uint32(g.now().Sub(g.epoch) / (4 * time.Microsecond))
+	return Seq(M + uint32(F))
+}
+
+func putAddr(dst []byte, addr *net.TCPAddr) (n int) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		n = copy(dst, ip4)
+	} else {
+		n = copy(dst, addr.IP.To16())
+	}
+	binary.BigEndian.PutUint16(dst[n:], uint16(addr.Port))
+	return n + 2
+}
+
+var (
+	defaultISNOnce sync.Once
+	defaultISN     *ISNGenerator
+)
+
+// defaultISNGenerator returns a package level ISNGenerator keyed with
+// crypto/rand and using time.Now as clock.
+func defaultISNGenerator() *ISNGenerator {
+	defaultISNOnce.Do(func() {
+		var err error
+		defaultISN, err = NewRandomISNGenerator(rand.Reader, nil)
+		if err != nil {
+			panic("tcpctl: generating ISN key: " + err.Error())
+		}
+	})
+	return defaultISN
+}
@@ -0,0 +1,32 @@
+package tcpctl
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestISNGenerator(t *testing.T) {
+	var now time.Time
+	clock := func() time.Time { return now }
+	key := [16]byte{1, 2, 3}
+	g := NewISNGenerator(key, clock)
+	local := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 80}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 112), Port: 58920}
+	isn1 := g.ISN(local, remote)
+	if isn1 != NewISNGenerator(key, clock).ISN(local, remote) {
+		t.Error("ISN not deterministic for same key, clock and 4-tuple")
+	}
+	other := &net.TCPAddr{IP: remote.IP, Port: remote.Port + 1}
+	if isn1 == g.ISN(local, other) {
+		t.Error("ISN should differ for different 4-tuple")
+	}
+	if isn1 == NewISNGenerator([16]byte{3, 2, 1}, clock).ISN(local, remote) {
+		t.Error("ISN should differ for different key")
+	}
+	// M increments every 4 microseconds.
+	now = now.Add(40 * time.Microsecond)
+	if got := g.ISN(local, remote); isn1.Sizeof(got) != 10 {
+		t.Errorf("ISN should advance 10 after 40us, got %d", isn1.Sizeof(got))
+	}
+}
@@ -0,0 +1,147 @@
+package tcpctl
+
+import (
+	"errors"
+	"time"
+)
+
+// Keepalive defaults, the same as those of the net package.
+const (
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+var (
+	errKeepAliveTimeout = errors.New("keepalive timeout")
+	errPersistTimeout   = errors.New("zero window probe timeout")
+)
+
+// KeepAliveConfig contains the keepalive parameters of a connection.
+// Zero values of Idle, Interval and Count are replaced by defaults
+// of 15 seconds, 15 seconds and 9 probes respectively.
+type KeepAliveConfig struct {
+	// Enable enables keepalive probes. They are disabled by default.
+	Enable bool
+	// Idle is the time the connection must be idle before the first probe is sent.
+	Idle time.Duration
+	// Interval is the time between probes left unanswered.
+	Interval time.Duration
+	// Count is the number of unanswered probes after which the connection is aborted.
+	Count int
+}
+
+// keepAlive holds the state of TCP keepalives as described by RFC 1122 section
+// 4.2.3.6. Probes are sent after the connection has been idle for some time so
+// that middleboxes do not drop their state and dead peers are detected.
+type keepAlive struct {
+	cfg KeepAliveConfig
+	// last is the time the last segment was received.
+	last time.Time
+	// probes is the number of probes sent without a response.
+	probes int
+}
+
+// persistTimer holds the state of the persist timer which probes a zero
+// send window (RFC 9293 section 3.8.6.1), so that the connection does not
+// deadlock if the ACK opening the window is lost.
+type persistTimer struct {
+	// deadline is the time the next window probe is due. Zero if not running.
+	deadline time.Time
+	backoff  uint8
+	// probes is the number of probes sent without a response.
+	probes int
+}
+
+// segmentRcv records an acceptable segment was received, which answers any probes.
+// cs.mu must be held.
+func (cs *connState) segmentRcv() {
+	cs.keepalive.last = cs.now
+	cs.keepalive.probes = 0
+	cs.persist.probes = 0
+}
+
+// keepAliveTick sends a keepalive probe if the connection has been idle for
+// long enough and aborts it if too many probes went unanswered. cs.mu must be held.
+func (cs *connState) keepAliveTick(now time.Time) error {
+	ka := &cs.keepalive
+	due, ok := cs.keepAliveDue()
+	if !ok || now.Before(due) {
+		return nil
+	}
+	if ka.probes >= ka.cfg.Count {
+		return errKeepAliveTimeout
+	}
+	ka.probes++
+	cs.pendingProbe = true
+	return nil
+}
+
+// keepAliveDue returns the time the next keepalive probe is due. ok is false
+// if no probe is to be sent. cs.mu must be held.
+func (cs *connState) keepAliveDue() (due time.Time, ok bool) {
+	ka := &cs.keepalive
+	if !ka.cfg.Enable || (cs.state != StateEstablished && cs.state != StateCloseWait) ||
+		cs.rtx.Len() > 0 || cs.unsent() > 0 {
+		// Keepalives are only needed when there is no data to (re)transmit.
+		return time.Time{}, false
+	}
+	return ka.last.Add(ka.cfg.Idle + time.Duration(ka.probes)*ka.cfg.Interval), true
+}
+
+// persistTick runs the persist timer, sending window probes while the remote
+// peer advertises a zero window and we have data to send. Probes are backed off
+// exponentially like retransmissions and the connection is aborted if the peer
+// does not answer them. cs.mu must be held.
+func (cs *connState) persistTick(now time.Time) error {
+	p := &cs.persist
+	if !cs.persistNeeded() {
+		*p = persistTimer{}
+		return nil
+	}
+	if p.deadline.IsZero() {
+		p.deadline = now.Add(cs.persistTimeout())
+		return nil
+	}
+	if now.Before(p.deadline) {
+		return nil
+	}
+	maxRetries := cs.rtx.maxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	if p.probes >= int(maxRetries) {
+		return errPersistTimeout
+	}
+	p.probes++
+	if p.backoff < 32 {
+		p.backoff++
+	}
+	p.deadline = now.Add(cs.persistTimeout())
+	cs.pendingProbe = true
+	return nil
+}
+
+// persistNeeded returns true if the persist timer must run: the remote peer
+// advertises a zero window and we have data to send but none in flight whose
+// acknowledgment could open the window. cs.mu must be held.
+func (cs *connState) persistNeeded() bool {
+	if cs.snd.WND != 0 || cs.rtx.Len() > 0 || cs.unsent() == 0 {
+		return false
+	}
+	// Data written before the user closed the connection is still sent ahead
+	// of our FIN, so the window is probed in FIN-WAIT-1 and LAST-ACK too.
+	return cs.state == StateEstablished || cs.state == StateCloseWait || cs.closing
+}
+
+// persistTimeout returns the RTO with the persist timer's backoff applied.
+func (cs *connState) persistTimeout() time.Duration {
+	rto := cs.rtx.est.RTO()
+	for i := uint8(0); i < cs.persist.backoff && rto < rtoMax; i++ {
+		rto *= 2
+	}
+	if rto > rtoMax {
+		rto = rtoMax
+	}
+	return rto
+}
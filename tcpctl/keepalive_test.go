@@ -0,0 +1,139 @@
+package tcpctl_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestKeepAlive(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	s.SetKeepAlive(tcpctl.KeepAliveConfig{Enable: true, Idle: 10 * time.Second, Interval: time.Second, Count: 3})
+	iss := establish(t, &s, now)
+	expectProbe := func(at time.Duration) {
+		t.Helper()
+		s.Tick(now.Add(at - time.Millisecond))
+		if n, _ := s.SendTCP(buf[:]); n != 0 {
+			t.Fatalf("probe sent before %s", at)
+		}
+		if err := s.Tick(now.Add(at)); err != nil {
+			t.Fatal(err)
+		}
+		probe := sendTCP(t, &s, buf[:])
+		if probe.Seq != iss || probe.Ack != irs+1 || len(tcpPayload(buf[:], &probe)) != 0 {
+			t.Fatalf("expected keepalive probe with seq=SND.NXT-1, got seq=%d ack=%d", probe.Seq-iss, probe.Ack-irs)
+		}
+	}
+	expectProbe(10 * time.Second)
+	// Peer answers, connection is idle again.
+	now = now.Add(10 * time.Second)
+	s.Tick(now)
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	expectProbe(10 * time.Second)
+	expectProbe(11 * time.Second)
+	expectProbe(12 * time.Second)
+	if err := s.Tick(now.Add(13 * time.Second)); err == nil || s.State() != tcpctl.StateClosed {
+		t.Fatalf("expected connection aborted after 3 unanswered probes, got err=%v state=%s", err, s.State())
+	}
+}
+
+func TestZeroWindowProbe(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	s.SetMaxRetries(3)
+	iss := establish(t, &s, now)
+	// Peer's receive buffer fills up.
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 0, nil)
+	s.Write([]byte("blocked"))
+	s.Tick(now)
+	if n, _ := s.SendTCP(buf[:]); n != 0 {
+		t.Fatal("data sent on zero window")
+	}
+	// Probes back off exponentially while the peer keeps the window closed.
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		s.Tick(now.Add(wait - time.Millisecond))
+		if n, _ := s.SendTCP(buf[:]); n != 0 {
+			t.Fatalf("probe sent before %s", wait)
+		}
+		now = now.Add(wait)
+		s.Tick(now)
+		probe := sendTCP(t, &s, buf[:])
+		if probe.Seq != iss || len(tcpPayload(buf[:], &probe)) != 0 {
+			t.Fatalf("expected zero window probe, got seq=%d", probe.Seq-iss)
+		}
+		recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 0, nil)
+	}
+	// Window opens, data flows.
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	seg := sendTCP(t, &s, buf[:])
+	if string(tcpPayload(buf[:], &seg)) != "blocked" {
+		t.Fatal("expected data to be sent once window opens")
+	}
+
+	// Unanswered probes abort the connection.
+	recvTCP(t, &s, irs+1, iss+8, dgrams.FlagTCP_ACK, 0, nil)
+	s.Write([]byte("more"))
+	s.Tick(now)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		now = now.Add(time.Minute)
+		err = s.Tick(now)
+		s.SendTCP(buf[:])
+	}
+	if err == nil || s.State() != tcpctl.StateClosed {
+		t.Fatalf("expected abort after unanswered zero window probes, got err=%v state=%s", err, s.State())
+	}
+}
+
+func TestZeroWindowProbeClosing(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	iss := establish(t, &s, now)
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 0, nil)
+	s.Write([]byte("bye"))
+	s.Close()
+	s.Tick(now)
+	// Data written before closing waits for the window to open, the
+	// persist timer keeps probing it in FIN-WAIT-1.
+	now = now.Add(time.Second)
+	s.Tick(now)
+	probe := sendTCP(t, &s, buf[:])
+	if probe.Seq != iss || probe.Flags().HasFlags(dgrams.FlagTCP_FIN) {
+		t.Fatalf("expected zero window probe in %s, got %s seq=%d", s.State(), probe.Flags(), probe.Seq-iss)
+	}
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	seg := sendTCP(t, &s, buf[:])
+	if string(tcpPayload(buf[:], &seg)) != "bye" || !seg.Flags().HasFlags(dgrams.FlagTCP_FIN) {
+		t.Fatalf("expected data and FIN once window opens, got %s", seg.Flags())
+	}
+}
+
+func TestZeroWindowProbeLastAck(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	iss := establish(t, &s, now)
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_FIN|dgrams.FlagTCP_ACK, 0, nil)
+	sendTCP(t, &s, buf[:]) // ACK of FIN.
+	s.Write([]byte("bye"))
+	s.Close()
+	if s.State() != tcpctl.StateLastAck {
+		t.Fatal("expected LAST-ACK, got", s.State())
+	}
+	s.Tick(now)
+	now = now.Add(time.Second)
+	s.Tick(now)
+	if probe := sendTCP(t, &s, buf[:]); probe.Seq != iss || probe.Flags().HasFlags(dgrams.FlagTCP_FIN) {
+		t.Fatalf("expected zero window probe in LAST-ACK, got %s seq=%d", probe.Flags(), probe.Seq-iss)
+	}
+}
@@ -0,0 +1,173 @@
+package tcpctl
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// runTickInterval is the period at which Run advances the time of the stack.
+// It bounds the resolution of the TCP timers.
+const runTickInterval = 10 * time.Millisecond
+
+// maxTSOFrame is the size of the largest IP packet exchanged with a TSODevice.
+const maxTSOFrame = 0xffff
+
+// LinkType is the type of frames a Device sends and receives.
+type LinkType uint8
+
+const (
+	// LinkEthernet devices exchange Ethernet frames, i.e. TAP devices.
+	LinkEthernet LinkType = iota + 1
+	// LinkIP devices exchange IP packets without a link layer header, i.e. TUN devices.
+	LinkIP
+)
+
+// Clock is the source of time of a Stack. Its methods may be called from
+// different goroutines.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system, the default of a Stack.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Device is a network interface a Stack sends and receives frames through.
+// Its methods are called from different goroutines by Run: ReadFrame
+// concurrently with WriteFrame.
+type Device interface {
+	// ReadFrame blocks until a frame is received and copies it to dst,
+	// returning its length. Frames larger than dst may be truncated.
+	ReadFrame(dst []byte) (int, error)
+	// WriteFrame sends a frame.
+	WriteFrame(frame []byte) error
+	// MTU returns the maximum size of IP packets sent through the device.
+	MTU() int
+	// HardwareAddr returns the MAC address of the device, nil if LinkType is LinkIP.
+	HardwareAddr() net.HardwareAddr
+	// LinkType returns the type of frames of the device.
+	LinkType() LinkType
+}
+
+// OffloadDevice is a Device whose link layer verifies the checksums of the
+// frames received, i.e. a network card with receive checksum offload or a
+// virtio-net device. Run does not verify again the checksums of frames it
+// reports verified if StackConfig.ChecksumPolicy is ChecksumTrustOffload.
+type OffloadDevice interface {
+	Device
+	// ReadFrameChecked is like ReadFrame and also reports whether the link
+	// layer verified the IPv4 header and TCP checksums of the frame.
+	ReadFrameChecked(dst []byte) (n int, verified bool, err error)
+}
+
+// TSODevice is a Device completing the TCP checksums of the frames written and
+// splitting TCP segments larger than the MTU itself (TCP Segmentation Offload),
+// i.e. a TUN interface with virtio-net headers. Run writes it frames of up to
+// 64KiB whose TCP checksum only covers the pseudo-header, and reads frames of up
+// to 64KiB since such devices usually coalesce the segments received too.
+type TSODevice interface {
+	Device
+	// WriteFrameOffload sends a frame carrying a TCP segment over IPv4 whose
+	// checksum must be completed. If mss is non-zero the segment must be split
+	// into segments of mss bytes of data, the PSH and FIN flags only set on
+	// the last one.
+	WriteFrameOffload(frame []byte, mss int) error
+}
+
+// Run drives the stack with dev: it passes the frames read from dev to the stack,
+// writes the frames the stack has pending to dev and advances the time of the
+// stack as told by StackConfig.Clock. The hardware address and MTU of the stack
+// are taken from dev if not set in StackConfig. Run blocks until ctx is done or
+// reading from dev fails. Frames dev fails to write are dropped, like frames
+// lost on the link. The frames read are received in a separate goroutine which
+// returns once ReadFrame fails, so dev should be closed after Run returns.
+// Checksum verification and segmentation are left to devices implementing
+// OffloadDevice and TSODevice.
+func (st *Stack) Run(ctx context.Context, dev Device) error {
+	ethernet := dev.LinkType() == LinkEthernet
+	mtu := dev.MTU()
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	st.mu.Lock()
+	if st.hw == ([6]byte{}) {
+		copy(st.hw[:], dev.HardwareAddr())
+	}
+	if st.mtu == 0 && mtu >= pmtuMin && mtu <= 0xffff {
+		st.mtu = uint16(mtu)
+	}
+	st.mu.Unlock()
+	tso, _ := dev.(TSODevice)
+	if tso != nil {
+		mtu = maxTSOFrame
+	}
+	if ethernet {
+		mtu += dgrams.SizeEthernetHeaderNoVLAN
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, mtu)
+		offload, _ := dev.(OffloadDevice)
+		for {
+			var n int
+			var verified bool
+			var err error
+			if offload != nil {
+				n, verified, err = offload.ReadFrameChecked(buf)
+			} else {
+				n, err = dev.ReadFrame(buf)
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			// Frames not for the stack are dropped.
+			if ethernet {
+				st.recvEthernet(buf[:n], verified)
+			} else {
+				st.recvTCP(buf[:n], verified)
+			}
+			st.kick()
+		}
+	}()
+
+	buf := make([]byte, mtu)
+	ticker := time.NewTicker(runTickInterval)
+	defer ticker.Stop()
+	for {
+		st.Tick(st.clock.Now())
+		for {
+			n, mss, err := st.send(buf, ethernet, tso != nil)
+			if err != nil || n == 0 {
+				break
+			}
+			if tso != nil {
+				tso.WriteFrameOffload(buf[:n], mss)
+			} else {
+				dev.WriteFrame(buf[:n])
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case <-ticker.C:
+		case <-st.kickc:
+		}
+	}
+}
+
+// kick wakes up Run to send the frames pending after the user or a received frame
+// changed the state of a connection, so they are not delayed until the next tick.
+func (st *Stack) kick() {
+	select {
+	case st.kickc <- struct{}{}:
+	default:
+	}
+}
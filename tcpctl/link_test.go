@@ -0,0 +1,161 @@
+package tcpctl_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// chanDevice is a tcpctl.Device exchanging Ethernet frames over channels.
+type chanDevice struct {
+	rx, tx chan []byte
+	hw     net.HardwareAddr
+}
+
+func (d *chanDevice) ReadFrame(dst []byte) (int, error) {
+	frame, ok := <-d.rx
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(dst, frame), nil
+}
+
+func (d *chanDevice) WriteFrame(frame []byte) error {
+	d.tx <- append([]byte{}, frame...)
+	return nil
+}
+
+func (d *chanDevice) MTU() int                       { return 1500 }
+func (d *chanDevice) HardwareAddr() net.HardwareAddr { return d.hw }
+func (d *chanDevice) LinkType() tcpctl.LinkType      { return tcpctl.LinkEthernet }
+
+func (d *chanDevice) next(t *testing.T) (dgrams.EthernetHeader, dgrams.TCPHeader, []byte) {
+	t.Helper()
+	select {
+	case frame := <-d.tx:
+		tcp := dgrams.DecodeTCPHeader(frame[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader:])
+		payload := tcpPayload(frame[dgrams.SizeEthernetHeaderNoVLAN:], &tcp)
+		return dgrams.DecodeEthernetHeader(frame), tcp, payload
+	case <-time.After(time.Second):
+		t.Fatal("expected frame to be sent")
+		panic("unreachable")
+	}
+}
+
+func TestStackRun(t *testing.T) {
+	const irs = irsEstablished
+	dev := &chanDevice{
+		rx: make(chan []byte),
+		tx: make(chan []byte, 16),
+		hw: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+	}
+	st := newTestStack(t, 2)
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- st.Run(ctx, dev) }()
+
+	dev.rx <- packetSyn
+	eth, synack, _ := dev.next(t)
+	if synack.Flags() != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK {
+		t.Fatal("expected SYN-ACK, got", synack.Flags())
+	}
+	if want := dgrams.DecodeEthernetHeader(packetSyn).Source; eth.Destination != want {
+		t.Fatal("expected SYN-ACK sent to hardware address of SYN, got", eth.Destination)
+	}
+	ethernet := func(pkt []byte) []byte {
+		return append(append([]byte{}, packetSyn[:dgrams.SizeEthernetHeaderNoVLAN]...), pkt...)
+	}
+	iss := synack.Seq
+	dev.rx <- ethernet(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_PSH, 65535, nil, []byte("ping")))
+	remote := make(net.IP, 4)
+	fd, err := st.Accept(lfd, remote, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [16]byte
+	n, err := st.Recv(fd, buf[:], 0, time.Now().Add(time.Second))
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("expected ping, got %q %v", buf[:n], err)
+	}
+	st.Send(fd, []byte("pong"), 0, time.Time{})
+	_, seg, payload := dev.next(t)
+	if string(payload) != "pong" || seg.Ack != irs+5 {
+		t.Fatalf("expected pong acknowledging ping, got %q", payload)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected Run to return on cancel, got", err)
+	}
+	close(dev.rx)
+}
+
+// tsoDevice is a chanDevice offloading TCP segmentation, which reports the
+// segment size of each frame written on mss.
+type tsoDevice struct {
+	chanDevice
+	mss chan int
+}
+
+func (d *tsoDevice) WriteFrameOffload(frame []byte, mss int) error {
+	d.mss <- mss
+	return d.WriteFrame(frame)
+}
+
+func TestStackRunTSO(t *testing.T) {
+	const irs = irsEstablished
+	dev := &tsoDevice{
+		chanDevice: chanDevice{rx: make(chan []byte), tx: make(chan []byte, 16), hw: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		mss:        make(chan int, 16),
+	}
+	st := newTestStack(t, 2)
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- st.Run(ctx, dev) }()
+
+	dev.rx <- packetSyn
+	_, synack, _ := dev.next(t)
+	<-dev.mss
+	ethernet := func(pkt []byte) []byte {
+		return append(append([]byte{}, packetSyn[:dgrams.SizeEthernetHeaderNoVLAN]...), pkt...)
+	}
+	iss := synack.Seq
+	dev.rx <- ethernet(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 65535, nil, nil))
+	fd, err := st.Accept(lfd, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := st.Stats().OutSegs
+	st.Send(fd, make([]byte, 2048), 0, time.Time{})
+	// Data is sent in a single frame split into segments of 1448 bytes of data,
+	// the MSS less the timestamps option.
+	frame := <-dev.tx
+	if mss := <-dev.mss; mss != 1448 || len(frame) != dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader+32+2048 {
+		t.Fatalf("expected frame of 2048 bytes of data split by 1448, got %d bytes split by %d", len(frame), mss)
+	}
+	if sent := st.Stats().OutSegs - before; sent != 2 {
+		t.Fatal("expected 2 segments counted, got", sent)
+	}
+	// The checksum only covers the pseudo-header, the device completes it.
+	pkt := frame[dgrams.SizeEthernetHeaderNoVLAN:]
+	vnet := dgrams.VirtioNetHeader{CsumStart: dgrams.SizeIPHeader, CsumOffset: 16}
+	vnet.CompleteChecksum(pkt)
+	if err := dgrams.VerifyChecksumsIPv4(pkt); err != nil {
+		t.Fatal("checksum not completed by the device:", err)
+	}
+	cancel()
+	<-done
+	close(dev.rx)
+}
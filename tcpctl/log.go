@@ -0,0 +1,198 @@
+package tcpctl
+
+import (
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// LogLevel is the severity of an Event. Levels have the values of their
+// log/slog counterparts so that they convert to slog.Level.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+// EventKind enumerates the events logged by sockets.
+type EventKind uint8
+
+const (
+	// EventState is a change of the state of a connection, logged at LevelInfo.
+	EventState EventKind = iota + 1
+	// EventRecv is a segment received, logged at LevelDebug.
+	EventRecv
+	// EventSend is a segment sent, logged at LevelDebug.
+	EventSend
+	// EventRetransmit is a segment retransmitted, logged at LevelDebug.
+	EventRetransmit
+	// EventDrop is a segment received and dropped, logged at LevelInfo.
+	// Err is the reason it was dropped.
+	EventDrop
+	// EventBadChecksum is a segment received with a checksum not matching its
+	// contents, logged at LevelWarn.
+	EventBadChecksum
+	// EventError is an internal error of the socket, logged at LevelError.
+	EventError
+)
+
+// String returns the message of events of kind k.
+func (k EventKind) String() string {
+	switch k {
+	case EventState:
+		return "state change"
+	case EventRecv:
+		return "segment received"
+	case EventSend:
+		return "segment sent"
+	case EventRetransmit:
+		return "segment retransmitted"
+	case EventDrop:
+		return "segment dropped"
+	case EventBadChecksum:
+		return "bad checksum"
+	case EventError:
+		return "error"
+	}
+	return "unknown event"
+}
+
+// Event is a structured event of a connection passed to a Logger. Fields
+// which do not apply to its kind are zero.
+type Event struct {
+	Kind  EventKind
+	Level LogLevel
+	// Time is the time of the socket or stack when the event happened.
+	Time time.Time
+	// Addresses and ports of the connection, those of the segment for events
+	// of a Stack which are not of a connection.
+	LocalAddr, RemoteAddr [4]byte
+	LocalPort, RemotePort uint16
+	// State is the state of the connection after the event. From is the
+	// state it changed from in EventState events.
+	State, From State
+	// Seq, Ack, Flags, Window and Len describe the segment sent or received,
+	// Len being the length of its payload.
+	Seq, Ack Seq
+	Flags    dgrams.TCPFlags
+	Window   uint16
+	Len      int
+	// Err is the reason of EventDrop and EventError events.
+	Err error
+}
+
+// Logger receives the events of sockets and stacks, see Socket.SetLogger and
+// StackConfig.Logger. Events are only built and passed to Log if Enabled returns
+// true for their level, so that sockets without a logger or with events disabled
+// do not pay for them. Both methods are called with the socket locked and must
+// not call methods of the socket. See NewSlogLogger for a Logger using log/slog.
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Log(e Event)
+}
+
+// connID identifies a connection in the events it logs.
+type connID struct {
+	local, remote [4]byte
+	lport, rport  uint16
+}
+
+// SetLogger sets the logger receiving the events of the socket. Nil, the default,
+// disables logging.
+func (s *Socket) SetLogger(l Logger) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.log = l
+}
+
+// setConnID sets the connection identifying the events of the socket to that
+// between s.us and s.them. s.cs.mu must be held.
+func (s *Socket) setConnID() {
+	s.cs.id = connID{lport: uint16(s.us.Port), rport: uint16(s.them.Port)}
+	copy(s.cs.id.local[:], s.us.IP.To4())
+	copy(s.cs.id.remote[:], s.them.IP.To4())
+}
+
+// logEnabled returns true if events of level are logged. cs.mu must be held.
+func (cs *connState) logEnabled(level LogLevel) bool {
+	return cs.log != nil && cs.log.Enabled(level)
+}
+
+// logEvent logs e after filling in the time, connection and state. cs.mu must be held.
+func (cs *connState) logEvent(e Event) {
+	e.Time = cs.now
+	e.LocalAddr, e.RemoteAddr = cs.id.local, cs.id.remote
+	e.LocalPort, e.RemotePort = cs.id.lport, cs.id.rport
+	if e.Kind != EventState {
+		e.State = cs.state
+	}
+	cs.log.Log(e)
+}
+
+// logSegment logs a segment of the connection sent or received. cs.mu must be held.
+func (cs *connState) logSegment(kind EventKind, hdr *dgrams.TCPHeader, payloadLen int) {
+	if !cs.logEnabled(LevelDebug) {
+		return
+	}
+	cs.logEvent(Event{
+		Kind:   kind,
+		Level:  LevelDebug,
+		Seq:    Seq(hdr.Seq),
+		Ack:    Seq(hdr.Ack),
+		Flags:  hdr.Flags(),
+		Window: hdr.WindowSize,
+		Len:    payloadLen,
+	})
+}
+
+// setState moves the connection to state, logging and counting the change.
+// cs.mu must be held.
+func (cs *connState) setState(state State) {
+	if state == cs.state {
+		return
+	}
+	if cs.logEnabled(LevelInfo) {
+		cs.logEvent(Event{Kind: EventState, Level: LevelInfo, State: state, From: cs.state})
+	}
+	cs.countTransition(cs.state, state)
+	cs.state = state
+}
+
+// logPacket logs an event of the stack about the TCP+IPv4 packet in buf, which
+// has been checked to contain the headers. st.mu must be held.
+func (st *Stack) logPacket(kind EventKind, level LogLevel, buf []byte, err error) {
+	if st.log == nil || !st.log.Enabled(level) {
+		return
+	}
+	ip := dgrams.DecodeIPv4Header(buf)
+	ihl := int(ip.IHL) * 4
+	tcp := dgrams.DecodeTCPHeader(buf[ihl:])
+	e := Event{
+		Kind:       kind,
+		Level:      level,
+		Time:       st.now,
+		LocalAddr:  ip.Destination,
+		RemoteAddr: ip.Source,
+		LocalPort:  tcp.DestinationPort,
+		RemotePort: tcp.SourcePort,
+		Seq:        Seq(tcp.Seq),
+		Ack:        Seq(tcp.Ack),
+		Flags:      tcp.Flags(),
+		Window:     tcp.WindowSize,
+		Err:        err,
+	}
+	if kind == EventSend {
+		// Packets sent by the stack go from the local to the remote address.
+		e.LocalAddr, e.RemoteAddr = e.RemoteAddr, e.LocalAddr
+		e.LocalPort, e.RemotePort = e.RemotePort, e.LocalPort
+	}
+	if end := int(ip.TotalLength); end <= len(buf) {
+		if start := ihl + int(tcp.OffsetInBytes()); start <= end {
+			e.Len = end - start
+		}
+	}
+	st.log.Log(e)
+}
@@ -0,0 +1,105 @@
+package tcpctl_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+// eventLog is a Logger recording the events of level and above.
+type eventLog struct {
+	level  tcpctl.LogLevel
+	events []tcpctl.Event
+}
+
+func (l *eventLog) Enabled(level tcpctl.LogLevel) bool { return level >= l.level }
+func (l *eventLog) Log(e tcpctl.Event)                 { l.events = append(l.events, e) }
+
+func (l *eventLog) kinds() (kinds []tcpctl.EventKind) {
+	for _, e := range l.events {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+func TestSocketLogger(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	log := &eventLog{level: tcpctl.LevelDebug}
+	s.SetLogger(log)
+	var buf [1500]byte
+	now := time.Unix(100, 0)
+	s.Tick(now)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	// Segment outside the receive window.
+	s.RecvTCP(tcpPacket(irs+1+1<<20, iss+1, dgrams.FlagTCP_ACK, 100, nil, []byte("x")))
+	want := []tcpctl.EventKind{
+		tcpctl.EventState, // CLOSED -> LISTEN.
+		tcpctl.EventRecv,  // SYN.
+		tcpctl.EventState, // LISTEN -> SYN-RECEIVED.
+		tcpctl.EventSend,  // SYN-ACK.
+		tcpctl.EventRecv,  // ACK.
+		tcpctl.EventState, // SYN-RECEIVED -> ESTABLISHED.
+		tcpctl.EventRecv,
+		tcpctl.EventDrop,
+	}
+	got := log.kinds()
+	if len(got) != len(want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	}
+	ev := log.events
+	if ev[2].From != tcpctl.StateListen || ev[2].State != tcpctl.StateSynRcvd {
+		t.Errorf("got state change from %s to %s", ev[2].From, ev[2].State)
+	}
+	if ev[3].Seq != tcpctl.Seq(iss) || ev[3].Ack != irs+1 || ev[3].Flags != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK {
+		t.Errorf("SYN-ACK event does not match segment sent: %+v", ev[3])
+	}
+	if ev[3].LocalPort != 80 || ev[3].RemotePort != 58920 || ev[3].RemoteAddr != [4]byte{192, 168, 1, 112} {
+		t.Errorf("SYN-ACK event has wrong connection: %+v", ev[3])
+	}
+	if ev[6].Len != 1 || ev[7].Err == nil || !ev[7].Time.Equal(now) {
+		t.Errorf("drop event %+v of segment %+v", ev[7], ev[6])
+	}
+	// Only events of enabled levels are logged.
+	log.events, log.level = nil, tcpctl.LevelInfo
+	s.Close()
+	if got := log.kinds(); len(got) != 1 || got[0] != tcpctl.EventState || log.events[0].State != tcpctl.StateFinWait1 {
+		t.Fatalf("expected only state change on close, got %+v", log.events)
+	}
+}
+
+func TestStackLogger(t *testing.T) {
+	log := &eventLog{level: tcpctl.LevelDebug}
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:       net.IPv4(192, 168, 1, 5),
+		MaxSockets: 1,
+		Logger:     log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Tick(time.Now())
+	var buf [1500]byte
+	st.RecvTCP(tcpPacketPorts(58921, 81, irsEstablished, 1, dgrams.FlagTCP_ACK, 65535, nil, nil))
+	if n, _ := st.SendTCP(buf[:]); n == 0 {
+		t.Fatal("expected RST")
+	}
+	got := log.events
+	if len(got) != 2 || got[0].Kind != tcpctl.EventDrop || got[1].Kind != tcpctl.EventSend {
+		t.Fatalf("expected drop and RST events, got %+v", got)
+	}
+	if got[0].LocalPort != 81 || got[1].LocalPort != 81 || got[1].RemotePort != 58921 || got[1].Flags != dgrams.FlagTCP_RST {
+		t.Fatalf("events do not match segments: %+v", got)
+	}
+}
@@ -0,0 +1,115 @@
+package tcpctl
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/dgrams"
+)
+
+// tcpOptions contains the TCP options of an incoming segment relevant to the connection.
+type tcpOptions struct {
+	hasMSS        bool
+	mss           uint16
+	sackPermitted bool
+	hasWS         bool
+	wscale        uint8
+	hasTS         bool
+	tsVal         uint32
+	tsEcr         uint32
+	// sack contains the SACK blocks of the segment, at most 4 fit in a TCP header.
+	sack  [oooMaxBlocks]oooBlock
+	nsack int
+}
+
+// parseOptions decodes the TCP options in b. Unknown options are ignored.
+func parseOptions(b []byte) (opts tcpOptions, err error) {
+	for len(b) > 0 {
+		kind, data, n, err := dgrams.DecodeTCPOption(b)
+		if err != nil {
+			return opts, err
+		}
+		b = b[n:]
+		switch kind {
+		case dgrams.TCPOptionEnd:
+			return opts, nil
+		case dgrams.TCPOptionMSS:
+			if len(data) != 2 {
+				return opts, errors.New("bad MSS option length")
+			}
+			opts.hasMSS = true
+			opts.mss = binary.BigEndian.Uint16(data)
+		case dgrams.TCPOptionSACKPermitted:
+			opts.sackPermitted = true
+		case dgrams.TCPOptionWindowScale:
+			if len(data) != 1 {
+				return opts, errors.New("bad window scale option length")
+			}
+			opts.hasWS = true
+			opts.wscale = data[0]
+		case dgrams.TCPOptionTimestamps:
+			if len(data) != 8 {
+				return opts, errors.New("bad timestamps option length")
+			}
+			opts.hasTS = true
+			opts.tsVal = binary.BigEndian.Uint32(data)
+			opts.tsEcr = binary.BigEndian.Uint32(data[4:])
+		case dgrams.TCPOptionSACK:
+			if len(data)%8 != 0 || len(data)/8 > len(opts.sack) {
+				return opts, errors.New("bad SACK option length")
+			}
+			for opts.nsack = 0; len(data) > 0; opts.nsack++ {
+				opts.sack[opts.nsack] = oooBlock{
+					Start: Seq(binary.BigEndian.Uint32(data)),
+					End:   Seq(binary.BigEndian.Uint32(data[4:])),
+				}
+				data = data[8:]
+			}
+		}
+	}
+	return opts, nil
+}
+
+// appendOptions appends the TCP options for an outgoing segment with the given
+// flags to dst. Options are padded with NOPs to be 4 byte aligned. cs.mu must be held.
+func (cs *connState) appendOptions(dst []byte, flags dgrams.TCPFlags) []byte {
+	const maxOptionsLen = 40
+	if flags.HasFlags(dgrams.FlagTCP_SYN) {
+		dst = append(dst, byte(dgrams.TCPOptionMSS), 4)
+		dst = binary.BigEndian.AppendUint16(dst, cs.advertisedMSS())
+	}
+	if cs.ts.ok && !flags.HasFlags(dgrams.FlagTCP_RST) {
+		dst = append(dst, byte(dgrams.TCPOptionNop), byte(dgrams.TCPOptionNop),
+			byte(dgrams.TCPOptionTimestamps), 10)
+		dst = binary.BigEndian.AppendUint32(dst, cs.ts.val(cs.now))
+		dst = binary.BigEndian.AppendUint32(dst, cs.ts.recent)
+	}
+	if flags.HasFlags(dgrams.FlagTCP_SYN) {
+		if cs.sackOK {
+			dst = append(dst, byte(dgrams.TCPOptionNop), byte(dgrams.TCPOptionNop),
+				byte(dgrams.TCPOptionSACKPermitted), 2)
+		}
+		if cs.wsOK {
+			dst = append(dst, byte(dgrams.TCPOptionNop),
+				byte(dgrams.TCPOptionWindowScale), 3, cs.rcv.shift)
+		}
+		return dst
+	}
+	if cs.sackOK && cs.ooo.Len() > 0 && flags.HasFlags(dgrams.FlagTCP_ACK) {
+		// Report as many SACK blocks as fit, most recently received first.
+		var blocks [oooMaxBlocks]oooBlock
+		sacks := cs.ooo.appendBlocks(blocks[:0])
+		if max := (maxOptionsLen - len(dst) - 4) / 8; len(sacks) > max {
+			sacks = sacks[:max]
+		}
+		if len(sacks) > 0 {
+			dst = append(dst, byte(dgrams.TCPOptionNop), byte(dgrams.TCPOptionNop),
+				byte(dgrams.TCPOptionSACK), byte(2+8*len(sacks)))
+			for _, b := range sacks {
+				dst = binary.BigEndian.AppendUint32(dst, uint32(b.Start))
+				dst = binary.BigEndian.AppendUint32(dst, uint32(b.End))
+			}
+		}
+	}
+	return dst
+}
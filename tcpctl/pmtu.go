@@ -0,0 +1,227 @@
+package tcpctl
+
+import (
+	"time"
+)
+
+const (
+	// defaultMTU is the link MTU assumed when none is set by the user, that of Ethernet.
+	defaultMTU = 1500
+	// pmtuMin is the smallest path MTU accepted. It is the datagram size all
+	// hosts must accept (RFC 791), smaller values reported by ICMP are likely forged.
+	pmtuMin = 576
+	// plpmtuBase is the MTU used when a black hole is detected, as suggested by RFC 4821 section 7.2.
+	plpmtuBase = 1024
+	// plpmtuResolution is the width of the search range below which PLPMTUD stops probing.
+	plpmtuResolution = 32
+	// plpmtuRaiseTimeout is the time after which a converged search is
+	// restarted to discover a larger path MTU (RFC 4821 section 7.7).
+	plpmtuRaiseTimeout = 10 * time.Minute
+	// plpmtuBlackholeRTOs is the number of consecutive timeouts of a segment
+	// larger than plpmtuBase after which the path is assumed to be an MTU black hole.
+	plpmtuBlackholeRTOs = 2
+)
+
+// mtuPlateaus are common MTUs used to estimate the path MTU when a router does not
+// report the next-hop MTU in a Fragmentation Needed message (RFC 1191 section 7).
+var mtuPlateaus = [...]uint16{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68}
+
+// pmtuState holds the Path MTU Discovery state of a connection. The path MTU is
+// lowered by ICMP Fragmentation Needed messages (RFC 1191). Since ICMP is often
+// filtered, repeated timeouts of large segments are taken as a sign of an MTU
+// black hole and Packetization Layer Path MTU Discovery (RFC 4821) takes over,
+// searching for the path MTU with probe segments.
+type pmtuState struct {
+	// mtu is the largest IP datagram believed to traverse the path to the remote peer.
+	mtu uint16
+	// link is the MTU of the local link, the upper bound for the path MTU.
+	link uint16
+	// plpmtud is set if PLPMTUD may be used when a black hole is detected.
+	plpmtud bool
+	// searching is set once PLPMTUD has taken over.
+	searching bool
+	// low is the largest MTU known to work and high the smallest assumed not to.
+	low, high uint16
+	// probe is the sequence space of the outstanding probe segment of size probeSize.
+	probe     oooBlock
+	probeSize uint16
+	// raise is the time after which a converged search is restarted.
+	raise time.Time
+}
+
+func (p *pmtuState) reset(link uint16, plpmtud bool) {
+	*p = pmtuState{mtu: link, link: link, plpmtud: plpmtud}
+}
+
+// checkConverged stops probing until the raise timer expires if the search range is narrow enough.
+func (p *pmtuState) checkConverged(now time.Time) {
+	if p.high-p.low < plpmtuResolution {
+		p.raise = now.Add(plpmtuRaiseTimeout)
+	}
+}
+
+// maxSegment returns the largest segment the remote peer and the path accept,
+// excluding the TCP and IP headers. TCP options must fit in it too (RFC 6691).
+func (cs *connState) maxSegment() uint32 {
+	mss := uint32(cs.pmtu.mtu) - sizeTCPIPv4
+	if peer := uint32(cs.peerMSS); peer < mss {
+		mss = peer
+	}
+	return mss
+}
+
+// fixedOptionsLen returns the length of the options sent in every non-SYN segment.
+func (cs *connState) fixedOptionsLen() uint32 {
+	if cs.ts.ok {
+		return 12
+	}
+	return 0
+}
+
+// smss returns the sender maximum segment size, the largest amount of data
+// sent in a single segment. It is the segment size used by congestion control.
+func (cs *connState) smss() uint32 {
+	return cs.maxSegment() - cs.fixedOptionsLen()
+}
+
+// advertisedMSS returns the MSS sent to the remote peer, derived from the link MTU.
+func (cs *connState) advertisedMSS() uint16 {
+	return cs.pmtu.link - sizeTCPIPv4
+}
+
+// pmtuReduce lowers the path MTU as reported by an ICMP Fragmentation Needed
+// message for the datagram of total length sent. Segments in flight no longer
+// fitting the path are retransmitted, which is not a sign of congestion.
+func (cs *connState) pmtuReduce(mtu, sent uint16) {
+	if mtu == 0 {
+		// Router predates RFC 1191, guess the MTU from the plateau table.
+		for _, plateau := range mtuPlateaus {
+			if plateau < sent {
+				mtu = plateau
+				break
+			}
+		}
+	}
+	if mtu < pmtuMin {
+		mtu = pmtuMin
+	}
+	if mtu >= cs.pmtu.mtu {
+		return
+	}
+	cs.pmtu.mtu = mtu
+	if cs.pmtu.searching && mtu < cs.pmtu.high {
+		cs.pmtu.high = mtu + 1
+		if cs.pmtu.low > mtu {
+			cs.pmtu.low = mtu
+		}
+	}
+	cs.markOversized()
+}
+
+// markOversized marks all segments in flight larger than the path allows for retransmission.
+func (cs *connState) markOversized() {
+	max := cs.smss()
+	for i := 0; i < cs.rtx.Len(); i++ {
+		seg := cs.rtx.at(i)
+		if !seg.sacked && seg.len-segLen(seg.flags, nil) > max {
+			seg.lost = true
+			cs.rtx.force = true
+		}
+	}
+}
+
+// pmtuTimeout is called on expiry of the retransmission timer. If the first
+// unacknowledged segment keeps timing out and is larger than the base MTU of
+// RFC 4821 the path is assumed to be a black hole and PLPMTUD starts searching.
+func (cs *connState) pmtuTimeout() {
+	seg := cs.rtx.firstUnsacked()
+	if seg == nil || !cs.pmtu.plpmtud {
+		return
+	}
+	if cs.pmtu.probeSize != 0 && seg.seq == cs.pmtu.probe.Start {
+		cs.probeLost()
+		return
+	}
+	size := seg.len - segLen(seg.flags, nil) + sizeTCPIPv4 + cs.fixedOptionsLen()
+	if int(seg.nrtx)+1 < plpmtuBlackholeRTOs || size <= plpmtuBase {
+		return
+	}
+	p := &cs.pmtu
+	p.high = p.mtu
+	if p.mtu > plpmtuBase {
+		p.mtu = plpmtuBase
+	} else {
+		p.mtu = pmtuMin
+	}
+	p.low = p.mtu
+	p.searching = true
+	p.raise = time.Time{}
+	p.probeSize = 0
+	p.checkConverged(cs.now)
+	cs.markOversized()
+}
+
+// probeLen returns the amount of data the next segment must carry to probe
+// for a larger path MTU or zero if no probe is to be sent.
+func (cs *connState) probeLen(optlen uint32) uint32 {
+	p := &cs.pmtu
+	if !p.searching || p.probeSize != 0 || cs.recovery || cs.now.Before(p.raise) {
+		return 0
+	}
+	if !p.raise.IsZero() {
+		// Search converged a while ago, look for a larger MTU again.
+		p.raise = time.Time{}
+		p.high = p.link + 1
+		if peer := cs.peerMSS + sizeTCPIPv4 + 1; peer < p.high {
+			p.high = peer
+		}
+		if p.high-p.low < plpmtuResolution {
+			p.checkConverged(cs.now)
+			return 0
+		}
+	}
+	size := (uint32(p.low) + uint32(p.high)) / 2
+	return size - sizeTCPIPv4 - optlen
+}
+
+// probeSent records a probe segment occupying seq to seq+datalen was sent.
+func (cs *connState) probeSent(seq Seq, datalen, optlen uint32) {
+	cs.pmtu.probe = oooBlock{Start: seq, End: seq.Add(datalen)}
+	cs.pmtu.probeSize = uint16(datalen + optlen + sizeTCPIPv4)
+}
+
+// probeAcked checks if the outstanding probe was acknowledged, in which
+// case the path MTU is raised to the size of the probe.
+func (cs *connState) probeAcked(ack Seq) {
+	p := &cs.pmtu
+	if p.probeSize == 0 || ack.LessThan(p.probe.End) {
+		return
+	}
+	p.mtu = p.probeSize
+	p.low = p.probeSize
+	p.probeSize = 0
+	p.checkConverged(cs.now)
+}
+
+// probeLost records the failure of the outstanding probe. Probe losses are
+// not congestion signals so the congestion window is left untouched.
+func (cs *connState) probeLost() {
+	p := &cs.pmtu
+	p.high = p.probeSize
+	p.probeSize = 0
+	p.checkConverged(cs.now)
+	cs.markOversized()
+}
+
+// probeIsLost returns true if the outstanding probe segment was marked lost.
+func (cs *connState) probeIsLost() bool {
+	if cs.pmtu.probeSize == 0 {
+		return false
+	}
+	for i := 0; i < cs.rtx.Len(); i++ {
+		if seg := cs.rtx.at(i); seg.seq == cs.pmtu.probe.Start {
+			return seg.lost
+		}
+	}
+	return false
+}
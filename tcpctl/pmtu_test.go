@@ -0,0 +1,201 @@
+package tcpctl_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestMSSOption(t *testing.T) {
+	const irs = 1000
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetMTU(1280)
+	s.SetTimestamps(false)
+	s.SetBuffers(make([]byte, 8000), make([]byte, 2048))
+	s.Listen()
+	// Peer can only receive segments of 700 bytes.
+	mss := []byte{byte(dgrams.TCPOptionMSS), 4, 0, 0}
+	binary.BigEndian.PutUint16(mss[2:], 700)
+	recvTCPOpts(t, &s, irs, 0, dgrams.FlagTCP_SYN, 8000, mss, nil)
+	synack := sendTCP(t, &s, buf[:])
+	if opt, ok := findOption(buf[:], &synack, dgrams.TCPOptionMSS); !ok || binary.BigEndian.Uint16(opt) != 1280-40 {
+		t.Fatalf("expected MSS option derived from link MTU, got %v", opt)
+	}
+	iss := synack.Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 8000, nil)
+	s.Write(make([]byte, 1500))
+	for _, want := range []int{700, 700, 100} {
+		seg := sendTCP(t, &s, buf[:])
+		if got := len(tcpPayload(buf[:], &seg)); got != want {
+			t.Fatalf("expected segment of %d bytes to honour peer MSS, got %d", want, got)
+		}
+	}
+}
+
+func TestMSSOptionTiny(t *testing.T) {
+	const irs = irsEstablished
+	for _, peerMSS := range []uint16{0, 4, 87} {
+		var s tcpctl.Socket
+		var buf [1500]byte
+		s.SetBuffers(make([]byte, 1000), make([]byte, 2048))
+		s.Listen()
+		// Timestamps take 12 bytes of every segment, more than the MSS advertised.
+		syn := append([]byte{}, packetSyn[dgrams.SizeEthernetHeaderNoVLAN:]...)
+		binary.BigEndian.PutUint16(syn[dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions+2:], peerMSS)
+		setChecksums(syn)
+		if _, _, err := s.RecvTCP(syn); err != nil {
+			t.Fatal(err)
+		}
+		iss := sendTCP(t, &s, buf[:]).Seq
+		recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 8000, nil)
+		s.Write(make([]byte, 1000))
+		seg := sendTCP(t, &s, buf[:])
+		if got := len(tcpPayload(buf[:], &seg)); got != 88-12 {
+			t.Fatalf("MSS %d: expected segment of %d bytes, got %d", peerMSS, 88-12, got)
+		}
+	}
+}
+
+func TestPMTUDFragmentationNeeded(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	const mtu = 1000
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetBuffers(make([]byte, 8000), make([]byte, 2048))
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	s.Write(make([]byte, 3000))
+	seg := sendTCP(t, &s, buf[:])
+	if ip := dgrams.DecodeIPv4Header(buf[:]); ip.TotalLength != 1500 || !ip.Flags.DontFragment() {
+		t.Fatalf("expected full sized segment with DF set, got length %d flags %#x", ip.TotalLength, ip.Flags)
+	}
+	first := quote(buf[:])
+	for n, _ := s.SendTCP(buf[:]); n > 0; n, _ = s.SendTCP(buf[:]) {
+	}
+
+	// Forged message quoting a sequence number not in flight is ignored.
+	forged := append([]byte{}, first...)
+	binary.BigEndian.PutUint32(forged[24:], iss-1000)
+	if err := s.RecvICMP(fragNeeded(forged, mtu)); err == nil {
+		t.Fatal("expected ICMP error for segment not in flight to be rejected")
+	}
+	if n, _ := s.SendTCP(buf[:]); n != 0 {
+		t.Fatal("no retransmission expected after forged ICMP")
+	}
+
+	if err := s.RecvICMP(fragNeeded(first, mtu)); err != nil {
+		t.Fatal(err)
+	}
+	// Segments larger than the path MTU are retransmitted in segments fitting it.
+	next := seg.Seq
+	for next != iss+1+2*1448 {
+		n, _ := s.SendTCP(buf[:])
+		if n == 0 {
+			t.Fatalf("expected retransmission of seq %d", next-iss)
+		} else if n > mtu {
+			t.Fatalf("segment of %d bytes exceeds path MTU", n)
+		}
+		seg := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+		if seg.Seq != next {
+			t.Fatalf("expected retransmission of seq %d, got %d", next-iss, seg.Seq-iss)
+		}
+		next += uint32(len(tcpPayload(buf[:], &seg)))
+	}
+	if n, _ := s.SendTCP(buf[:]); n != 0 {
+		t.Fatal("segment fitting the path MTU should not be retransmitted")
+	}
+}
+
+// quote returns the IP header and first 8 octets of the TCP segment in buf
+// as quoted by ICMP error messages.
+func quote(buf []byte) []byte {
+	return append([]byte{}, buf[:dgrams.SizeIPHeader+8]...)
+}
+
+// fragNeeded returns an ICMP Fragmentation Needed message from a router with
+// next-hop MTU mtu quoting the start of the packet sent.
+func fragNeeded(sent []byte, mtu uint16) []byte {
+	buf := make([]byte, dgrams.SizeIPHeader+dgrams.SizeICMPv4Header+len(sent))
+	ip := dgrams.IPv4Header{
+		Version:     4,
+		IHL:         5,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    1,
+		Source:      [4]byte{192, 168, 1, 1},
+		Destination: [4]byte{192, 168, 1, 5},
+	}
+	icmp := dgrams.ICMPv4Header{
+		Type: dgrams.ICMPv4DestinationUnreachable,
+		Code: dgrams.ICMPv4CodeFragmentationNeeded,
+	}
+	binary.BigEndian.PutUint16(icmp.Data[2:], mtu)
+	ip.Put(buf)
+	icmp.Put(buf[dgrams.SizeIPHeader:])
+	copy(buf[dgrams.SizeIPHeader+dgrams.SizeICMPv4Header:], sent)
+	setChecksums(buf)
+	return buf
+}
+
+func TestPLPMTUDBlackhole(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	s.Tick(now)
+	s.SetSACK(false)
+	s.SetBuffers(make([]byte, 20000), make([]byte, 2048))
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	s.Write(make([]byte, 20000))
+	nxt := iss + 1
+	sendAll := func() (sizes []int) {
+		for {
+			n, _ := s.SendTCP(buf[:])
+			if n == 0 {
+				return sizes
+			}
+			seg := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+			if end := seg.Seq + uint32(len(tcpPayload(buf[:], &seg))); int32(end-nxt) > 0 {
+				nxt = end
+			}
+			sizes = append(sizes, n)
+		}
+	}
+	sendAll()
+	// Full sized segments never arrive and ICMP is filtered.
+	now = now.Add(time.Second)
+	s.Tick(now)
+	if sizes := sendAll(); len(sizes) != 1 || sizes[0] != 1500 {
+		t.Fatalf("expected single full sized retransmission on first timeout, got %v", sizes)
+	}
+	now = now.Add(2 * time.Second)
+	s.Tick(now)
+	sizes := sendAll()
+	for _, size := range sizes {
+		if size > 1024 {
+			t.Fatalf("expected retransmissions within base MTU 1024 after black hole detected, got %v", sizes)
+		}
+	}
+	if len(sizes) == 0 || sizes[0] != 1024 {
+		t.Fatalf("expected retransmission with base MTU 1024, got %v", sizes)
+	}
+	// Data gets through with smaller segments. PLPMTUD probes for a larger MTU.
+	recvTCP(t, &s, irs+1, nxt, dgrams.FlagTCP_ACK, 100, nil)
+	if sizes := sendAll(); len(sizes) == 0 || sizes[0] != (1024+1500)/2 {
+		t.Fatalf("expected probe of %d bytes, got %v", (1024+1500)/2, sizes)
+	}
+	probeEnd := nxt
+	recvTCP(t, &s, irs+1, probeEnd, dgrams.FlagTCP_ACK, 100, nil)
+	if sizes := sendAll(); len(sizes) == 0 || sizes[0] != (1262+1500)/2 {
+		t.Fatalf("expected probe of %d bytes after successful probe, got %v", (1262+1500)/2, sizes)
+	}
+}
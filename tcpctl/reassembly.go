@@ -0,0 +1,105 @@
+package tcpctl
+
+// oooMaxBlocks is the maximum number of disjoint ranges of out-of-order data
+// held by a connection. It matches the maximum number of SACK blocks that fit
+// in a TCP header so all data held can be reported to the sender.
+const oooMaxBlocks = 4
+
+// oooBlock is a contiguous range [Start, End) of sequence space received
+// ahead of RCV.NXT.
+type oooBlock struct {
+	Start Seq
+	End   Seq
+}
+
+// oooStore keeps track of data received out of order. The data itself is
+// written to the free space of the receive buffer at its offset from RCV.NXT,
+// so memory usage is bounded by the receive window. oooStore only tracks which
+// ranges of that space hold valid data, and is bounded to oooMaxBlocks ranges.
+type oooStore struct {
+	// blocks are ordered by sequence number and never overlap nor touch.
+	blocks [oooMaxBlocks]oooBlock
+	n      int
+	// recent is the block containing the most recently received segment,
+	// which must be reported first in SACK options as per RFC 2018.
+	recent oooBlock
+}
+
+// Len returns the number of disjoint blocks held.
+func (o *oooStore) Len() int { return o.n }
+
+func (o *oooStore) reset() { *o = oooStore{} }
+
+// insert adds the range [start, end) to the store, merging it with blocks it
+// overlaps or touches. If the store is full and the range can't be merged
+// the block farthest from RCV.NXT is evicted to make room, or the range is
+// rejected if it is itself the farthest. insert returns false if rejected.
+func (o *oooStore) insert(start, end Seq) bool {
+	if !start.LessThan(end) {
+		return false
+	}
+	// Find first block that ends at or after start, which is where the new block goes.
+	i := 0
+	for i < o.n && o.blocks[i].End.LessThan(start) {
+		i++
+	}
+	// Find blocks that overlap or touch the new range and merge them.
+	j := i
+	for j < o.n && o.blocks[j].Start.LessThanEq(end) {
+		if o.blocks[j].Start.LessThan(start) {
+			start = o.blocks[j].Start
+		}
+		if end.LessThan(o.blocks[j].End) {
+			end = o.blocks[j].End
+		}
+		j++
+	}
+	merged := j - i
+	if merged == 0 && o.n == len(o.blocks) {
+		if i == o.n {
+			return false // New range is farthest, reject it.
+		}
+		o.n-- // Evict farthest block.
+	}
+	// Replace blocks [i,j) with the single merged block.
+	if merged != 1 {
+		copy(o.blocks[i+1:], o.blocks[j:o.n])
+		o.n += 1 - merged
+	}
+	o.blocks[i] = oooBlock{Start: start, End: end}
+	o.recent = o.blocks[i]
+	return true
+}
+
+// pop removes and returns the first block if it starts at or before nxt,
+// which is to say the block is now contiguous with in-order data.
+func (o *oooStore) pop(nxt Seq) (oooBlock, bool) {
+	if o.n == 0 || nxt.LessThan(o.blocks[0].Start) {
+		return oooBlock{}, false
+	}
+	first := o.blocks[0]
+	copy(o.blocks[:], o.blocks[1:o.n])
+	o.n--
+	return first, true
+}
+
+// appendBlocks appends the blocks held to dst, starting with the block holding
+// the most recently received data followed by the rest in sequence order.
+// It is used to generate SACK blocks.
+func (o *oooStore) appendBlocks(dst []oooBlock) []oooBlock {
+	recent := -1
+	for i := 0; i < o.n; i++ {
+		b := o.blocks[i]
+		if b.Start.LessThanEq(o.recent.Start) && o.recent.End.LessThanEq(b.End) {
+			recent = i
+			dst = append(dst, b)
+			break
+		}
+	}
+	for i := 0; i < o.n; i++ {
+		if i != recent {
+			dst = append(dst, o.blocks[i])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,63 @@
+package tcpctl
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOOOStoreMerge(t *testing.T) {
+	const base = math.MaxUint32 - 50 // Exercise wraparound.
+	var o oooStore
+	at := func(off uint32) Seq { return Seq(base).Add(off) }
+	o.insert(at(100), at(110))
+	o.insert(at(50), at(60))
+	o.insert(at(120), at(130))
+	o.insert(at(60), at(65)) // Touches block [50,60).
+	want := []oooBlock{{at(50), at(65)}, {at(100), at(110)}, {at(120), at(130)}}
+	checkBlocks(t, o.blocks[:o.n], want)
+	// Merge three blocks into one.
+	o.insert(at(64), at(125))
+	want = []oooBlock{{at(50), at(130)}}
+	checkBlocks(t, o.blocks[:o.n], want)
+	if _, ok := o.pop(at(49)); ok {
+		t.Error("pop should fail if block not contiguous")
+	}
+	b, ok := o.pop(at(55))
+	if !ok || b != want[0] || o.Len() != 0 {
+		t.Error("pop failed", b, ok)
+	}
+}
+
+func TestOOOStoreBounded(t *testing.T) {
+	var o oooStore
+	for i := uint32(0); i < oooMaxBlocks; i++ {
+		if !o.insert(Seq(20*i+20), Seq(20*i+30)) {
+			t.Fatal("insert failed", i)
+		}
+	}
+	if o.insert(1000, 1010) {
+		t.Error("farthest block should be rejected when full")
+	}
+	if !o.insert(0, 10) {
+		t.Fatal("block closer to RCV.NXT should evict farthest block")
+	}
+	if o.Len() != oooMaxBlocks || o.blocks[o.n-1].Start != 60 {
+		t.Error("expected farthest block [80,90) evicted", o.blocks[:o.n])
+	}
+	// Most recently received block is reported first.
+	o.insert(45, 50)
+	want := []oooBlock{{40, 50}, {0, 10}, {20, 30}, {60, 70}}
+	checkBlocks(t, o.appendBlocks(nil), want)
+}
+
+func checkBlocks(t *testing.T, got, want []oooBlock) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("want blocks %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("want blocks %v, got %v", want, got)
+		}
+	}
+}
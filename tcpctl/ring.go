@@ -0,0 +1,101 @@
+package tcpctl
+
+import "errors"
+
+var errRingFull = errors.New("ring buffer full")
+
+// ring is a fixed capacity circular byte buffer. It does not allocate after
+// being initialized so the backing memory may be provided by the user.
+type ring struct {
+	buf []byte
+	off int // read offset into buf.
+	n   int // number of bytes buffered.
+}
+
+// Size returns the total capacity of the ring buffer.
+func (r *ring) Size() int { return len(r.buf) }
+
+// Buffered returns the number of bytes that can be read from the ring buffer.
+func (r *ring) Buffered() int { return r.n }
+
+// Free returns the number of bytes that can be written to the ring buffer.
+func (r *ring) Free() int { return len(r.buf) - r.n }
+
+// Reset discards all buffered data.
+func (r *ring) Reset() {
+	r.off = 0
+	r.n = 0
+}
+
+// Write appends as much of b as fits in the free space of the ring buffer and
+// returns the number of bytes written. If not all of b fit errRingFull is returned.
+func (r *ring) Write(b []byte) (int, error) {
+	n := r.WriteAt(b, 0)
+	r.n += n
+	if n < len(b) {
+		return n, errRingFull
+	}
+	return n, nil
+}
+
+// WriteAt writes b to the free space of the ring buffer starting off bytes
+// after the end of buffered data, without marking it as buffered. It returns
+// the number of bytes written, which may be less than len(b) if b does not fit.
+func (r *ring) WriteAt(b []byte, off int) int {
+	free := r.Free()
+	if off >= free {
+		return 0
+	}
+	if len(b) > free-off {
+		b = b[:free-off]
+	}
+	start := (r.off + r.n + off) % len(r.buf)
+	n := copy(r.buf[start:], b)
+	n += copy(r.buf, b[n:])
+	return n
+}
+
+// Commit marks n bytes previously written with WriteAt following the buffered
+// data as buffered. It panics if n is larger than the free space.
+func (r *ring) Commit(n int) {
+	if n > r.Free() {
+		panic("ring: commit exceeds free space")
+	}
+	r.n += n
+}
+
+// Read reads buffered data into b and discards it from the ring buffer.
+func (r *ring) Read(b []byte) (int, error) {
+	n := r.ReadAt(b, 0)
+	r.Discard(n)
+	return n, nil
+}
+
+// ReadAt reads buffered data starting off bytes after the read offset into b
+// without discarding it. It returns the number of bytes read.
+func (r *ring) ReadAt(b []byte, off int) int {
+	if off >= r.n {
+		return 0
+	}
+	if len(b) > r.n-off {
+		b = b[:r.n-off]
+	}
+	start := (r.off + off) % len(r.buf)
+	n := copy(b, r.buf[start:])
+	n += copy(b[n:], r.buf)
+	return n
+}
+
+// Discard drops the first n buffered bytes. It panics if n is larger than
+// the number of buffered bytes.
+func (r *ring) Discard(n int) {
+	if n > r.n {
+		panic("ring: discard exceeds buffered data")
+	} else if n == 0 {
+		return
+	}
+	r.n -= n
+	// Offset is not reset when the buffer is emptied since data written
+	// with WriteAt past the buffered data must keep its position.
+	r.off = (r.off + n) % len(r.buf)
+}
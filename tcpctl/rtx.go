@@ -0,0 +1,370 @@
+package tcpctl
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// Retransmission timer parameters as recommended by RFC 6298.
+const (
+	rtoInitial = 1 * time.Second
+	rtoMin     = 1 * time.Second
+	rtoMax     = 60 * time.Second
+	// rtoGranularity is the clock granularity G. Our clock is provided by the
+	// user on each call to Tick, so it is assumed to have millisecond resolution.
+	rtoGranularity = time.Millisecond
+	// defaultMaxRetries is the number of retransmissions of a single segment
+	// after which the connection is aborted. Same as Linux's tcp_retries2.
+	defaultMaxRetries = 15
+	// rtxQueueLen is the maximum number of unacknowledged segments in flight.
+	rtxQueueLen = 32
+	// dupThresh is the number of duplicate ACKs or SACKed segments above
+	// a segment after which it is considered lost, as per RFC 6675.
+	dupThresh = 3
+)
+
+var errRtxTimeout = errors.New("retransmission timeout")
+
+// rtoEstimator calculates the retransmission timeout (RTO) from round trip
+// time measurements as described by RFC 6298.
+type rtoEstimator struct {
+	srtt   time.Duration // smoothed round-trip time
+	rttvar time.Duration // round-trip time variation
+	rto    time.Duration // zero until first measurement is made
+}
+
+// sample updates the estimator with a new round trip time measurement r.
+// Callers must follow Karn's algorithm and never sample retransmitted segments.
+func (e *rtoEstimator) sample(r time.Duration) {
+	if e.rto == 0 {
+		// (2.2) First RTT measurement.
+		e.srtt = r
+		e.rttvar = r / 2
+	} else {
+		// (2.3) Subsequent measurements, with alpha=1/8 and beta=1/4.
+		delta := e.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	k := 4 * e.rttvar
+	if k < rtoGranularity {
+		k = rtoGranularity
+	}
+	e.rto = e.srtt + k
+	// (2.4) and (2.5) bound the RTO.
+	if e.rto < rtoMin {
+		e.rto = rtoMin
+	} else if e.rto > rtoMax {
+		e.rto = rtoMax
+	}
+}
+
+// RTO returns the current retransmission timeout, without backoff.
+func (e *rtoEstimator) RTO() time.Duration {
+	if e.rto == 0 {
+		// (2.1) Until a RTT measurement has been made RTO is set to 1 second.
+		return rtoInitial
+	}
+	return e.rto
+}
+
+// rtxSegment is an unacknowledged segment in the send space. The segment's
+// data is not stored in the queue, only where it lives in sequence space.
+type rtxSegment struct {
+	seq   Seq
+	len   uint32 // length in sequence space, including SYN and FIN.
+	flags dgrams.TCPFlags
+	sent  time.Time // time of the last (re)transmission.
+	nrtx  uint8     // number of times the segment has been retransmitted.
+	// sacked is set when the segment is covered by a SACK block from the receiver.
+	sacked bool
+	// lost is set when the segment should be retransmitted on the next call to send.
+	lost bool
+	// rtxd is set when the segment was retransmitted during the current
+	// loss recovery episode so it is not marked lost again.
+	rtxd bool
+}
+
+// end returns the sequence number following the last one occupied by the segment.
+func (seg *rtxSegment) end() Seq { return seg.seq.Add(seg.len) }
+
+// rtxQueue keeps track of segments sent but not yet acknowledged, ordered by
+// sequence number, and runs the retransmission timer over them. It also
+// serves as the SACK scoreboard described in RFC 6675.
+type rtxQueue struct {
+	segs [rtxQueueLen]rtxSegment
+	off  int // index of first segment in segs.
+	n    int // number of segments in queue.
+	est  rtoEstimator
+	// backoff is the number of times the timer has expired without new data
+	// being acknowledged. The effective timeout is RTO*2**backoff.
+	backoff uint8
+	// deadline is the time at which the retransmission timer expires.
+	// Zero value means the timer is not running.
+	deadline   time.Time
+	maxRetries uint8
+	// force is set when the next retransmission must be sent regardless of the
+	// congestion window, as is the case for fast retransmit and timeouts.
+	force bool
+}
+
+func (q *rtxQueue) reset() {
+	est := q.est
+	maxRetries := q.maxRetries
+	*q = rtxQueue{est: est, maxRetries: maxRetries}
+}
+
+// Len returns the number of unacknowledged segments.
+func (q *rtxQueue) Len() int { return q.n }
+
+// Full returns true if no more segments can be tracked.
+func (q *rtxQueue) Full() bool { return q.n == len(q.segs) }
+
+// Free returns the number of segments which can be tracked before the queue is full.
+func (q *rtxQueue) Free() int { return len(q.segs) - q.n }
+
+// first returns the oldest unacknowledged segment or nil if none.
+func (q *rtxQueue) first() *rtxSegment {
+	if q.n == 0 {
+		return nil
+	}
+	return &q.segs[q.off]
+}
+
+// at returns the i'th unacknowledged segment in sequence order.
+func (q *rtxQueue) at(i int) *rtxSegment { return &q.segs[(q.off+i)%len(q.segs)] }
+
+// firstUnsacked returns the oldest unacknowledged segment not SACKed by the
+// receiver, or the oldest segment if all were SACKed.
+func (q *rtxQueue) firstUnsacked() *rtxSegment {
+	for i := 0; i < q.n; i++ {
+		if seg := q.at(i); !seg.sacked {
+			return seg
+		}
+	}
+	return q.first()
+}
+
+// nextLost returns the oldest segment marked for retransmission or nil if none.
+func (q *rtxQueue) nextLost() *rtxSegment {
+	for i := 0; i < q.n; i++ {
+		if seg := q.at(i); seg.lost && !seg.sacked {
+			return seg
+		}
+	}
+	return nil
+}
+
+// sack marks segments fully covered by any of the SACK blocks as SACKed.
+// Blocks are ignored if they do not fall within the unacknowledged data.
+func (q *rtxQueue) sack(blocks []oooBlock) {
+	for i := 0; i < q.n; i++ {
+		seg := q.at(i)
+		if seg.sacked {
+			continue
+		}
+		for _, b := range blocks {
+			if b.Start.LessThanEq(seg.seq) && seg.end().LessThanEq(b.End) {
+				seg.sacked = true
+				seg.lost = false
+				break
+			}
+		}
+	}
+}
+
+// isLost implements IsLost from RFC 6675 for the i'th segment. The segment is
+// lost if DupThresh segments or more than (DupThresh-1)*mss bytes above it were SACKed.
+func (q *rtxQueue) isLost(i int, mss uint32) bool {
+	var segs int
+	var bytes uint32
+	for j := i + 1; j < q.n; j++ {
+		if seg := q.at(j); seg.sacked {
+			segs++
+			bytes += seg.len
+		}
+	}
+	return segs >= dupThresh || bytes > (dupThresh-1)*mss
+}
+
+// startRecovery begins a loss recovery episode by marking the first
+// unSACKed segment lost, as done on receiving DupThresh duplicate ACKs.
+func (q *rtxQueue) startRecovery() {
+	for i := 0; i < q.n; i++ {
+		q.at(i).rtxd = false
+	}
+	if seg := q.firstUnsacked(); seg != nil {
+		seg.lost = true
+		q.force = true
+	}
+}
+
+// pipe returns the number of bytes estimated to be in the network, which is
+// the data neither SACKed nor marked lost. It is the RFC 6675 pipe, counting
+// retransmitted segments once since only their latest copy is tracked.
+func (q *rtxQueue) pipe() (pipe uint32) {
+	for i := 0; i < q.n; i++ {
+		if seg := q.at(i); !seg.sacked && !seg.lost {
+			pipe += seg.len
+		}
+	}
+	return pipe
+}
+
+// markLost marks all segments deemed lost by isLost for retransmission,
+// excepting those already retransmitted in the current recovery episode.
+func (q *rtxQueue) markLost(mss uint32) {
+	for i := 0; i < q.n; i++ {
+		seg := q.at(i)
+		if !seg.sacked && !seg.rtxd && q.isLost(i, mss) {
+			seg.lost = true
+		}
+	}
+}
+
+// timeout returns the RTO with exponential backoff applied.
+func (q *rtxQueue) timeout() time.Duration {
+	rto := q.est.RTO()
+	for i := uint8(0); i < q.backoff && rto < rtoMax; i++ {
+		rto *= 2
+	}
+	if rto > rtoMax {
+		rto = rtoMax
+	}
+	return rto
+}
+
+// push adds a segment sent at time now to the queue. The segment must follow
+// all segments already in the queue in sequence space.
+func (q *rtxQueue) push(seg rtxSegment, now time.Time) error {
+	if q.Full() {
+		return errors.New("retransmission queue full")
+	}
+	seg.sent = now
+	q.segs[(q.off+q.n)%len(q.segs)] = seg
+	q.n++
+	if q.deadline.IsZero() {
+		// (5.1) Start the timer if it is not running.
+		q.deadline = now.Add(q.timeout())
+	}
+	return nil
+}
+
+// ack processes the acknowledgment of all sequence numbers before ack at time now,
+// removing acknowledged segments from the queue and updating the RTO estimate.
+// If rtt is non-zero it is used as the RTT measurement, as is the case when it is
+// obtained from the Timestamps option, otherwise segment send times are used.
+func (q *rtxQueue) ack(ack Seq, now time.Time, rtt time.Duration) {
+	var newlyAcked bool
+	for q.n > 0 {
+		seg := &q.segs[q.off]
+		if ack.LessThanEq(seg.seq) {
+			break // Nothing more acknowledged.
+		}
+		newlyAcked = true
+		if seg.end().LessThanEq(ack) {
+			// Karn's algorithm: only sample segments that were never retransmitted.
+			if seg.nrtx == 0 && rtt == 0 {
+				q.est.sample(now.Sub(seg.sent))
+			}
+			q.off = (q.off + 1) % len(q.segs)
+			q.n--
+			continue
+		}
+		// Segment partially acknowledged, trim acknowledged part.
+		seg.len -= seg.seq.Sizeof(ack)
+		seg.seq = ack
+		break
+	}
+	if !newlyAcked {
+		return
+	}
+	if rtt != 0 {
+		q.est.sample(rtt)
+	}
+	q.backoff = 0
+	if q.n == 0 {
+		// (5.2) All outstanding data acknowledged, turn off the timer.
+		q.deadline = time.Time{}
+	} else {
+		// (5.3) New data acknowledged, restart the timer.
+		q.deadline = now.Add(q.timeout())
+	}
+}
+
+// tick checks the retransmission timer against now. If the timer expired the
+// timeout is backed off and all segments not SACKed are marked for retransmission,
+// starting with the earliest. expired is set if the timer expired.
+// An error is returned if the maximum number of retries was exceeded.
+func (q *rtxQueue) tick(now time.Time) (expired bool, err error) {
+	if q.deadline.IsZero() || now.Before(q.deadline) {
+		return false, nil
+	}
+	first := q.firstUnsacked()
+	if first == nil {
+		q.deadline = time.Time{}
+		return false, nil
+	}
+	maxRetries := q.maxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	if first.nrtx >= maxRetries {
+		return true, errRtxTimeout
+	}
+	// (5.4) Retransmit the earliest segment, (5.5) back off the timer
+	// and (5.6) restart it. Timer is restarted when segment is sent.
+	// The rest of the segments are sent as the congestion window allows.
+	for i := 0; i < q.n; i++ {
+		if seg := q.at(i); !seg.sacked {
+			seg.lost = true
+			seg.rtxd = false
+		}
+	}
+	q.force = true
+	if q.backoff < 32 {
+		q.backoff++
+	}
+	q.deadline = now.Add(q.timeout())
+	return true, nil
+}
+
+// split divides seg in two so that it carries n octets, the remainder making
+// up a new segment which inherits its state. Used to retransmit segments which
+// no longer fit the path MTU. Returns false if the queue is full.
+func (q *rtxQueue) split(seg *rtxSegment, n uint32) bool {
+	if q.Full() {
+		return false
+	}
+	i := 0
+	for q.at(i) != seg {
+		i++
+	}
+	for j := q.n; j > i+1; j-- {
+		*q.at(j) = *q.at(j - 1)
+	}
+	q.n++
+	rest := q.at(i + 1)
+	*rest = *seg
+	rest.seq = seg.seq.Add(n)
+	rest.len = seg.len - n
+	rest.flags = seg.flags &^ dgrams.FlagTCP_SYN
+	seg.len = n
+	seg.flags &^= dgrams.FlagTCP_FIN | dgrams.FlagTCP_PSH
+	return true
+}
+
+// retransmitted records that seg was retransmitted at time now.
+func (q *rtxQueue) retransmitted(seg *rtxSegment, now time.Time) {
+	seg.nrtx++
+	seg.sent = now
+	seg.lost = false
+	seg.rtxd = true
+	q.force = false
+	q.deadline = now.Add(q.timeout())
+}
@@ -0,0 +1,88 @@
+package tcpctl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	var e rtoEstimator
+	if e.RTO() != rtoInitial {
+		t.Fatalf("initial RTO want %s, got %s", rtoInitial, e.RTO())
+	}
+	e.sample(2 * time.Second)
+	// SRTT=2s, RTTVAR=1s, RTO=SRTT+4*RTTVAR.
+	if e.srtt != 2*time.Second || e.rttvar != time.Second || e.RTO() != 6*time.Second {
+		t.Fatalf("first sample: got srtt=%s rttvar=%s rto=%s", e.srtt, e.rttvar, e.RTO())
+	}
+	e.sample(time.Second)
+	// RTTVAR=3/4*1s+1/4*|2s-1s|=1s, SRTT=7/8*2s+1/8*1s=1.875s.
+	if e.srtt != 1875*time.Millisecond || e.rttvar != time.Second || e.RTO() != 5875*time.Millisecond {
+		t.Fatalf("second sample: got srtt=%s rttvar=%s rto=%s", e.srtt, e.rttvar, e.RTO())
+	}
+	for i := 0; i < 100; i++ {
+		e.sample(time.Millisecond)
+	}
+	if e.RTO() != rtoMin {
+		t.Errorf("RTO should be clamped to %s, got %s", rtoMin, e.RTO())
+	}
+}
+
+func TestRtxQueueKarn(t *testing.T) {
+	var q rtxQueue
+	start := time.Unix(0, 0)
+	q.push(rtxSegment{seq: 100, len: 10}, start)
+	q.push(rtxSegment{seq: 110, len: 10}, start)
+	if q.deadline != start.Add(rtoInitial) {
+		t.Fatal("timer not started on first push")
+	}
+	// Timer expires, first segment is retransmitted with doubled timeout.
+	now := start.Add(rtoInitial)
+	if expired, err := q.tick(now); err != nil || !expired {
+		t.Fatal("timer should expire", err)
+	}
+	if q.nextLost() != q.first() || q.timeout() != 2*rtoInitial {
+		t.Fatalf("expected first segment retransmit with backed off timeout, got timeout=%s", q.timeout())
+	}
+	q.retransmitted(q.first(), now)
+	// Acknowledging retransmitted segment must not produce an RTT sample.
+	now = now.Add(100 * time.Millisecond)
+	q.ack(110, now, 0)
+	if q.est.rto != 0 {
+		t.Errorf("RTT sampled from retransmitted segment, rto=%s", q.est.rto)
+	}
+	if q.backoff != 0 || q.Len() != 1 || q.deadline != now.Add(rtoInitial) {
+		t.Errorf("ack should reset backoff and restart timer: backoff=%d len=%d", q.backoff, q.Len())
+	}
+	// Second segment was never retransmitted and is sampled.
+	q.ack(115, now, 0)
+	if q.first().seq != 115 || q.first().len != 5 {
+		t.Errorf("partial ack should trim segment, got seq=%d len=%d", q.first().seq, q.first().len)
+	}
+	q.ack(120, now, 0)
+	if q.est.rto == 0 {
+		t.Error("expected RTT sample from segment never retransmitted")
+	}
+	if q.Len() != 0 || !q.deadline.IsZero() {
+		t.Error("timer should stop once all data acknowledged")
+	}
+}
+
+func TestRtxQueueMaxRetries(t *testing.T) {
+	q := rtxQueue{maxRetries: 3}
+	now := time.Unix(0, 0)
+	q.push(rtxSegment{seq: 0, len: 1}, now)
+	for i := 0; i < 3; i++ {
+		now = q.deadline
+		if _, err := q.tick(now); err != nil {
+			t.Fatalf("retry %d: %s", i, err)
+		}
+		q.retransmitted(q.first(), now)
+	}
+	if q.timeout() != 8*rtoInitial {
+		t.Errorf("expected exponential backoff to 8s, got %s", q.timeout())
+	}
+	if _, err := q.tick(q.deadline); err != errRtxTimeout {
+		t.Errorf("expected %v, got %v", errRtxTimeout, err)
+	}
+}
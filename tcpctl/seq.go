@@ -0,0 +1,78 @@
+package tcpctl
+
+import "github.com/soypat/dgrams"
+
+// Seq is a TCP sequence number. Sequence numbers live in a finite space of
+// 2**32 values so all comparisons must be done modulo 2**32, as described
+// in RFC 793 section 3.3. Plain integer comparison breaks down as soon as
+// the numbers wrap around past 2**32-1.
+//
+// Comparisons are only meaningful between sequence numbers which are less
+// than 2**31 apart, which is always the case for numbers within a valid window.
+type Seq uint32
+
+// LessThan returns true if s precedes v in sequence space, which is
+// to say s < v modulo 2**32.
+func (s Seq) LessThan(v Seq) bool { return int32(s-v) < 0 }
+
+// LessThanEq returns true if s precedes or is equal to v in sequence space,
+// which is to say s <= v modulo 2**32.
+func (s Seq) LessThanEq(v Seq) bool { return s == v || s.LessThan(v) }
+
+// InRange returns true if s is in the half-open range [first, last) modulo 2**32.
+func (s Seq) InRange(first, last Seq) bool {
+	return first.LessThanEq(s) && s.LessThan(last)
+}
+
+// InWindow returns true if s is contained in the window starting at first
+// and of size bytes in length, which is to say first <= s < first+size
+// modulo 2**32. A window of size zero contains no sequence numbers.
+func (s Seq) InWindow(first Seq, size uint32) bool {
+	return first.Sizeof(s) < size
+}
+
+// Add returns the sequence number n bytes ahead of s, wrapping around modulo 2**32.
+func (s Seq) Add(n uint32) Seq { return s + Seq(n) }
+
+// Sizeof returns the number of bytes from s up to v, which is to say v-s
+// modulo 2**32. If v precedes s the result is not meaningful.
+func (s Seq) Sizeof(v Seq) uint32 { return uint32(v - s) }
+
+// segLen returns the length of the segment in sequence space. SYN and FIN
+// flags each occupy one sequence number in addition to the data.
+func segLen(flags dgrams.TCPFlags, payload []byte) uint32 {
+	n := uint32(len(payload))
+	if flags.HasFlags(dgrams.FlagTCP_SYN) {
+		n++
+	}
+	if flags.HasFlags(dgrams.FlagTCP_FIN) {
+		n++
+	}
+	return n
+}
+
+// acceptable implements the segment acceptability test of RFC 793 page 69 for
+// a segment starting at seq and occupying seglen sequence numbers. There are
+// four cases:
+//
+//	Segment Receive  Test
+//	Length  Window
+//	------- -------  -------------------------------------------
+//	   0       0     SEG.SEQ = RCV.NXT
+//	   0      >0     RCV.NXT =< SEG.SEQ < RCV.NXT+RCV.WND
+//	  >0       0     not acceptable
+//	  >0      >0     RCV.NXT =< SEG.SEQ < RCV.NXT+RCV.WND
+//	              or RCV.NXT =< SEG.SEQ+SEG.LEN-1 < RCV.NXT+RCV.WND
+func (rcv *rcvSpace) acceptable(seq Seq, seglen uint32) bool {
+	wnd := rcv.WND
+	switch {
+	case seglen == 0 && wnd == 0:
+		return seq == rcv.NXT
+	case seglen == 0:
+		return seq.InWindow(rcv.NXT, wnd)
+	case wnd == 0:
+		return false
+	}
+	last := seq.Add(seglen - 1)
+	return seq.InWindow(rcv.NXT, wnd) || last.InWindow(rcv.NXT, wnd)
+}
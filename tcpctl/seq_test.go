@@ -0,0 +1,116 @@
+package tcpctl
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/dgrams"
+)
+
+func TestSeqWraparound(t *testing.T) {
+	const max = math.MaxUint32
+	for _, test := range []struct {
+		a, b     Seq
+		lessThan bool
+	}{
+		{a: 0, b: 1, lessThan: true},
+		{a: 1, b: 0, lessThan: false},
+		{a: max, b: 0, lessThan: true},
+		{a: 0, b: max, lessThan: false},
+		{a: max - 10, b: 10, lessThan: true},
+		{a: 10, b: max - 10, lessThan: false},
+		{a: max, b: max, lessThan: false},
+		{a: 1 << 31, b: 1<<31 + 1, lessThan: true},
+	} {
+		if got := test.a.LessThan(test.b); got != test.lessThan {
+			t.Errorf("%d<%d: want %v, got %v", test.a, test.b, test.lessThan, got)
+		}
+		if got := test.a.LessThanEq(test.b); got != (test.lessThan || test.a == test.b) {
+			t.Errorf("%d<=%d: want %v, got %v", test.a, test.b, !got, got)
+		}
+	}
+	if got := Seq(max).Add(2); got != 1 {
+		t.Errorf("max+2 want 1, got %d", got)
+	}
+	if got := Seq(max - 1).Sizeof(3); got != 5 {
+		t.Errorf("Sizeof across wrap want 5, got %d", got)
+	}
+}
+
+func TestSeqInWindow(t *testing.T) {
+	const max = math.MaxUint32
+	for _, test := range []struct {
+		v, first Seq
+		size     uint32
+		want     bool
+	}{
+		{v: 0, first: 0, size: 0, want: false},
+		{v: 0, first: 0, size: 1, want: true},
+		{v: 1, first: 0, size: 1, want: false},
+		{v: max, first: max - 1, size: 2, want: true},
+		{v: 0, first: max - 1, size: 2, want: false},
+		{v: 0, first: max - 1, size: 3, want: true},
+		{v: 100, first: max - 100, size: 300, want: true},
+		{v: max - 101, first: max - 100, size: 300, want: false},
+		{v: 200, first: max - 100, size: 300, want: false},
+	} {
+		if got := test.v.InWindow(test.first, test.size); got != test.want {
+			t.Errorf("%d in [%d, %d+%d): want %v, got %v", test.v, test.first, test.first, test.size, test.want, got)
+		}
+	}
+}
+
+func TestRcvSpaceAcceptable(t *testing.T) {
+	const max = math.MaxUint32
+	for _, test := range []struct {
+		nxt    Seq
+		wnd    uint32
+		seq    Seq
+		seglen uint32
+		want   bool
+	}{
+		// Zero length segment, zero window.
+		{nxt: max, wnd: 0, seq: max, seglen: 0, want: true},
+		{nxt: max, wnd: 0, seq: 0, seglen: 0, want: false},
+		// Zero length segment, open window.
+		{nxt: max, wnd: 10, seq: max, seglen: 0, want: true},
+		{nxt: max, wnd: 10, seq: 8, seglen: 0, want: true},
+		{nxt: max, wnd: 10, seq: 9, seglen: 0, want: false},
+		{nxt: max, wnd: 10, seq: max - 1, seglen: 0, want: false},
+		// Data segment, zero window.
+		{nxt: max, wnd: 0, seq: max, seglen: 1, want: false},
+		// Data segment, open window.
+		{nxt: max - 4, wnd: 10, seq: max - 4, seglen: 20, want: true},
+		{nxt: max - 4, wnd: 10, seq: max - 10, seglen: 7, want: true}, // Tail overlaps window start.
+		{nxt: max - 4, wnd: 10, seq: max - 10, seglen: 6, want: false},
+		{nxt: max - 4, wnd: 10, seq: 4, seglen: 6, want: true}, // Head in window end.
+		{nxt: max - 4, wnd: 10, seq: 5, seglen: 6, want: false},
+	} {
+		rcv := rcvSpace{NXT: test.nxt, WND: test.wnd}
+		if got := rcv.acceptable(test.seq, test.seglen); got != test.want {
+			t.Errorf("RCV.NXT=%d RCV.WND=%d SEG.SEQ=%d SEG.LEN=%d: want %v, got %v",
+				test.nxt, test.wnd, test.seq, test.seglen, test.want, got)
+		}
+	}
+}
+
+func TestFrameRcvAckWraparound(t *testing.T) {
+	const max = math.MaxUint32
+	cs := connState{snd: sendSpace{UNA: max - 1, NXT: 3}}
+	for _, test := range []struct {
+		ack  uint32
+		want error
+	}{
+		{ack: max - 2, want: errAckOld},
+		{ack: max - 1, want: errAckOld},
+		{ack: max, want: nil},
+		{ack: 0, want: nil},
+		{ack: 3, want: nil},
+		{ack: 4, want: errAckUnsent},
+	} {
+		hdr := dgrams.TCPHeader{Ack: test.ack}
+		if got := cs.frameRcv(&hdr); got != test.want {
+			t.Errorf("SEG.ACK=%d: want %v, got %v", test.ack, test.want, got)
+		}
+	}
+}
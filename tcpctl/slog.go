@@ -0,0 +1,51 @@
+//go:build go1.21
+
+package tcpctl
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+)
+
+// NewSlogLogger returns a Logger passing events to h as records whose message
+// is the kind of the event and whose attributes are the fields of the event
+// which apply to its kind.
+func NewSlogLogger(h slog.Handler) Logger {
+	return slogLogger{h: h}
+}
+
+type slogLogger struct {
+	h slog.Handler
+}
+
+func (l slogLogger) Enabled(level LogLevel) bool {
+	return l.h.Enabled(context.Background(), slog.Level(level))
+}
+
+func (l slogLogger) Log(e Event) {
+	r := slog.NewRecord(e.Time, slog.Level(e.Level), e.Kind.String(), 0)
+	r.AddAttrs(
+		slog.String("local", netip.AddrPortFrom(netip.AddrFrom4(e.LocalAddr), e.LocalPort).String()),
+		slog.String("remote", netip.AddrPortFrom(netip.AddrFrom4(e.RemoteAddr), e.RemotePort).String()),
+	)
+	switch e.Kind {
+	case EventState:
+		r.AddAttrs(slog.String("from", e.From.String()), slog.String("state", e.State.String()))
+	case EventError:
+		r.AddAttrs(slog.String("state", e.State.String()), slog.String("err", e.Err.Error()))
+	default:
+		r.AddAttrs(
+			slog.String("state", e.State.String()),
+			slog.Uint64("seq", uint64(e.Seq)),
+			slog.Uint64("ack", uint64(e.Ack)),
+			slog.String("flags", e.Flags.String()),
+			slog.Uint64("wnd", uint64(e.Window)),
+			slog.Int("len", e.Len),
+		)
+		if e.Err != nil {
+			r.AddAttrs(slog.String("err", e.Err.Error()))
+		}
+	}
+	l.h.Handle(context.Background(), r)
+}
@@ -0,0 +1,38 @@
+//go:build go1.21
+
+package tcpctl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var out bytes.Buffer
+	var s tcpctl.Socket
+	s.SetLogger(tcpctl.NewSlogLogger(slog.NewJSONHandler(&out, nil)))
+	s.Tick(time.Unix(100, 0))
+	s.Listen()
+	s.RecvEthernet(packetSyn) // Segments are logged at debug level, not enabled.
+	var records []map[string]interface{}
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 state changes, got %v", records)
+	}
+	r := records[1]
+	if r["msg"] != "state change" || r["from"] != "StateListen" || r["state"] != "StateSynRcvd" ||
+		r["remote"] != "192.168.1.112:58920" || r["local"] != "192.168.1.5:80" {
+		t.Fatalf("unexpected record %v", r)
+	}
+}
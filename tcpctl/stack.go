@@ -0,0 +1,1208 @@
+package tcpctl
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soypat/dgrams"
+)
+
+// Constants of the Berkeley sockets-like interface implemented by Stack.
+// They have the same values as their Linux counterparts.
+const (
+	AF_INET     = 0x2
+	SOCK_STREAM = 0x1
+	IPPROTO_TCP = 0x6
+
+	SOL_IP = 0x0
+	IP_TOS = 0x1
+	IP_TTL = 0x2
+
+	SOL_SOCKET   = 0x1
+	SO_SNDBUF    = 0x7
+	SO_RCVBUF    = 0x8
+	SO_KEEPALIVE = 0x9
+
+	SOL_TCP       = IPPROTO_TCP
+	TCP_NODELAY   = 0x1
+	TCP_KEEPIDLE  = 0x4
+	TCP_KEEPINTVL = 0x5
+	TCP_KEEPCNT   = 0x6
+	TCP_QUICKACK  = 0xc
+)
+
+const (
+	// Ephemeral ports are chosen from the dynamic port range of RFC 6335.
+	ephemeralPortMin = 49152
+	ephemeralPortMax = math.MaxUint16
+	// defaultMaxSockets is the number of sockets a Stack supports when not set by the user.
+	defaultMaxSockets = 8
+	// ctlQueueLen is the number of RST and SYN cookie segments a Stack holds
+	// until they are sent. No segment is sent in response to segments received
+	// while the queue is full, limiting the traffic generated in response to
+	// stray segments and SYN floods.
+	ctlQueueLen = 4
+)
+
+var (
+	errBadDescriptor  = errors.New("bad socket descriptor")
+	errAddrInUse      = errors.New("address already in use")
+	errTooManySockets = errors.New("too many open sockets")
+	errShortTCP       = errors.New("buffer too short to contain TCP")
+	errBadLength      = errors.New("bad IP total length")
+	errBadIHL         = errors.New("bad IP header length")
+	errNotForStack    = errors.New("packet not destined to stack")
+	errNotTCPIPv4     = errors.New("packet is not TCP over IPv4")
+	errNoSocket       = errors.New("no socket for packet")
+	errBacklogFull    = errors.New("listen backlog full")
+	errFragment       = errors.New("IP fragment reassembly not supported")
+)
+
+var _ netdever = (*Stack)(nil)
+
+// StackConfig contains the parameters of a Stack.
+type StackConfig struct {
+	// Addr is the IPv4 address of the stack.
+	Addr net.IP
+	// HardwareAddr is the MAC address of the stack, the source of Ethernet frames sent.
+	HardwareAddr [6]byte
+	// GatewayHardwareAddr is the MAC address Ethernet frames of connections
+	// opened with Connect are sent to until a frame from the remote peer is
+	// received, since the stack does not resolve hardware addresses with ARP.
+	GatewayHardwareAddr [6]byte
+	// MaxSockets is the maximum number of sockets, including those not yet
+	// accepted and those closed by the user but still closing. Default is 8.
+	MaxSockets int
+	// MTU is the MTU of the link, see Socket.SetMTU. Default is 1500.
+	MTU uint16
+	// ISNGenerator is the initial sequence number generator of the sockets,
+	// see Socket.SetISNGenerator.
+	ISNGenerator *ISNGenerator
+	// SYNBacklog is the maximum number of half-open connections of a listening
+	// socket, those in SYN-RECEIVED waiting for the final ACK of the handshake.
+	// Connection requests received with the SYN backlog full are answered with a
+	// SYN cookie if SYNCookies is set, else the oldest half-open connection is
+	// dropped to make room. The oldest half-open connection is also dropped when
+	// no socket is free. Default is the backlog of the listening socket.
+	SYNBacklog int
+	// SYNCookies enables answering connection requests with SYN cookies when the
+	// SYN backlog is full, which protects against SYN floods without keeping
+	// state (RFC 4987). Connections established from a SYN cookie do not use TCP
+	// options other than MSS.
+	SYNCookies bool
+	// Clock is the source of time used by Run and for the deadlines of Send and
+	// Recv. Default is the system clock.
+	Clock Clock
+	// Logger receives the events of the sockets and those of the stack itself,
+	// i.e. packets dropped matching no socket. Nil disables logging.
+	Logger Logger
+	// Tracer receives probes of the connections of all sockets, see Socket.SetTracer.
+	Tracer Tracer
+	// ChecksumPolicy is how packets received with a bad checksum are handled.
+	// Default is ChecksumDrop.
+	ChecksumPolicy ChecksumPolicy
+	// IPv4 writes the IPv4 header of packets sent by the stack and its sockets,
+	// see Socket.SetIPv4Sender. The TTL and DSCP of a socket may be changed
+	// with the IP_TTL and IP_TOS socket options.
+	IPv4 dgrams.IPv4Sender
+}
+
+// Stack manages a fixed number of TCP sockets referred to by integer descriptors,
+// implementing a Berkeley sockets-like interface modelled after that of TinyGo's
+// network devices. Listening sockets spawn a socket for every connection request
+// received, up to their backlog. Segments are demultiplexed to sockets by
+// their address and port pairs, segments matching no socket are answered with
+// a RST. Sockets, their default buffers and the demultiplexing table are
+// allocated when the Stack is created so that it can run on memory constrained
+// devices without allocating while running.
+//
+// Like Socket, a Stack is driven by the user calling Tick, its Recv methods
+// with packets received and its Send methods to flush packets. The socket
+// interface methods block and must be called concurrently with the driving loop.
+// The timers of all sockets run on a timer wheel advanced by Tick, so that Tick
+// only processes the sockets whose timers expired. A loop driving the stack
+// without goroutines or runtime timers, i.e. on a microcontroller, may sleep
+// until NextTimeout when there are no packets to exchange.
+type Stack struct {
+	mu      sync.Mutex
+	addr    net.IP
+	hw, gw  [6]byte
+	mtu     uint16
+	isn     *ISNGenerator
+	sockets []Socket
+	slots   []stackSlot
+	demux   demuxTable
+	// ctl holds the segments sent by the stack itself pending to be sent, oldest first.
+	ctl  [ctlQueueLen]ctlSegment
+	nctl int
+	// synBacklog is the SYN backlog of listening sockets, zero if that of their backlog.
+	synBacklog int
+	cookies    bool
+	cookieKey  [16]byte
+	// csum is how packets received with a bad checksum are handled.
+	csum ChecksumPolicy
+	ipv4 dgrams.IPv4Sender
+	// kickc wakes up Run when there are packets to send, see kick.
+	kickc chan struct{}
+	// stats counts the segments of the stack itself and those of connections
+	// of sockets since reused.
+	stats Stats
+	// port is the next ephemeral port to try.
+	port uint16
+	// next is the index of the socket SendTCP starts looking at so that connections get a fair share.
+	next int
+	// spawned counts the connections spawned by listening sockets.
+	spawned uint32
+	now     time.Time
+	clock   Clock
+	log     Logger
+	// wheel runs the timers of the sockets, timers[i] being that of socket i.
+	wheel  timerWheel
+	timers []timer
+}
+
+// stackSlot holds the state of a socket descriptor. The socket it refers to may
+// be in use while the descriptor is not, i.e. connections waiting to be accepted
+// or connections closed by the user still exchanging FINs with the remote peer.
+type stackSlot struct {
+	// open is set while the descriptor is in use by the user.
+	open      bool
+	listening bool
+	backlog   int
+	// parent is the descriptor of the listening socket which spawned the
+	// connection until it is accepted, -1 otherwise.
+	parent int
+	// born orders connections waiting to be accepted.
+	born uint32
+	// port is the local port the socket is bound to, zero if not bound.
+	port uint16
+	opts sockOpts
+	// key is the key of the socket in the demultiplexing table while hashed is set.
+	key    demuxKey
+	hashed bool
+}
+
+// ctlSegment is a segment sent by the stack without a socket: a RST in response
+// to a segment matching no socket or a SYN-ACK carrying a SYN cookie.
+type ctlSegment struct {
+	key      demuxKey
+	seq, ack Seq
+	flags    dgrams.TCPFlags
+	wnd      uint16
+	// mss is the value of the MSS option, not sent if zero.
+	mss uint16
+	// Hardware addresses of the frame sent, those of the frame received swapped
+	// if ethLearned is set.
+	ethDst, ethSrc [6]byte
+	ethLearned     bool
+}
+
+// sockOpts are the socket options set with SetSockOpt. Connections
+// spawned by a listening socket inherit its options.
+type sockOpts struct {
+	keepalive KeepAliveConfig
+	nodelay   bool
+	quickack  bool
+	sndbuf    int
+	rcvbuf    int
+	ipv4      dgrams.IPv4Sender
+}
+
+// NewStack returns a Stack with the given configuration.
+func NewStack(cfg StackConfig) (*Stack, error) {
+	addr := cfg.Addr.To4()
+	if addr == nil {
+		return nil, errors.New("stack requires an IPv4 address")
+	}
+	if cfg.MaxSockets <= 0 {
+		cfg.MaxSockets = defaultMaxSockets
+	}
+	if cfg.MTU != 0 && cfg.MTU < pmtuMin {
+		return nil, errors.New("MTU too small")
+	}
+	st := &Stack{
+		addr:    append(net.IP{}, addr...),
+		hw:      cfg.HardwareAddr,
+		gw:      cfg.GatewayHardwareAddr,
+		mtu:     cfg.MTU,
+		isn:     cfg.ISNGenerator,
+		sockets: make([]Socket, cfg.MaxSockets),
+		slots:   make([]stackSlot, cfg.MaxSockets),
+		demux:   makeDemuxTable(cfg.MaxSockets),
+		port:    ephemeralPortMin,
+		clock:   cfg.Clock,
+		log:     cfg.Logger,
+		timers:  make([]timer, cfg.MaxSockets),
+
+		synBacklog: cfg.SYNBacklog,
+		csum:       cfg.ChecksumPolicy,
+		ipv4:       cfg.IPv4,
+		cookies:    cfg.SYNCookies,
+		kickc:      make(chan struct{}, 1),
+	}
+	if st.clock == nil {
+		st.clock = systemClock{}
+	}
+	if st.cookies {
+		if _, err := rand.Read(st.cookieKey[:]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range st.sockets {
+		st.sockets[i].initWake()
+		st.sockets[i].cs.initBuffers()
+		st.sockets[i].cs.log = cfg.Logger
+		st.sockets[i].cs.tracer = cfg.Tracer
+		st.slots[i].parent = -1
+		st.timers[i].id = i
+	}
+	return st, nil
+}
+
+// GetHostByName returns the IP address of name, which must be an IPv4 address
+// in dotted decimal notation since the stack does not implement DNS.
+func (st *Stack) GetHostByName(name string) (net.IP, error) {
+	ip := net.ParseIP(name).To4()
+	if ip == nil {
+		return nil, errors.New("name resolution not supported: " + name)
+	}
+	return ip, nil
+}
+
+// Socket creates a socket and returns its descriptor. Only TCP over IPv4
+// is supported: domain must be AF_INET, stype SOCK_STREAM and protocol
+// IPPROTO_TCP or zero.
+func (st *Stack) Socket(domain int, stype int, protocol int) (int, error) {
+	if domain != AF_INET || stype != SOCK_STREAM || (protocol != IPPROTO_TCP && protocol != 0) {
+		return -1, errors.New("only TCP over IPv4 sockets supported")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fd, err := st.alloc()
+	if err != nil {
+		return -1, err
+	}
+	st.slots[fd] = stackSlot{open: true, parent: -1, opts: sockOpts{ipv4: st.ipv4}}
+	return fd, nil
+}
+
+// Bind binds the socket to a local port. ip must be nil, the unspecified
+// address or the address of the stack. If port is zero an ephemeral port is chosen.
+func (st *Stack) Bind(sockfd int, ip net.IP, port int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	slot, err := st.slot(sockfd)
+	if err != nil {
+		return err
+	}
+	switch {
+	case slot.port != 0:
+		return errors.New("socket already bound")
+	case ip != nil && !ip.IsUnspecified() && !ip.Equal(st.addr):
+		return errors.New("cannot assign requested address")
+	case port < 0 || port > math.MaxUint16:
+		return errors.New("invalid port")
+	case port == 0:
+		return st.bindEphemeral(slot)
+	case st.portInUse(uint16(port)):
+		return errAddrInUse
+	}
+	slot.port = uint16(port)
+	return nil
+}
+
+// Connect opens a connection to the remote peer at ip and port, blocking until
+// it is established or fails. If ip is nil host is resolved with GetHostByName.
+// Unbound sockets are bound to an ephemeral port.
+func (st *Stack) Connect(sockfd int, host string, ip net.IP, port int) (err error) {
+	if ip == nil {
+		ip, err = st.GetHostByName(host)
+		if err != nil {
+			return err
+		}
+	}
+	if port <= 0 || port > math.MaxUint16 {
+		return errors.New("invalid port")
+	}
+	st.mu.Lock()
+	slot, err := st.slot(sockfd)
+	switch {
+	case err != nil:
+	case slot.listening:
+		err = errors.New("connect on listening socket")
+	case slot.port == 0:
+		err = st.bindEphemeral(slot)
+	}
+	if err != nil {
+		st.mu.Unlock()
+		return err
+	}
+	s := &st.sockets[sockfd]
+	s.Tick(st.now)
+	err = s.Connect(&net.TCPAddr{IP: st.addr, Port: int(slot.port)}, &net.TCPAddr{IP: ip, Port: port})
+	if err == nil {
+		key := demuxKey{port: slot.port, rport: uint16(port)}
+		copy(key.rip[:], ip.To4())
+		st.hash(sockfd, key)
+		st.update(sockfd)
+		st.kick()
+	}
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := st.check(sockfd, time.Time{})(); err != nil {
+			return err
+		}
+		switch s.State() {
+		case StateSynSent:
+		case StateClosed:
+			if err = s.error(); err == nil {
+				err = errConnRefused
+			}
+			return err
+		default:
+			return nil
+		}
+		wait(s.cs.wrWake, time.Time{})
+	}
+}
+
+// Listen marks a bound socket as accepting connections. backlog is the maximum
+// number of established connections waiting to be accepted, further connection
+// requests are dropped. See StackConfig.SYNBacklog for the limit of connections
+// being established.
+func (st *Stack) Listen(sockfd int, backlog int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	slot, err := st.slot(sockfd)
+	switch {
+	case err != nil:
+		return err
+	case slot.port == 0:
+		return errors.New("listen on unbound socket")
+	case st.sockets[sockfd].State() != StateClosed:
+		return errors.New("listen on connected socket")
+	}
+	if backlog < 1 {
+		backlog = 1
+	}
+	slot.listening = true
+	slot.backlog = backlog
+	st.sockets[sockfd].Listen()
+	st.hash(sockfd, demuxKey{port: slot.port})
+	return nil
+}
+
+// Accept blocks until a connection to the listening socket is established and
+// returns its descriptor. The IP address of the remote peer is copied to ip
+// if it is large enough; port is ignored since it cannot be returned.
+func (st *Stack) Accept(sockfd int, ip net.IP, port int) (int, error) {
+	for {
+		st.mu.Lock()
+		slot, err := st.slot(sockfd)
+		if err == nil && !slot.listening {
+			err = errors.New("accept on socket not listening")
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return -1, err
+		}
+		child := -1
+		for i := range st.slots {
+			c := &st.slots[i]
+			if c.parent == sockfd && !c.open && isEstablished(st.sockets[i].State()) &&
+				(child < 0 || int32(c.born-st.slots[child].born) < 0) {
+				child = i
+			}
+		}
+		if child >= 0 {
+			st.slots[child].open = true
+			st.slots[child].parent = -1
+			copy(ip, st.sockets[child].RemoteAddr().IP)
+			st.mu.Unlock()
+			return child, nil
+		}
+		st.mu.Unlock()
+		wait(st.sockets[sockfd].cs.rdWake, time.Time{})
+	}
+}
+
+// Send writes buf to the connection, blocking until all of it is buffered
+// for sending or the deadline expires. A zero deadline never expires.
+// No flags are supported.
+func (st *Stack) Send(sockfd int, buf []byte, flags int, deadline time.Time) (int, error) {
+	s, err := st.conn(sockfd, flags)
+	if err != nil {
+		return 0, err
+	}
+	defer st.kick()
+	return s.writeBlocking(buf, st.check(sockfd, deadline))
+}
+
+// Recv reads data received on the connection into buf, blocking until data is
+// available or the deadline expires. A zero deadline never expires. io.EOF is
+// returned once the remote peer closed the connection. No flags are supported.
+func (st *Stack) Recv(sockfd int, buf []byte, flags int, deadline time.Time) (int, error) {
+	s, err := st.conn(sockfd, flags)
+	if err != nil {
+		return 0, err
+	}
+	defer st.kick() // Reading may open the receive window.
+	return s.readBlocking(buf, st.check(sockfd, deadline))
+}
+
+// Close releases the socket descriptor. Connections are closed gracefully,
+// see Socket.Close, and the socket is reused once the connection is closed.
+// Connections of a listening socket not yet accepted are aborted.
+func (st *Stack) Close(sockfd int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	slot, err := st.slot(sockfd)
+	if err != nil {
+		return err
+	}
+	s := &st.sockets[sockfd]
+	slot.open = false
+	if slot.listening {
+		slot.listening = false
+		for i := range st.slots {
+			if c := &st.slots[i]; c.parent == sockfd && !c.open {
+				st.sockets[i].abortWith(net.ErrClosed)
+				c.parent = -1
+			}
+		}
+		s.abortWith(nil)
+		st.unhash(sockfd)
+		return nil
+	}
+	err = s.Close()
+	s.wake()
+	st.update(sockfd)
+	st.kick()
+	return err
+}
+
+// SetSockOpt sets a socket option. The supported options are IP_TOS and IP_TTL
+// at level SOL_IP, SO_KEEPALIVE, SO_SNDBUF and SO_RCVBUF at level SOL_SOCKET and
+// TCP_NODELAY, TCP_QUICKACK, TCP_KEEPIDLE, TCP_KEEPINTVL and TCP_KEEPCNT at
+// level SOL_TCP. value is a bool or an int. Keepalive times are in seconds if
+// an int or a time.Duration. Buffer sizes only take effect on connections not
+// yet established. The ECN bits of IP_TOS are ignored, setting IP_TTL to -1
+// restores the TTL of the stack.
+func (st *Stack) SetSockOpt(sockfd int, level int, opt int, value interface{}) error {
+	var v int
+	var d time.Duration
+	switch value := value.(type) {
+	case bool:
+		if value {
+			v = 1
+		}
+	case int:
+		v = value
+		d = time.Duration(value) * time.Second
+	case time.Duration:
+		v = int(value / time.Second)
+		d = value
+	default:
+		return errors.New("unsupported socket option value type")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	slot, err := st.slot(sockfd)
+	if err != nil {
+		return err
+	}
+	o := &slot.opts
+	switch {
+	case level == SOL_IP && opt == IP_TOS:
+		if v < 0 || v > math.MaxUint8 {
+			return errors.New("invalid type of service")
+		}
+		o.ipv4.DSCP = uint8(v) >> 2
+	case level == SOL_IP && opt == IP_TTL:
+		if v == -1 {
+			v = int(st.ipv4.TTL)
+		} else if v < 1 || v > math.MaxUint8 {
+			return errors.New("invalid TTL")
+		}
+		o.ipv4.TTL = uint8(v)
+	case level == SOL_SOCKET && opt == SO_KEEPALIVE:
+		o.keepalive.Enable = v != 0
+	case level == SOL_SOCKET && (opt == SO_SNDBUF || opt == SO_RCVBUF):
+		if v <= 0 {
+			return errors.New("buffer size must be positive")
+		}
+		if opt == SO_SNDBUF {
+			o.sndbuf = v
+		} else {
+			o.rcvbuf = v
+		}
+	case level == SOL_TCP && opt == TCP_NODELAY:
+		o.nodelay = v != 0
+	case level == SOL_TCP && opt == TCP_QUICKACK:
+		o.quickack = v != 0
+	case level == SOL_TCP && opt == TCP_KEEPIDLE:
+		o.keepalive.Idle = d
+	case level == SOL_TCP && opt == TCP_KEEPINTVL:
+		o.keepalive.Interval = d
+	case level == SOL_TCP && opt == TCP_KEEPCNT:
+		o.keepalive.Count = v
+	default:
+		return errors.New("socket option not supported")
+	}
+	st.sockets[sockfd].applyOpts(o)
+	st.update(sockfd) // Keepalive may have been enabled.
+	return nil
+}
+
+// Tick advances the time of the stack to now and processes the timers of the
+// sockets which expired, see Socket.Tick. Timers have a resolution of a millisecond.
+func (st *Stack) Tick(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.now = now
+	if !st.wheel.started {
+		st.wheel.start(wheelTick(now))
+		for i := range st.sockets {
+			st.update(i)
+		}
+	}
+	tick := wheelTick(now)
+	for t := st.wheel.expire(tick); t != nil; t = st.wheel.expire(tick) {
+		st.sockets[t.id].Tick(now)
+		st.update(t.id)
+	}
+}
+
+// NextTimeout returns the time Tick must be called at for the next timer of the
+// stack to expire, so that the loop driving the stack may sleep until then when
+// there are no packets to exchange. It may be earlier than a timer expires, in
+// which case Tick does nothing. ok is false if no timer is running.
+func (st *Stack) NextTimeout() (t time.Time, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tick, ok := st.wheel.nextExpiry()
+	if !ok || !st.wheel.started {
+		return time.Time{}, false
+	}
+	return wheelTime(tick), true
+}
+
+// RecvEthernet passes an Ethernet frame to the socket it belongs to, see Socket.RecvEthernet.
+func (st *Stack) RecvEthernet(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	return st.recvEthernet(buf, false)
+}
+
+// recvEthernet is RecvEthernet for a frame whose checksums the link layer
+// verified if verified is set.
+func (st *Stack) recvEthernet(buf []byte, verified bool) (payloadStart, payloadEnd uint16, err error) {
+	if len(buf) < dgrams.SizeEthernetHeaderNoVLAN {
+		return 0, 0, errors.New("buffer too short to contain Ethernet")
+	}
+	eth := dgrams.DecodeEthernetHeader(buf)
+	if eth.SizeOrEtherType != uint16(dgrams.EtherTypeIPv4) {
+		return 0, 0, errors.New("support only IPv4")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fd, err := st.socketFor(buf[dgrams.SizeEthernetHeaderNoVLAN:], &eth, verified)
+	if fd < 0 {
+		st.dropped(buf[dgrams.SizeEthernetHeaderNoVLAN:], err)
+		return 0, 0, err
+	}
+	st.sockets[fd].setNow(st.now)
+	payloadStart, payloadEnd, err = st.sockets[fd].recvEthernet(buf, true)
+	st.received(fd)
+	st.update(fd)
+	return payloadStart, payloadEnd, err
+}
+
+// RecvTCP passes a TCP+IPv4 packet to the socket it belongs to, see Socket.RecvTCP.
+func (st *Stack) RecvTCP(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	return st.recvTCP(buf, false)
+}
+
+// recvTCP is RecvTCP for a packet whose checksums the link layer verified if
+// verified is set.
+func (st *Stack) recvTCP(buf []byte, verified bool) (payloadStart, payloadEnd uint16, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fd, err := st.socketFor(buf, nil, verified)
+	if fd < 0 {
+		st.dropped(buf, err)
+		return 0, 0, err
+	}
+	st.sockets[fd].setNow(st.now)
+	payloadStart, payloadEnd, err = st.sockets[fd].recvTCP(buf, true)
+	st.received(fd)
+	st.update(fd)
+	return payloadStart, payloadEnd, err
+}
+
+// SendEthernet writes the next pending Ethernet frame of any socket to dst, see Socket.SendEthernet.
+func (st *Stack) SendEthernet(dst []byte) (n int, err error) {
+	n, _, err = st.send(dst, true, false)
+	return n, err
+}
+
+// SendTCP writes the next pending TCP+IPv4 packet of any socket to dst, see Socket.SendTCP.
+func (st *Stack) SendTCP(dst []byte) (n int, err error) {
+	n, _, err = st.send(dst, false, false)
+	return n, err
+}
+
+// send writes the next pending frame to dst. If offload is set the frame is for
+// a TSODevice, see Socket.sendTCP.
+func (st *Stack) send(dst []byte, ethernet, offload bool) (n, mss int, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.nctl > 0 {
+		c := st.ctl[0]
+		copy(st.ctl[:], st.ctl[1:st.nctl])
+		st.nctl--
+		n, err = st.writeCtl(dst, &c, ethernet, offload)
+		return n, 0, err
+	}
+	for i := 0; i < len(st.sockets); i++ {
+		idx := (st.next + i) % len(st.sockets)
+		if st.slots[idx].listening {
+			continue
+		}
+		s := &st.sockets[idx]
+		s.setNow(st.now)
+		if ethernet {
+			n, mss, err = s.sendEthernet(dst, offload)
+		} else {
+			n, mss, err = s.sendTCP(dst, offload)
+		}
+		// Data written by the user since the socket was last updated may
+		// need its timers, i.e. the persist timer, so all are updated.
+		st.update(idx)
+		if ethernet && n > 0 {
+			s.cs.mu.Lock()
+			st.countARP(s.ethLearned)
+			s.cs.mu.Unlock()
+		}
+		if n > 0 || err != nil {
+			st.next = idx + 1
+			return n, mss, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// socketFor returns the descriptor of the socket the TCP+IPv4 packet in buf is
+// destined to. Segments are matched to connections by their address and port
+// pairs first and to listening sockets by their destination port otherwise.
+// Connection requests to a listening socket spawn a new socket if its backlog
+// is not full. A RST is queued in response to segments matching no socket.
+// Checksums are verified first unless the link layer verified them and the
+// policy trusts it. eth is the header of the Ethernet frame containing buf, if
+// any. st.mu must be held.
+func (st *Stack) socketFor(buf []byte, eth *dgrams.EthernetHeader, verified bool) (int, error) {
+	if len(buf) < sizeTCPIPv4 {
+		return -1, errShortTCP
+	}
+	ip := dgrams.DecodeIPv4Header(buf)
+	if ip.Version != 4 || ip.Protocol != 6 {
+		return -1, errNotTCPIPv4
+	}
+	// The TCP header follows the options of the IP header, if any.
+	ihl := int(ip.IHL) * 4
+	if ihl < dgrams.SizeIPHeader || ihl > int(ip.TotalLength) || ihl+dgrams.SizeTCPHeaderNoOptions > len(buf) {
+		return -1, errBadIHL
+	}
+	if ip.Flags.MoreFragments() || ip.Flags.FragmentOffset() != 0 {
+		return -1, errFragment
+	}
+	if !verified || st.csum != ChecksumTrustOffload {
+		drop, err := checkChecksums(buf, st.csum, &st.stats)
+		if err == dgrams.ErrIPv4HeaderChecksum || err == dgrams.ErrChecksum {
+			st.logPacket(EventBadChecksum, LevelWarn, buf, err)
+		}
+		if drop {
+			return -1, err
+		}
+	}
+	tcp := dgrams.DecodeTCPHeader(buf[ihl:])
+	if !st.addr.Equal(ip.Destination[:]) {
+		return -1, errNotForStack
+	}
+	key := demuxKey{port: tcp.DestinationPort, rport: tcp.SourcePort, rip: ip.Source}
+	if fd, ok := st.demux.lookup(key); ok && !st.slots[fd].listening {
+		if st.sockets[fd].State() != StateClosed {
+			return fd, nil
+		}
+		// Connection closed since the last Tick, it no longer exists.
+		st.unhash(fd)
+	}
+	flags := tcp.Flags()
+	listener, ok := st.demux.lookup(demuxKey{port: tcp.DestinationPort})
+	if ok && flags == dgrams.FlagTCP_SYN {
+		return st.synRcv(listener, key, eth, buf[ihl:], &tcp)
+	}
+	if ok && st.cookies && flags&(dgrams.FlagTCP_SYN|dgrams.FlagTCP_RST|dgrams.FlagTCP_ACK) == dgrams.FlagTCP_ACK {
+		if fd, err := st.cookieRcv(listener, key, &ip, &tcp); fd >= 0 || err != nil {
+			return fd, err
+		}
+	}
+	// Segments without ACK reaching a listening socket are dropped
+	// without a RST, see RFC 9293 section 3.10.7.2.
+	if !ok || flags.HasFlags(dgrams.FlagTCP_ACK) {
+		if err := st.reset(eth, buf, &ip, &tcp); err != nil {
+			return -1, err
+		}
+	}
+	return -1, errNoSocket
+}
+
+// dropped counts and logs the packet in buf which was not passed to a socket
+// because of err, nil if the stack answered it itself. st.mu must be held.
+func (st *Stack) dropped(buf []byte, err error) {
+	switch err {
+	case errShortTCP, errNotTCPIPv4, errBadIHL:
+		return // Not a TCP segment.
+	case errFragment:
+		st.stats.ReasmFails++
+		return
+	case dgrams.ErrIPv4HeaderChecksum, dgrams.ErrChecksum:
+		return // Counted and logged when verified.
+	case errBadLength:
+		st.stats.InErrs++
+	}
+	st.stats.InSegs++
+	if err != nil {
+		st.logPacket(EventDrop, LevelInfo, buf, err)
+	}
+}
+
+// synRcv spawns a socket for a connection request of the remote peer of k to
+// listener. When the SYN backlog of the listener is full the request is answered
+// with a SYN cookie if enabled, otherwise the oldest half-open connection is
+// dropped. seg is the TCP segment of the request. It returns -1 and no error if
+// the request was answered by the stack itself. st.mu must be held.
+func (st *Stack) synRcv(listener int, k demuxKey, eth *dgrams.EthernetHeader, seg []byte, tcp *dgrams.TCPHeader) (int, error) {
+	l := &st.slots[listener]
+	queued, halfOpen, oldest := st.children(listener)
+	if queued >= l.backlog {
+		return -1, errBacklogFull
+	}
+	synBacklog := st.synBacklog
+	if synBacklog <= 0 {
+		synBacklog = l.backlog
+	}
+	fd := -1
+	if halfOpen < synBacklog {
+		fd, _ = st.alloc()
+	}
+	if fd < 0 && st.cookies {
+		return -1, st.sendCookie(listener, k, eth, seg, tcp)
+	}
+	if fd < 0 {
+		if oldest < 0 {
+			return -1, errTooManySockets
+		}
+		st.sockets[oldest].abortWith(nil)
+		st.slots[oldest].parent = -1
+		st.unhash(oldest)
+		var err error
+		if fd, err = st.alloc(); err != nil {
+			return -1, err
+		}
+	}
+	st.spawn(listener, fd, k)
+	return fd, nil
+}
+
+// cookieRcv spawns a socket for a connection of listener if the segment received
+// from the remote peer of k is the final ACK of a handshake answered with a valid
+// SYN cookie. It returns -1 and no error if it is not. st.mu must be held.
+func (st *Stack) cookieRcv(listener int, k demuxKey, ip *dgrams.IPv4Header, tcp *dgrams.TCPHeader) (int, error) {
+	irs, cookie := Seq(tcp.Seq-1), Seq(tcp.Ack-1)
+	mss, ok := checkSynCookie(&st.cookieKey, st.now, k, irs, cookie)
+	if !ok {
+		return -1, nil
+	}
+	if queued, _, _ := st.children(listener); queued >= st.slots[listener].backlog {
+		return -1, errBacklogFull
+	}
+	fd, err := st.alloc()
+	if err != nil {
+		return -1, err
+	}
+	st.spawn(listener, fd, k)
+	st.sockets[fd].cookieRcv(ip, tcp, cookie, mss)
+	return fd, nil
+}
+
+// sendCookie queues a SYN-ACK answering the connection request of the remote
+// peer of k to listener with a SYN cookie. seg is the TCP segment of the
+// request. st.mu must be held.
+func (st *Stack) sendCookie(listener int, k demuxKey, eth *dgrams.EthernetHeader, seg []byte, tcp *dgrams.TCPHeader) error {
+	end := int(tcp.OffsetInBytes())
+	if end > len(seg) {
+		return errShortTCP
+	}
+	opts, err := parseOptions(seg[dgrams.SizeTCPHeaderNoOptions:end])
+	if err != nil {
+		return err
+	}
+	mss := uint16(defaultMSS)
+	if opts.hasMSS {
+		mss = opts.mss
+	}
+	mtu, wnd := st.mtu, st.slots[listener].opts.rcvbuf
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	if wnd <= 0 {
+		wnd = defaultBufferSize
+	}
+	if wnd > math.MaxUint16 {
+		wnd = math.MaxUint16
+	}
+	st.queueCtl(eth, ctlSegment{
+		key:   k,
+		seq:   synCookie(&st.cookieKey, st.now, k, Seq(tcp.Seq), mss),
+		ack:   Seq(tcp.Seq).Add(1),
+		flags: dgrams.FlagTCP_SYN | dgrams.FlagTCP_ACK,
+		wnd:   uint16(wnd),
+		mss:   mtu - sizeTCPIPv4,
+	})
+	return nil
+}
+
+// children returns the number of established connections of listener waiting
+// to be accepted, the number of its half-open connections and the descriptor of
+// the oldest half-open connection, -1 if there is none. st.mu must be held.
+func (st *Stack) children(listener int) (queued, halfOpen, oldest int) {
+	oldest = -1
+	for i := range st.slots {
+		c := &st.slots[i]
+		if c.parent != listener || c.open {
+			continue
+		}
+		switch st.sockets[i].State() {
+		case StateClosed:
+		case StateListen, StateSynRcvd:
+			halfOpen++
+			if oldest < 0 || int32(c.born-st.slots[oldest].born) < 0 {
+				oldest = i
+			}
+		default:
+			queued++
+		}
+	}
+	return queued, halfOpen, oldest
+}
+
+// spawn initializes the free socket fd as a connection of listener with key k,
+// inheriting the options of the listener. st.mu must be held.
+func (st *Stack) spawn(listener, fd int, k demuxKey) {
+	st.spawned++
+	st.slots[fd] = stackSlot{
+		parent: listener,
+		born:   st.spawned,
+		port:   k.port,
+		opts:   st.slots[listener].opts,
+	}
+	st.hash(fd, k)
+	s := &st.sockets[fd]
+	s.applyOpts(&st.slots[fd].opts)
+	s.us = net.TCPAddr{IP: append(s.us.IP[:0], st.addr...), Port: int(k.port)}
+	s.Tick(st.now)
+	s.Listen()
+}
+
+// reset queues a RST in response to the segment in buf which matches no
+// socket, as specified by RFC 9293 section 3.10.7.1. No RST is sent in
+// response to a RST. st.mu must be held.
+func (st *Stack) reset(eth *dgrams.EthernetHeader, buf []byte, ip *dgrams.IPv4Header, tcp *dgrams.TCPHeader) error {
+	payloadStart := int(ip.IHL)*4 + int(tcp.OffsetInBytes())
+	end := int(ip.TotalLength)
+	if end > len(buf) || payloadStart > end {
+		return errBadLength
+	}
+	flags := tcp.Flags()
+	if flags.HasFlags(dgrams.FlagTCP_RST) {
+		return nil
+	}
+	c := ctlSegment{key: demuxKey{port: tcp.DestinationPort, rport: tcp.SourcePort, rip: ip.Source}}
+	if flags.HasFlags(dgrams.FlagTCP_ACK) {
+		c.seq = Seq(tcp.Ack)
+		c.flags = dgrams.FlagTCP_RST
+	} else {
+		c.ack = Seq(tcp.Seq).Add(segLen(flags, buf[payloadStart:end]))
+		c.flags = dgrams.FlagTCP_RST | dgrams.FlagTCP_ACK
+	}
+	st.queueCtl(eth, c)
+	return nil
+}
+
+// queueCtl queues c for sending unless the queue is full. eth is the header of
+// the Ethernet frame c responds to, if any. st.mu must be held.
+func (st *Stack) queueCtl(eth *dgrams.EthernetHeader, c ctlSegment) {
+	if st.nctl == len(st.ctl) {
+		return
+	}
+	c.ethDst, c.ethSrc = st.gw, st.hw
+	if eth != nil {
+		c.ethDst, c.ethSrc = eth.Source, eth.Destination
+		c.ethLearned = true
+	}
+	st.ctl[st.nctl] = c
+	st.nctl++
+}
+
+// writeCtl writes the segment c to dst, in an Ethernet frame if ethernet is set.
+// The TCP checksum is partial if partialCsum is set, see putTCPIPv4. st.mu must be held.
+func (st *Stack) writeCtl(dst []byte, c *ctlSegment, ethernet, partialCsum bool) (int, error) {
+	off := 0
+	if ethernet {
+		if len(dst) < dgrams.SizeEthernetHeaderNoVLAN {
+			return 0, io.ErrShortBuffer
+		}
+		off = dgrams.SizeEthernetHeaderNoVLAN
+	}
+	tcp := dgrams.TCPHeader{
+		SourcePort:      c.key.port,
+		DestinationPort: c.key.rport,
+		Seq:             uint32(c.seq),
+		Ack:             uint32(c.ack),
+		WindowSize:      c.wnd,
+	}
+	tcp.SetFlags(c.flags)
+	var optBuf [4]byte
+	opts := optBuf[:0]
+	if c.mss != 0 {
+		opts = append(opts, byte(dgrams.TCPOptionMSS), 4)
+		opts = binary.BigEndian.AppendUint16(opts, c.mss)
+	}
+	var src [4]byte
+	copy(src[:], st.addr)
+	n, err := putTCPIPv4(dst[off:], &st.ipv4, src, c.key.rip, &tcp, opts, nil, partialCsum)
+	if err != nil {
+		return 0, err
+	}
+	st.logPacket(EventSend, LevelDebug, dst[off:off+n], nil)
+	st.stats.OutSegs++
+	if c.flags.HasFlags(dgrams.FlagTCP_RST) {
+		st.stats.OutRsts++
+	}
+	if ethernet {
+		st.countARP(c.ethLearned)
+		eth := dgrams.EthernetHeader{
+			Destination:     c.ethDst,
+			Source:          c.ethSrc,
+			SizeOrEtherType: uint16(dgrams.EtherTypeIPv4),
+		}
+		eth.Put(dst)
+	}
+	return off + n, nil
+}
+
+// update releases the socket of fd if its connection was reset or timed out
+// during the handshake or was closed, and schedules its timer at the time its
+// next timer expires. It must be called after the state of the connection may
+// have changed. st.mu must be held.
+func (st *Stack) update(fd int) {
+	s, c := &st.sockets[fd], &st.slots[fd]
+	s.cs.mu.Lock()
+	state := s.cs.state
+	next := s.cs.nextTimeout()
+	s.cs.mu.Unlock()
+	if c.parent >= 0 && (state == StateListen || state == StateClosed) {
+		s.abortWith(nil)
+		c.parent = -1
+		state = StateClosed
+	}
+	if !c.listening && state == StateClosed {
+		st.unhash(fd)
+	}
+	if next.IsZero() || !st.wheel.started {
+		st.wheel.stop(&st.timers[fd])
+	} else {
+		st.wheel.schedule(&st.timers[fd], wheelTick(next))
+	}
+}
+
+// received wakes up the listening socket which spawned the connection of fd
+// if it has just been established. st.mu must be held.
+func (st *Stack) received(fd int) {
+	if parent := st.slots[fd].parent; parent >= 0 && isEstablished(st.sockets[fd].State()) {
+		st.sockets[parent].wake()
+	}
+}
+
+// alloc returns the descriptor of a free socket and resets the socket. st.mu must be held.
+func (st *Stack) alloc() (int, error) {
+	for i := range st.slots {
+		c := &st.slots[i]
+		if c.open || st.sockets[i].State() != StateClosed {
+			continue
+		}
+		st.unhash(i)
+		s := &st.sockets[i]
+		s.cs.mu.Lock()
+		s.cs.abort(nil)
+		st.stats.add(&s.cs.stats)
+		s.cs.stats = Stats{}
+		s.us = net.TCPAddr{IP: s.us.IP[:0]}
+		s.them = net.TCPAddr{IP: s.them.IP[:0]}
+		s.ethUs = st.hw
+		s.ethThem = st.gw
+		s.ethLearned = false
+		s.isn = st.isn
+		s.mtu = st.mtu
+		s.cs.mu.Unlock()
+		s.applyOpts(&sockOpts{ipv4: st.ipv4})
+		return i, nil
+	}
+	return -1, errTooManySockets
+}
+
+// hash adds the socket of fd to the demultiplexing table with key k. st.mu must be held.
+func (st *Stack) hash(fd int, k demuxKey) {
+	st.unhash(fd)
+	if !st.demux.insert(k, fd) {
+		// Every socket has at most one key and the table is sized for all of them.
+		panic("tcpctl: demultiplexing table full")
+	}
+	st.slots[fd].key = k
+	st.slots[fd].hashed = true
+}
+
+// unhash removes the socket of fd from the demultiplexing table. st.mu must be held.
+func (st *Stack) unhash(fd int) {
+	if c := &st.slots[fd]; c.hashed {
+		st.demux.remove(c.key)
+		c.hashed = false
+	}
+}
+
+// slot returns the slot of an open descriptor. st.mu must be held.
+func (st *Stack) slot(sockfd int) (*stackSlot, error) {
+	if sockfd < 0 || sockfd >= len(st.slots) || !st.slots[sockfd].open {
+		return nil, errBadDescriptor
+	}
+	return &st.slots[sockfd], nil
+}
+
+// conn returns the socket of an open descriptor for sending and receiving.
+func (st *Stack) conn(sockfd int, flags int) (*Socket, error) {
+	if flags != 0 {
+		return nil, errors.New("flags not supported")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	slot, err := st.slot(sockfd)
+	if err != nil {
+		return nil, err
+	}
+	if slot.listening {
+		return nil, errors.New("socket is listening")
+	}
+	return &st.sockets[sockfd], nil
+}
+
+// check returns a function reporting the deadline of a blocking call on
+// sockfd, which fails if the deadline expired or the descriptor was closed.
+// deadline is on the clock of the stack, the deadline reported is on the
+// system clock which times the wait.
+func (st *Stack) check(sockfd int, deadline time.Time) func() (time.Time, error) {
+	return func() (time.Time, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if _, err := st.slot(sockfd); err != nil {
+			return deadline, net.ErrClosed
+		}
+		if deadline.IsZero() {
+			return deadline, nil
+		}
+		now := st.clock.Now()
+		if !now.Before(deadline) {
+			return deadline, os.ErrDeadlineExceeded
+		}
+		return time.Now().Add(deadline.Sub(now)), nil
+	}
+}
+
+// portInUse returns true if a socket is bound to port. Connections spawned
+// by listening sockets share its port. st.mu must be held.
+func (st *Stack) portInUse(port uint16) bool {
+	for i := range st.slots {
+		c := &st.slots[i]
+		inUse := c.open || st.sockets[i].State() != StateClosed
+		if c.port == port && c.parent < 0 && inUse {
+			return true
+		}
+	}
+	return false
+}
+
+// bindEphemeral binds slot to an unused ephemeral port. st.mu must be held.
+func (st *Stack) bindEphemeral(slot *stackSlot) error {
+	for i := 0; i <= ephemeralPortMax-ephemeralPortMin; i++ {
+		port := st.port
+		if st.port == ephemeralPortMax {
+			st.port = ephemeralPortMin
+		} else {
+			st.port++
+		}
+		if !st.portInUse(port) {
+			slot.port = port
+			return nil
+		}
+	}
+	return errAddrInUse
+}
+
+// applyOpts sets the socket options in o on the socket.
+func (s *Socket) applyOpts(o *sockOpts) {
+	s.SetNoDelay(o.nodelay)
+	s.SetQuickAck(o.quickack)
+	s.SetKeepAlive(o.keepalive)
+	s.SetIPv4Sender(o.ipv4)
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	if s.cs.state != StateClosed && s.cs.state != StateListen {
+		return
+	}
+	if o.sndbuf > 0 && o.sndbuf != s.cs.sndBuf.Size() {
+		s.cs.sndBuf = ring{buf: make([]byte, o.sndbuf)}
+	}
+	if o.rcvbuf > 0 && o.rcvbuf != s.cs.rcvBuf.Size() {
+		s.cs.rcvBuf = ring{buf: make([]byte, o.rcvbuf)}
+	}
+}
+
+// setNow advances the time of the socket to now without running its timers,
+// which the Stack runs on its timer wheel.
+func (s *Socket) setNow(now time.Time) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.now = now
+}
+
+// abortWith aborts the connection with the given error returned by Read and Write.
+func (s *Socket) abortWith(err error) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.abort(err)
+}
+
+// error returns the reason the connection was aborted, if any.
+func (s *Socket) error() error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	return s.cs.err
+}
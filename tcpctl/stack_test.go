@@ -0,0 +1,589 @@
+package tcpctl_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func newTestStack(t *testing.T, maxSockets int) *tcpctl.Stack {
+	t.Helper()
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:       net.IPv4(192, 168, 1, 5),
+		MaxSockets: maxSockets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Tick(time.Now())
+	return st
+}
+
+func newTestSocket(t *testing.T, st *tcpctl.Stack) int {
+	t.Helper()
+	fd, err := st.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, tcpctl.IPPROTO_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// pollTCP calls st.SendTCP until a packet is sent, for use while another goroutine blocks on st.
+func pollTCP(t *testing.T, st *tcpctl.Stack, buf []byte) dgrams.TCPHeader {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		n, err := st.SendTCP(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if n > 0 {
+			return dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n])
+		}
+	}
+	t.Fatal("expected packet to be sent")
+	return dgrams.TCPHeader{}
+}
+
+func TestStackAccept(t *testing.T) {
+	const irs = irsEstablished
+	st := newTestStack(t, 4)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	if err := st.Bind(lfd, nil, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetSockOpt(lfd, tcpctl.SOL_TCP, tcpctl.TCP_NODELAY, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Listen(lfd, 1); err != nil {
+		t.Fatal(err)
+	}
+	fd := newTestSocket(t, st)
+	if err := st.Bind(fd, nil, 80); err == nil {
+		t.Fatal("expected error binding port in use")
+	}
+	st.Close(fd)
+
+	accepted := make(chan int, 1)
+	remote := make(net.IP, 4)
+	go func() {
+		fd, err := st.Accept(lfd, remote, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- fd
+	}()
+	if _, _, err := st.RecvEthernet(packetSyn); err != nil {
+		t.Fatal(err)
+	}
+	iss := pollTCP(t, st, buf[:]).Seq
+	if _, _, err := st.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 65535, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fd = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return")
+	}
+	if !remote.Equal(net.IPv4(192, 168, 1, 112)) {
+		t.Fatal("unexpected remote address", remote)
+	}
+
+	_, err := st.Recv(fd, buf[:], 0, time.Now().Add(10*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected Recv to time out, got", err)
+	}
+	st.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_PSH, 65535, nil, []byte("ping")))
+	n, err := st.Recv(fd, buf[:], 0, time.Time{})
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("expected to receive ping, got %q %v", buf[:n], err)
+	}
+	if _, err = st.Send(fd, []byte("pong"), 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	seg := pollTCP(t, st, buf[:])
+	if string(tcpPayload(buf[:], &seg)) != "pong" || seg.Ack != irs+5 {
+		t.Fatalf("expected pong acknowledging ping, got ack=%d", seg.Ack-irs)
+	}
+	// Option set on listening socket is inherited: no Nagle delay.
+	st.Send(fd, []byte("!"), 0, time.Time{})
+	if seg = pollTCP(t, st, buf[:]); string(tcpPayload(buf[:], &seg)) != "!" {
+		t.Fatal("expected small segment sent right away with TCP_NODELAY")
+	}
+	st.Close(fd)
+	if fin := pollTCP(t, st, buf[:]); !fin.Flags().HasFlags(dgrams.FlagTCP_FIN) {
+		t.Fatal("expected FIN after close, got", fin.Flags())
+	}
+	if _, err = st.Recv(fd, buf[:], 0, time.Time{}); err == nil {
+		t.Fatal("expected error on closed descriptor")
+	}
+}
+
+func TestStackConnect(t *testing.T) {
+	const irs = irsEstablished
+	const peerPort = 58920
+	st := newTestStack(t, 2)
+	var buf [1500]byte
+	fd := newTestSocket(t, st)
+	if err := st.SetSockOpt(fd, tcpctl.SOL_SOCKET, tcpctl.SO_RCVBUF, 4000); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- st.Connect(fd, "192.168.1.112", nil, peerPort) }()
+	syn := pollTCP(t, st, buf[:])
+	if syn.Flags() != dgrams.FlagTCP_SYN || syn.SourcePort < 49152 || syn.DestinationPort != peerPort {
+		t.Fatalf("expected SYN from ephemeral port, got %s from port %d", syn.Flags(), syn.SourcePort)
+	}
+	if buf[0] != 0x45 {
+		t.Fatalf("expected IPv4 header without options, got first octet %#x", buf[0])
+	}
+	if syn.WindowSize != 4000 {
+		t.Fatal("expected window of SO_RCVBUF size, got", syn.WindowSize)
+	}
+	if _, ok := findOption(buf[:], &syn, dgrams.TCPOptionMSS); !ok {
+		t.Fatal("expected MSS option in SYN")
+	}
+	port := syn.SourcePort
+	st.RecvTCP(tcpPacketPorts(peerPort, port, irs, syn.Seq+1, dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK, 65535, nil, nil))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ack := pollTCP(t, st, buf[:]); ack.Ack != irs+1 || ack.Seq != syn.Seq+1 {
+		t.Fatal("expected ACK of SYN-ACK")
+	}
+	st.Send(fd, []byte("hello"), 0, time.Time{})
+	if seg := pollTCP(t, st, buf[:]); string(tcpPayload(buf[:], &seg)) != "hello" {
+		t.Fatal("expected data sent on connection")
+	}
+
+	// Connection request refused by the remote peer.
+	fd2 := newTestSocket(t, st)
+	go func() { done <- st.Connect(fd2, "", net.IPv4(192, 168, 1, 112), peerPort) }()
+	syn = pollTCP(t, st, buf[:])
+	if syn.SourcePort == port {
+		t.Fatal("expected a different ephemeral port")
+	}
+	st.RecvTCP(tcpPacketPorts(peerPort, syn.SourcePort, 0, syn.Seq+1, dgrams.FlagTCP_RST|dgrams.FlagTCP_ACK, 0, nil, nil))
+	if err := <-done; err == nil {
+		t.Fatal("expected connection refused")
+	}
+}
+
+func TestStackErrors(t *testing.T) {
+	st := newTestStack(t, 1)
+	if _, err := st.Socket(tcpctl.AF_INET, 2, 17); err == nil {
+		t.Error("expected UDP socket to be unsupported")
+	}
+	fd := newTestSocket(t, st)
+	if _, err := st.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, 0); err == nil {
+		t.Error("expected error with no sockets left")
+	}
+	if err := st.SetSockOpt(fd, tcpctl.SOL_SOCKET, 0xff, 1); err == nil {
+		t.Error("expected unsupported socket option error")
+	}
+	if err := st.Listen(fd, 1); err == nil {
+		t.Error("expected error listening on unbound socket")
+	}
+	if _, err := st.GetHostByName("example.com"); err == nil {
+		t.Error("expected name resolution to be unsupported")
+	}
+	st.Close(fd)
+	if err := st.Bind(fd, nil, 80); err == nil {
+		t.Error("expected error on closed descriptor")
+	}
+	if _, err := st.Socket(tcpctl.AF_INET, tcpctl.SOCK_STREAM, 0); err != nil {
+		t.Error("expected closed socket to be reused, got", err)
+	}
+}
+
+func TestStackReset(t *testing.T) {
+	const seq = 1000
+	st := newTestStack(t, 2)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	for _, test := range []struct {
+		port     uint16
+		flags    dgrams.TCPFlags
+		payload  string
+		wantSeq  uint32
+		wantAck  uint32
+		wantFlag dgrams.TCPFlags
+	}{
+		// Segment with ACK to a closed port: RST carries the acknowledgment number as sequence number.
+		{port: 81, flags: dgrams.FlagTCP_ACK | dgrams.FlagTCP_PSH, payload: "data", wantSeq: 5000, wantFlag: dgrams.FlagTCP_RST},
+		// Connection request to a closed port is refused acknowledging the SYN.
+		{port: 81, flags: dgrams.FlagTCP_SYN, wantAck: seq + 1, wantFlag: dgrams.FlagTCP_RST | dgrams.FlagTCP_ACK},
+		{port: 81, flags: dgrams.FlagTCP_FIN, payload: "ab", wantAck: seq + 3, wantFlag: dgrams.FlagTCP_RST | dgrams.FlagTCP_ACK},
+		// Segment acknowledging nothing to a listening socket.
+		{port: 80, flags: dgrams.FlagTCP_ACK, wantSeq: 5000, wantFlag: dgrams.FlagTCP_RST},
+	} {
+		pkt := tcpPacketPorts(58920, test.port, seq, 5000, test.flags, 1024, nil, []byte(test.payload))
+		if _, _, err := st.RecvTCP(pkt); err == nil {
+			t.Fatal("expected error for segment matching no socket")
+		}
+		n, err := st.SendTCP(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("expected RST to be sent", err)
+		}
+		rst := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n])
+		if rst.Flags() != test.wantFlag || rst.Seq != test.wantSeq || rst.Ack != test.wantAck {
+			t.Errorf("%s to port %d: got %s seq=%d ack=%d", test.flags, test.port, rst.Flags(), rst.Seq, rst.Ack)
+		}
+		if rst.SourcePort != test.port || rst.DestinationPort != 58920 {
+			t.Error("RST has wrong ports", rst.SourcePort, rst.DestinationPort)
+		}
+	}
+	// No RST in response to a RST or to a segment without ACK reaching a listening socket.
+	st.RecvTCP(tcpPacketPorts(58920, 81, seq, 0, dgrams.FlagTCP_RST, 0, nil, nil))
+	st.RecvTCP(tcpPacketPorts(58920, 80, seq, 0, dgrams.FlagTCP_PSH, 0, nil, []byte("x")))
+	if n, _ := st.SendTCP(buf[:]); n != 0 {
+		t.Fatal("expected no RST to be sent")
+	}
+
+	// RST in an Ethernet frame is sent back to the hardware address it came from.
+	stray := append([]byte{}, packetSyn...)
+	stray[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader+3] = 81 // Destination port.
+	setChecksums(stray[dgrams.SizeEthernetHeaderNoVLAN:])
+	st.RecvEthernet(stray)
+	n, _ := st.SendEthernet(buf[:])
+	eth := dgrams.DecodeEthernetHeader(buf[:n])
+	synEth := dgrams.DecodeEthernetHeader(packetSyn)
+	if n == 0 || eth.Destination != synEth.Source || eth.Source != synEth.Destination {
+		t.Fatal("expected RST sent to the hardware address of the SYN")
+	}
+}
+
+func TestStackDemuxAllocs(t *testing.T) {
+	const irs = irsEstablished
+	st := newTestStack(t, 4)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 4)
+	if _, _, err := st.RecvEthernet(packetSyn); err != nil {
+		t.Fatal(err)
+	}
+	iss := pollTCP(t, st, buf[:]).Seq
+	ack := tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 65535, nil, nil)
+	if _, _, err := st.RecvTCP(ack); err != nil {
+		t.Fatal(err)
+	}
+	stray := tcpPacketPorts(58921, 80, irs, 1, dgrams.FlagTCP_ACK, 65535, nil, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := st.RecvTCP(ack); err != nil {
+			t.Fatal(err)
+		}
+		st.RecvTCP(stray)
+		if n, _ := st.SendTCP(buf[:]); n == 0 {
+			t.Fatal("expected RST")
+		}
+	})
+	if allocs != 0 {
+		t.Fatal("expected demultiplexing not to allocate, got", allocs, "allocations")
+	}
+}
+
+// synFlood sends n connection requests to port 80 of st from distinct ports
+// and discards the segments sent in response.
+func synFlood(st *tcpctl.Stack, n int) {
+	var buf [1500]byte
+	for i := 0; i < n; i++ {
+		st.RecvTCP(tcpPacketPorts(uint16(10000+i), 80, uint32(i), 0, dgrams.FlagTCP_SYN, 1024, nil, nil))
+		for n, _ := st.SendTCP(buf[:]); n > 0; n, _ = st.SendTCP(buf[:]) {
+		}
+	}
+}
+
+func TestStackSYNCookies(t *testing.T) {
+	const irs = irsEstablished
+	const port = 40000
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:       net.IPv4(192, 168, 1, 5),
+		MaxSockets: 4,
+		SYNBacklog: 2,
+		SYNCookies: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	st.Tick(now)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 2)
+	synFlood(st, 100)
+
+	// Legitimate connection request answered with a SYN cookie.
+	mssOpt := []byte{byte(dgrams.TCPOptionMSS), 4, 0x05, 0xb4}
+	st.RecvTCP(tcpPacketPorts(port, 80, irs, 0, dgrams.FlagTCP_SYN, 1024, mssOpt, nil))
+	n, err := st.SendTCP(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected SYN-ACK", err)
+	}
+	synack := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n])
+	if synack.Flags() != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK || synack.Ack != irs+1 || synack.DestinationPort != port {
+		t.Fatalf("unexpected SYN-ACK %s ack=%d", synack.Flags(), synack.Ack-irs)
+	}
+	if _, ok := findOption(buf[:n], &synack, dgrams.TCPOptionWindowScale); ok {
+		t.Fatal("expected no window scale option in SYN cookie SYN-ACK")
+	}
+	cookie := synack.Seq
+
+	// Forged final ACK is rejected.
+	st.RecvTCP(tcpPacketPorts(port+1, 80, irs+1, cookie+1, dgrams.FlagTCP_ACK, 1024, nil, nil))
+	n, _ = st.SendTCP(buf[:])
+	if rst := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n]); n == 0 || !rst.Flags().HasFlags(dgrams.FlagTCP_RST) {
+		t.Fatal("expected RST in response to ACK of forged cookie")
+	}
+
+	// Final ACK carrying data establishes the connection.
+	_, _, err = st.RecvTCP(tcpPacketPorts(port, 80, irs+1, cookie+1, dgrams.FlagTCP_ACK|dgrams.FlagTCP_PSH, 1024, nil, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := make(net.IP, 4)
+	fd, err := st.Accept(lfd, remote, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = st.Recv(fd, buf[:], 0, time.Time{})
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected data of final ACK, got %q %v", buf[:n], err)
+	}
+	st.Send(fd, []byte("hi"), 0, time.Time{})
+	seg := pollTCP(t, st, buf[:])
+	if seg.Seq != cookie+1 || seg.Ack != irs+6 || string(tcpPayload(buf[:], &seg)) != "hi" {
+		t.Fatalf("unexpected segment seq=%d ack=%d", seg.Seq-cookie, seg.Ack-irs)
+	}
+
+	// Cookies expire.
+	st.RecvTCP(tcpPacketPorts(port+2, 80, irs, 0, dgrams.FlagTCP_SYN, 1024, nil, nil))
+	n, _ = st.SendTCP(buf[:])
+	cookie = dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n]).Seq
+	st.Tick(now.Add(3 * time.Minute))
+	if _, _, err = st.RecvTCP(tcpPacketPorts(port+2, 80, irs+1, cookie+1, dgrams.FlagTCP_ACK, 1024, nil, nil)); err == nil {
+		t.Fatal("expected ACK of expired cookie to be rejected")
+	}
+}
+
+func TestStackSYNEviction(t *testing.T) {
+	const irs = irsEstablished
+	st := newTestStack(t, 4)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 2)
+	synFlood(st, 100)
+	// Oldest half-open connections were dropped to make room for new ones.
+	if _, _, err := st.RecvTCP(tcpPacketPorts(10000, 80, 1, 1, dgrams.FlagTCP_ACK, 1024, nil, nil)); err == nil {
+		t.Fatal("expected segment of evicted connection to be rejected")
+	}
+	st.SendTCP(buf[:]) // Discard RST.
+
+	if _, _, err := st.RecvEthernet(packetSyn); err != nil {
+		t.Fatal(err)
+	}
+	iss := pollTCP(t, st, buf[:]).Seq
+	if _, _, err := st.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_ACK, 65535, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	remote := make(net.IP, 4)
+	if _, err := st.Accept(lfd, remote, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStackTimers(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{Addr: net.IPv4(192, 168, 1, 5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Tick(start)
+	if _, ok := st.NextTimeout(); ok {
+		t.Fatal("expected no timer running")
+	}
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	st.RecvEthernet(packetSyn)
+	var buf [1500]byte
+	if n, _ := st.SendTCP(buf[:]); n == 0 {
+		t.Fatal("expected SYN-ACK")
+	}
+	// Retransmissions of the SYN-ACK expire exactly after the backed off RTO.
+	due := start
+	for _, rto := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		due = due.Add(rto)
+		if next, ok := st.NextTimeout(); !ok || !next.Equal(due) {
+			t.Fatalf("expected next timeout %v, got %v %v", due.Sub(start), next.Sub(start), ok)
+		}
+		st.Tick(due.Add(-time.Millisecond))
+		if n, _ := st.SendTCP(buf[:]); n != 0 {
+			t.Fatal("retransmitted before RTO expired")
+		}
+		st.Tick(due)
+		if n, _ := st.SendTCP(buf[:]); n == 0 {
+			t.Fatal("expected SYN-ACK retransmitted once RTO expired")
+		}
+	}
+}
+
+func TestStackIPv4Header(t *testing.T) {
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr: net.IPv4(192, 168, 1, 5),
+		IPv4: dgrams.IPv4Sender{IDs: dgrams.NewIPv4IDGenerator([16]byte{1})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Tick(time.Now())
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	if err := st.SetSockOpt(lfd, tcpctl.SOL_IP, tcpctl.IP_TTL, 0); err == nil {
+		t.Error("expected error setting TTL to zero")
+	}
+	if err := st.SetSockOpt(lfd, tcpctl.SOL_IP, tcpctl.IP_TTL, 32); err != nil {
+		t.Fatal(err)
+	}
+	// Expedited Forwarding with ECN bits, which are ignored.
+	if err := st.SetSockOpt(lfd, tcpctl.SOL_IP, tcpctl.IP_TOS, 46<<2|1); err != nil {
+		t.Fatal(err)
+	}
+	sent := func() dgrams.IPv4Header {
+		t.Helper()
+		n, err := st.SendTCP(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("expected packet to be sent", err)
+		}
+		if buf[0] != 0x45 {
+			t.Fatalf("expected version 4 and IHL 5 in the first octet, got %#x", buf[0])
+		}
+		if err := dgrams.VerifyChecksumsIPv4(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return dgrams.DecodeIPv4Header(buf[:n])
+	}
+
+	// The SYN-ACK of the spawned connection inherits the options of the listener.
+	st.RecvTCP(tcpPacket(1000, 0, dgrams.FlagTCP_SYN, 1024, nil, nil))
+	ip := sent()
+	if ip.TTL != 32 || ip.DSCP() != 46 || ip.ECN() != dgrams.ECNNotECT || !ip.Flags.DontFragment() {
+		t.Fatalf("SYN-ACK sent with TTL %d, DSCP %d, ECN %d and flags %#x", ip.TTL, ip.DSCP(), ip.ECN(), ip.Flags)
+	}
+	// Segments sent by the stack itself use its defaults, IDs increase per destination.
+	var ids []uint16
+	for i := 0; i < 2; i++ {
+		st.RecvTCP(tcpPacketPorts(58920, 81, 1000, 0, dgrams.FlagTCP_SYN, 1024, nil, nil))
+		ip = sent()
+		if ip.TTL != dgrams.DefaultTTL || ip.ToS != 0 || !ip.Flags.DontFragment() {
+			t.Fatalf("RST sent with TTL %d, ToS %#x and flags %#x", ip.TTL, ip.ToS, ip.Flags)
+		}
+		ids = append(ids, ip.ID)
+	}
+	if ids[1] != ids[0]+1 {
+		t.Fatal("expected consecutive IDs to the same destination, got", ids)
+	}
+
+	// Fragmentation allowed by the stack configuration.
+	st, err = tcpctl.NewStack(tcpctl.StackConfig{
+		Addr: net.IPv4(192, 168, 1, 5),
+		IPv4: dgrams.IPv4Sender{TTL: 100, DF: dgrams.DFNever},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Tick(time.Now())
+	st.RecvTCP(tcpPacketPorts(58920, 81, 1000, 0, dgrams.FlagTCP_SYN, 1024, nil, nil))
+	if ip = sent(); ip.TTL != 100 || ip.Flags.DontFragment() {
+		t.Fatalf("RST sent with TTL %d and flags %#x", ip.TTL, ip.Flags)
+	}
+}
+
+// withIPOptions returns the TCP+IPv4 packet pkt with an IP header carrying 4 octets of options.
+func withIPOptions(pkt []byte) []byte {
+	buf := make([]byte, len(pkt)+4)
+	copy(buf, pkt[:dgrams.SizeIPHeader])
+	copy(buf[dgrams.SizeIPHeader:], []byte{1, 1, 1, 0}) // No-Operation and End of Option List.
+	copy(buf[dgrams.SizeIPHeader+4:], pkt[dgrams.SizeIPHeader:])
+	buf[0] = 4<<4 | 6
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	setChecksums(buf)
+	return buf
+}
+
+func TestStackIPOptions(t *testing.T) {
+	const seq = 1000
+	st := newTestStack(t, 2)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	// The TCP header follows the IP options.
+	pkt := withIPOptions(tcpPacketPorts(58920, 81, seq, 5000, dgrams.FlagTCP_ACK, 1024, nil, []byte("data")))
+	if _, _, err := st.RecvTCP(pkt); err == nil {
+		t.Fatal("expected error for segment matching no socket")
+	}
+	n, err := st.SendTCP(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected RST to be sent", err)
+	}
+	rst := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n])
+	if rst.Flags() != dgrams.FlagTCP_RST || rst.Seq != 5000 || rst.SourcePort != 81 || rst.DestinationPort != 58920 {
+		t.Fatalf("got %s seq=%d from port %d to %d", rst.Flags(), rst.Seq, rst.SourcePort, rst.DestinationPort)
+	}
+	if _, _, err := st.RecvTCP(withIPOptions(tcpPacket(seq, 0, dgrams.FlagTCP_SYN, 1024, nil, nil))); err != nil {
+		t.Fatal(err)
+	}
+	if synack := pollTCP(t, st, buf[:]); synack.Flags() != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK || synack.Ack != seq+1 {
+		t.Fatalf("expected SYN-ACK to SYN with IP options, got %s ack=%d", synack.Flags(), synack.Ack)
+	}
+
+	// Header lengths shorter than the minimum or exceeding the datagram are dropped silently.
+	for _, ihl := range []byte{4, 15} {
+		pkt := tcpPacketPorts(58920, 81, seq, 5000, dgrams.FlagTCP_ACK, 1024, nil, nil)
+		pkt[0] = 4<<4 | ihl
+		if _, _, err := st.RecvTCP(pkt); err == nil {
+			t.Fatalf("IHL %d: expected error", ihl)
+		}
+		if n, _ := st.SendTCP(buf[:]); n != 0 {
+			t.Fatalf("IHL %d: expected no RST to be sent", ihl)
+		}
+	}
+}
+
+// fixedClock is a Clock stopped at a point in time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestStackDeadlineClock(t *testing.T) {
+	now := time.Now().Add(time.Hour)
+	st, err := tcpctl.NewStack(tcpctl.StackConfig{
+		Addr:       net.IPv4(192, 168, 1, 5),
+		MaxSockets: 1,
+		Clock:      fixedClock(now),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := newTestSocket(t, st)
+	var buf [16]byte
+	// Deadlines are on the clock of the stack, not the system clock.
+	if _, err := st.Recv(fd, buf[:], 0, now.Add(-time.Minute)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline before the stack clock to be exceeded, got", err)
+	}
+	if _, err := st.Send(fd, []byte("x"), 0, now.Add(-time.Minute)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline before the stack clock to be exceeded, got", err)
+	}
+}
@@ -0,0 +1,136 @@
+package tcpctl
+
+// Stats contains counters of the segments and connections of a socket or stack
+// modelled after the Tcp and Ip groups of Linux's /proc/net/snmp. Counters of
+// a Stack include those of all its sockets.
+type Stats struct {
+	// ActiveOpens is the number of connections opened with Connect.
+	ActiveOpens uint64
+	// PassiveOpens is the number of connections opened by a connection request
+	// received in LISTEN.
+	PassiveOpens uint64
+	// AttemptFails is the number of connections which failed or were reset
+	// during the handshake, returning to CLOSED or LISTEN.
+	AttemptFails uint64
+	// EstabResets is the number of connections aborted in ESTABLISHED or CLOSE-WAIT.
+	EstabResets uint64
+	// CurrEstab is the number of connections in ESTABLISHED or CLOSE-WAIT.
+	CurrEstab uint64
+	// InSegs is the number of segments received, including malformed ones but
+	// not those dropped for a bad checksum, which are counted by InCsumErrors.
+	InSegs uint64
+	// OutSegs is the number of segments sent, excluding retransmissions.
+	OutSegs uint64
+	// RetransSegs is the number of segments retransmitted.
+	RetransSegs uint64
+	// InErrs is the number of segments received in error, i.e. malformed or
+	// with a bad checksum.
+	InErrs uint64
+	// InCsumErrors is the number of segments received with a bad checksum.
+	InCsumErrors uint64
+	// InHdrErrors is the number of IPv4 datagrams received with a malformed
+	// header or a bad header checksum.
+	InHdrErrors uint64
+	// OutOfWindow is the number of segments received outside the receive
+	// window, which are dropped.
+	OutOfWindow uint64
+	// OutRsts is the number of segments sent with the RST flag.
+	OutRsts uint64
+	// ARPHits and ARPMisses count the Ethernet frames sent by a Stack to a
+	// hardware address learned from a frame of the remote peer and to
+	// StackConfig.GatewayHardwareAddr respectively, since the stack does not
+	// resolve hardware addresses with ARP.
+	ARPHits, ARPMisses uint64
+	// ReasmFails is the number of IPv4 fragments received by a Stack, which
+	// does not reassemble datagrams and drops them.
+	ReasmFails uint64
+}
+
+// add adds the counters of o to s, except for gauges.
+func (s *Stats) add(o *Stats) {
+	s.ActiveOpens += o.ActiveOpens
+	s.PassiveOpens += o.PassiveOpens
+	s.AttemptFails += o.AttemptFails
+	s.EstabResets += o.EstabResets
+	s.InSegs += o.InSegs
+	s.OutSegs += o.OutSegs
+	s.RetransSegs += o.RetransSegs
+	s.InErrs += o.InErrs
+	s.InCsumErrors += o.InCsumErrors
+	s.InHdrErrors += o.InHdrErrors
+	s.OutOfWindow += o.OutOfWindow
+	s.OutRsts += o.OutRsts
+	s.ARPHits += o.ARPHits
+	s.ARPMisses += o.ARPMisses
+	s.ReasmFails += o.ReasmFails
+}
+
+// Stats returns a snapshot of the counters of the socket since it was created.
+func (s *Socket) Stats() Stats {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	stats := s.cs.stats
+	if s.cs.state == StateEstablished || s.cs.state == StateCloseWait {
+		stats.CurrEstab = 1
+	}
+	return stats
+}
+
+// countTransition counts the opening, failure or reset of the connection as it
+// moves from state from to state to. cs.mu must be held.
+func (cs *connState) countTransition(from, to State) {
+	switch {
+	case from == StateClosed && to == StateSynSent:
+		cs.stats.ActiveOpens++
+	case from == StateListen && to == StateSynRcvd:
+		cs.stats.PassiveOpens++
+	case (from == StateSynSent || from == StateSynRcvd) && (to == StateClosed || to == StateListen):
+		cs.stats.AttemptFails++
+	case (from == StateEstablished || from == StateCloseWait) && to == StateClosed:
+		cs.stats.EstabResets++
+	}
+}
+
+// countRxError counts a malformed segment received, which does not reach the connection.
+func (s *Socket) countRxError() {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.stats.InSegs++
+	s.cs.stats.InErrs++
+}
+
+// Stats returns a snapshot of the counters of the stack, which include those
+// of its sockets and of connections they had.
+func (st *Stack) Stats() Stats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := st.stats
+	for i := range st.sockets {
+		s := st.sockets[i].Stats()
+		stats.add(&s)
+		stats.CurrEstab += s.CurrEstab
+	}
+	return stats
+}
+
+// SocketStats returns a snapshot of the counters of the socket of sockfd
+// since the descriptor was opened or the connection was spawned by a
+// listening socket, see Socket.Stats.
+func (st *Stack) SocketStats(sockfd int) (Stats, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, err := st.slot(sockfd); err != nil {
+		return Stats{}, err
+	}
+	return st.sockets[sockfd].Stats(), nil
+}
+
+// countARP counts an Ethernet frame sent to a hardware address learned from the
+// remote peer if learned is set, or to the gateway otherwise. st.mu must be held.
+func (st *Stack) countARP(learned bool) {
+	if learned {
+		st.stats.ARPHits++
+	} else {
+		st.stats.ARPMisses++
+	}
+}
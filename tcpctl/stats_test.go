@@ -0,0 +1,83 @@
+package tcpctl_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+func TestSocketStats(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(0, 0)
+	s.Tick(now)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	// SYN-ACK is lost and retransmitted.
+	s.Tick(now.Add(time.Second))
+	sendTCP(t, &s, buf[:])
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	s.RecvTCP(tcpPacket(irs+1+1<<20, iss+1, dgrams.FlagTCP_ACK, 100, nil, []byte("x")))
+	got := s.Stats()
+	want := tcpctl.Stats{PassiveOpens: 1, CurrEstab: 1, InSegs: 3, OutSegs: 1, RetransSegs: 1, OutOfWindow: 1}
+	if got != want {
+		t.Fatalf("got stats\n%+v\nwant\n%+v", got, want)
+	}
+	s.RecvTCP(tcpPacket(irs+1, iss+1, dgrams.FlagTCP_RST, 100, nil, nil))
+	got = s.Stats()
+	want.InSegs++
+	want.CurrEstab = 0
+	want.EstabResets = 1
+	if got != want {
+		t.Fatalf("got stats after reset\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestStackStats(t *testing.T) {
+	st := newTestStack(t, 2)
+	var buf [1500]byte
+	lfd := newTestSocket(t, st)
+	st.Bind(lfd, nil, 80)
+	st.Listen(lfd, 1)
+	if _, _, err := st.RecvEthernet(packetSyn); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := st.SendEthernet(buf[:]); n == 0 {
+		t.Fatal("expected SYN-ACK")
+	}
+	// Segment matching no socket is answered with a RST to the gateway.
+	if _, _, err := st.RecvTCP(tcpPacketPorts(58921, 81, 1, 1, dgrams.FlagTCP_ACK, 100, nil, nil)); err == nil {
+		t.Fatal("expected error for segment matching no socket")
+	}
+	if n, _ := st.SendEthernet(buf[:]); n == 0 {
+		t.Fatal("expected RST")
+	}
+	frag := tcpPacket(irsEstablished+1, 1, dgrams.FlagTCP_ACK, 100, nil, []byte("fragment"))
+	frag[7] = 1 // Last fragment of a datagram, 8 octets in.
+	if _, _, err := st.RecvTCP(frag); err == nil {
+		t.Fatal("expected fragment to be dropped")
+	}
+	got := st.Stats()
+	want := tcpctl.Stats{
+		PassiveOpens: 1,
+		InSegs:       2,
+		OutSegs:      2,
+		OutRsts:      1,
+		ARPHits:      1,
+		ARPMisses:    1,
+		ReasmFails:   1,
+	}
+	if got != want {
+		t.Fatalf("got stats\n%+v\nwant\n%+v", got, want)
+	}
+	if _, err := st.SocketStats(lfd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SocketStats(1); err == nil {
+		t.Fatal("expected error for connection not yet accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package tcpctl
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/internal/siphash"
+)
+
+const (
+	// cookiePeriod is the period of the time counter encoded in SYN cookies.
+	cookiePeriod = 64 * time.Second
+	// cookieMaxAge is the number of periods a SYN cookie stays valid after the
+	// period it was sent in, so a cookie is accepted for 64 to 128 seconds.
+	cookieMaxAge = 1
+)
+
+// cookieMSS are the MSS values a SYN cookie can encode, indexed by 3 bits.
+// The MSS of the remote peer is rounded down to one of them.
+var cookieMSS = [8]uint16{defaultMSS, 1024, 1200, 1300, 1360, 1400, 1440, 1460}
+
+// synCookie returns the initial sequence number of a SYN-ACK answering the
+// connection request from the remote peer of k with initial sequence number irs
+// without keeping state, as described in RFC 4987 section 3.6. The connection is
+// established once the final ACK of the handshake acknowledges a valid cookie,
+// see checkSynCookie. The 32 bits of the cookie are laid out as follows:
+//
+//	| 5 bit time counter | 3 bit MSS index | 24 bit MAC of k, irs, time counter and MSS index |
+//
+// Since only the MSS is encoded, other options of the SYN are not used.
+func synCookie(key *[16]byte, now time.Time, k demuxKey, irs Seq, mss uint16) Seq {
+	t := cookieTime(now)
+	m := 0
+	for m < len(cookieMSS)-1 && cookieMSS[m+1] <= mss {
+		m++
+	}
+	return Seq(t<<27 | uint32(m)<<24 | cookieMAC(key, k, irs, t, uint32(m)))
+}
+
+// checkSynCookie validates the cookie acknowledged by the final ACK of a handshake
+// answered with synCookie and returns the MSS of the remote peer it encodes.
+func checkSynCookie(key *[16]byte, now time.Time, k demuxKey, irs, cookie Seq) (mss uint16, ok bool) {
+	t, m := uint32(cookie)>>27, uint32(cookie)>>24&0b111
+	age := (cookieTime(now) - t) & 0x1f
+	if age > cookieMaxAge || uint32(cookie)&0xffffff != cookieMAC(key, k, irs, t, m) {
+		return 0, false
+	}
+	return cookieMSS[m], true
+}
+
+// cookieTime returns the time counter of SYN cookies sent at now.
+func cookieTime(now time.Time) uint32 {
+	return uint32(now.Unix()/int64(cookiePeriod/time.Second)) & 0x1f
+}
+
+// cookieMAC returns the message authentication code of a SYN cookie with time
+// counter t and MSS index m, which are covered so that they can not be forged.
+func cookieMAC(key *[16]byte, k demuxKey, irs Seq, t, m uint32) uint32 {
+	var buf [16]byte
+	binary.BigEndian.PutUint16(buf[0:], k.port)
+	binary.BigEndian.PutUint16(buf[2:], k.rport)
+	copy(buf[4:8], k.rip[:])
+	binary.BigEndian.PutUint32(buf[8:], uint32(irs))
+	binary.BigEndian.PutUint32(buf[12:], t<<3|m)
+	return uint32(siphash.Hash24(key, buf[:])) & 0xffffff
+}
+
+// cookieRcv moves the listening socket to SYN-RECEIVED as if it had answered
+// the SYN of the remote peer sending the segment hdr with a SYN-ACK of sequence
+// number iss, for hdr to complete the handshake answered with a SYN cookie.
+// mss is the MSS of the remote peer encoded in the cookie.
+func (s *Socket) cookieRcv(ip *dgrams.IPv4Header, hdr *dgrams.TCPHeader, iss Seq, mss uint16) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.them = net.TCPAddr{IP: append(s.them.IP[:0], ip.Source[:]...), Port: int(hdr.SourcePort)}
+	s.initConn()
+	s.cs.snd.iss = iss
+	s.cs.snd.UNA = iss
+	s.cs.snd.NXT = iss.Add(1)
+	s.cs.smallEnd = iss
+	syn := dgrams.TCPHeader{Seq: hdr.Seq - 1, WindowSize: hdr.WindowSize}
+	s.synRcv(&syn, &tcpOptions{hasMSS: true, mss: mss})
+	s.cs.setState(StateSynRcvd)
+}
@@ -0,0 +1,41 @@
+package tcpctl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSynCookie(t *testing.T) {
+	key := [16]byte{1, 2, 3}
+	k := demuxKey{port: 80, rport: 58920, rip: [4]byte{192, 168, 1, 112}}
+	const irs = 0xfffffff0
+	now := time.Unix(1_700_000_000, 0)
+	for _, test := range []struct {
+		mss, want uint16
+	}{
+		{mss: 0, want: defaultMSS},
+		{mss: 1460, want: 1460},
+		{mss: 9000, want: 1460},
+		{mss: 1399, want: 1360},
+	} {
+		cookie := synCookie(&key, now, k, irs, test.mss)
+		mss, ok := checkSynCookie(&key, now.Add(cookiePeriod), k, irs, cookie)
+		if !ok || mss != test.want {
+			t.Errorf("MSS %d: got %d %v, want %d", test.mss, mss, ok, test.want)
+		}
+	}
+	cookie := synCookie(&key, now, k, irs, 1460)
+	if _, ok := checkSynCookie(&key, now.Add(2*cookiePeriod), k, irs, cookie); ok {
+		t.Error("expected expired cookie to be rejected")
+	}
+	if _, ok := checkSynCookie(&key, now, k, irs+1, cookie); ok {
+		t.Error("expected cookie of another ISN to be rejected")
+	}
+	if _, ok := checkSynCookie(&key, now, k, irs, cookie^1<<24); ok {
+		t.Error("expected cookie with another MSS index to be rejected")
+	}
+	k.rport++
+	if _, ok := checkSynCookie(&key, now, k, irs, cookie); ok {
+		t.Error("expected cookie of another connection to be rejected")
+	}
+}
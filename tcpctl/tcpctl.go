@@ -1,11 +1,13 @@
 package tcpctl
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"time"
 
 	"github.com/soypat/dgrams"
 )
@@ -50,18 +52,290 @@ const (
 	StateLastAck
 )
 
+const (
+	// defaultMSS is the maximum segment size assumed for the remote peer
+	// when none is advertised, as per RFC 879.
+	defaultMSS = 536
+	// minPeerMSS is the smallest MSS of the remote peer honoured, that of Linux.
+	// It leaves room for 40 bytes of TCP options and some data, peers
+	// advertising less are sent segments of minPeerMSS bytes.
+	minPeerMSS = 88
+	// defaultBufferSize is the size of the send and receive buffers allocated
+	// for a connection when none are provided by the user.
+	defaultBufferSize = 2048
+	// sizeTCPIPv4 is the size of TCP and IPv4 headers without options.
+	sizeTCPIPv4 = dgrams.SizeIPHeader + dgrams.SizeTCPHeaderNoOptions
+	// TCP words are 4 octets, header length is measured in words.
+	tcpWordlen = 4
+)
+
 type Socket struct {
-	cs        connState
-	us        net.TCPAddr
-	them      net.TCPAddr
-	staticBuf [1504]byte
+	cs   connState
+	us   net.TCPAddr
+	them net.TCPAddr
+	// Hardware addresses learned from the last Ethernet frame received.
+	ethUs   [6]byte
+	ethThem [6]byte
+	isn     *ISNGenerator
+	noSACK  bool
+	noWS    bool
+	noTS    bool
+	cc      CongestionControl
+	// mtu is the link MTU, zero for the default of 1500.
+	mtu       uint16
+	noPLPMTUD bool
+	// ethLearned is set once the hardware addresses were learned from a frame received.
+	ethLearned bool
+	// csum is how packets received with a bad checksum are handled.
+	csum ChecksumPolicy
+	// ipv4 writes the IPv4 header of packets sent.
+	ipv4 dgrams.IPv4Sender
 }
 
 func (s *Socket) Listen() {
-	s.cs.SetState(StateListen)
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.setConnID()
+	s.cs.setState(StateListen)
+}
+
+// Connect starts opening a connection from local to remote by sending a SYN.
+// It does not block, the connection is established once the remote peer
+// answers. Options enabled on the socket are offered to the remote peer and
+// used if it supports them too. Tick must have been called beforehand.
+func (s *Socket) Connect(local, remote *net.TCPAddr) error {
+	lip, rip := local.IP.To4(), remote.IP.To4()
+	if lip == nil || rip == nil {
+		return errors.New("support only IPv4")
+	}
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	if s.cs.state != StateClosed {
+		return errors.New("connect on socket in state " + s.cs.state.String())
+	}
+	s.us = net.TCPAddr{IP: append(s.us.IP[:0], lip...), Port: local.Port}
+	s.them = net.TCPAddr{IP: append(s.them.IP[:0], rip...), Port: remote.Port}
+	s.initConn()
+	// Offer the options enabled, they are negotiated once the SYN-ACK arrives.
+	s.cs.wsOK = !s.noWS
+	if s.cs.wsOK {
+		s.cs.rcv.shift = wsShift(s.cs.rcvBuf.Size())
+	}
+	s.cs.sackOK = !s.noSACK
+	s.cs.ts = tsState{ok: !s.noTS, offset: uint32(s.cs.snd.iss)}
+	s.cs.updateRcvWindow()
+	s.cs.pendingCtlFrame = dgrams.FlagTCP_SYN
+	s.cs.setState(StateSynSent)
+	return nil
+}
+
+// State returns the current state of the connection.
+func (s *Socket) State() State { return s.cs.State() }
+
+// SetMaxRetries sets the number of times a segment is retransmitted before
+// the connection is aborted. Zero value sets the default of 15 retries.
+func (s *Socket) SetMaxRetries(n uint8) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.rtx.maxRetries = n
+}
+
+// Tick advances the socket's notion of time to now and processes expired
+// timers, such as the retransmission timer. It should be called periodically
+// by the user, i.e. on every iteration of the loop driving the network
+// interface, followed by calls to SendTCP or SendEthernet to flush segments.
+// Tick returns an error if the connection was aborted due to a timeout.
+func (s *Socket) Tick(now time.Time) error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	s.cs.now = now
+	if s.cs.state == StateClosed || s.cs.state == StateListen {
+		return nil
+	}
+	s.cs.timeWaitTick(now)
+	expired, err := s.cs.rtx.tick(now)
+	if err != nil {
+		s.cs.abort(err)
+		return err
+	}
+	if expired {
+		s.cs.rtoExpired()
+	}
+	s.cs.delackTick(now)
+	err = s.cs.keepAliveTick(now)
+	if err == nil {
+		err = s.cs.persistTick(now)
+	}
+	if err != nil {
+		s.cs.abort(err)
+		return err
+	}
+	return nil
+}
+
+// nextTimeout returns the time Tick must be called at for the timers of the
+// connection to expire on time, zero if no timer is running. It is earlier than
+// any timer expires if a timer is to be started by Tick. cs.mu must be held.
+func (cs *connState) nextTimeout() time.Time {
+	if cs.state == StateClosed || cs.state == StateListen {
+		return time.Time{}
+	}
+	var next time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	earliest(cs.rtx.deadline)
+	earliest(cs.delack.deadline)
+	if cs.state == StateTimeWait {
+		earliest(cs.timeWait)
+	}
+	if due, ok := cs.keepAliveDue(); ok {
+		earliest(due)
+	}
+	if !cs.persist.deadline.IsZero() {
+		earliest(cs.persist.deadline)
+	} else if cs.persistNeeded() {
+		earliest(cs.now) // Started by Tick.
+	}
+	return next
+}
+
+// SetKeepAlive sets the keepalive parameters of the socket. When enabled, probes
+// are sent after the connection has been idle for cfg.Idle and every cfg.Interval
+// thereafter until the remote peer answers. The connection is aborted after
+// cfg.Count unanswered probes. Keepalives keep NAT and firewall state alive
+// and detect peers which disappeared without closing the connection.
+func (s *Socket) SetKeepAlive(cfg KeepAliveConfig) {
+	if cfg.Idle <= 0 {
+		cfg.Idle = defaultKeepAliveIdle
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultKeepAliveInterval
+	}
+	if cfg.Count <= 0 {
+		cfg.Count = defaultKeepAliveCount
+	}
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.keepalive.cfg = cfg
+}
+
+// SetNoDelay disables Nagle's algorithm when noDelay is true, like TCP_NODELAY.
+// By default small writes are coalesced while previously sent data is not yet
+// acknowledged, which reduces the number of small segments sent.
+func (s *Socket) SetNoDelay(noDelay bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.nodelay = noDelay
 }
 
+// SetQuickAck disables delayed acknowledgments when quickAck is true, like
+// TCP_QUICKACK. By default acknowledgments of data received are delayed up to
+// 200ms unless two full sized segments are received in the meantime.
+func (s *Socket) SetQuickAck(quickAck bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.delack.quick = quickAck
+	if quickAck && !s.cs.delack.deadline.IsZero() {
+		s.cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	}
+}
+
+// SetCongestionControl sets the congestion control algorithm used by new
+// connections. The algorithm keeps per-connection state so it must not be shared
+// between sockets. If never called or called with nil NewReno is used.
+func (s *Socket) SetCongestionControl(cc CongestionControl) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cc = cc
+}
+
+// SetSACK enables or disables selective acknowledgments (RFC 2018) for
+// new connections. SACK is enabled by default and used if the remote peer
+// sends the SACK-permitted option in its SYN.
+func (s *Socket) SetSACK(enable bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.noSACK = !enable
+}
+
+// SetWindowScaling enables or disables the Window Scale option (RFC 7323)
+// for new connections. It is enabled by default and allows advertising receive
+// windows larger than 64kB if the remote peer sends the option in its SYN.
+func (s *Socket) SetWindowScaling(enable bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.noWS = !enable
+}
+
+// SetTimestamps enables or disables the Timestamps option (RFC 7323) for new
+// connections. It is enabled by default and used for RTT measurement and
+// protection against wrapped sequence numbers if the remote peer sends
+// the option in its SYN.
+func (s *Socket) SetTimestamps(enable bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.noTS = !enable
+}
+
+// SetISNGenerator sets the generator used to choose the initial sequence number
+// of new connections. If never called or called with nil a package level
+// generator keyed with crypto/rand is used.
+func (s *Socket) SetISNGenerator(g *ISNGenerator) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.isn = g
+}
+
+// SetIPv4Sender sets how the IPv4 header of packets sent is written: their
+// TTL, DSCP, Don't Fragment flag and the generator of their IDs. Clearing the
+// Don't Fragment flag disables ICMP based Path MTU Discovery. Default is the
+// zero dgrams.IPv4Sender.
+func (s *Socket) SetIPv4Sender(ipv4 dgrams.IPv4Sender) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.ipv4 = ipv4
+}
+
+// SetMTU sets the MTU of the link the socket sends on, which is the largest IP
+// datagram it can carry. The MSS advertised to the remote peer is derived from it.
+// It must be called before the connection is established. Default is 1500.
+func (s *Socket) SetMTU(mtu uint16) error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	if s.cs.state != StateClosed && s.cs.state != StateListen {
+		return errors.New("MTU must be set before connection is established")
+	}
+	if mtu < pmtuMin {
+		return errors.New("MTU too small")
+	}
+	s.mtu = mtu
+	return nil
+}
+
+// SetPLPMTUD enables or disables Packetization Layer Path MTU Discovery (RFC 4821)
+// for new connections. It is enabled by default and takes over from ICMP based
+// Path MTU Discovery when repeated timeouts of large segments suggest ICMP
+// messages are being filtered, probing the path with segments of increasing size.
+func (s *Socket) SetPLPMTUD(enable bool) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.noPLPMTUD = !enable
+}
+
+// RecvEthernet processes an Ethernet frame in buf carrying a TCP segment over
+// IPv4, learning the hardware addresses of the connection from it. See RecvTCP.
 func (s *Socket) RecvEthernet(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	return s.recvEthernet(buf, false)
+}
+
+// recvEthernet is RecvEthernet for a frame whose checksums were already
+// verified if verified is set.
+func (s *Socket) recvEthernet(buf []byte, verified bool) (payloadStart, payloadEnd uint16, err error) {
 	buflen := uint16(len(buf))
 	switch {
 	case len(buf) > math.MaxUint16:
@@ -80,14 +354,28 @@ func (s *Socket) RecvEthernet(buf []byte) (payloadStart, payloadEnd uint16, err
 	if eth.SizeOrEtherType != uint16(dgrams.EtherTypeIPv4) {
 		return 0, 0, errors.New("support only IPv4")
 	}
-	payloadStart, payloadEnd, err = s.RecvTCP(buf[dgrams.SizeEthernetHeaderNoVLAN:])
+	payloadStart, payloadEnd, err = s.recvTCP(buf[dgrams.SizeEthernetHeaderNoVLAN:], verified)
 	if err != nil {
 		return 0, 0, err
 	}
+	s.cs.mu.Lock()
+	s.ethUs = eth.Destination
+	s.ethThem = eth.Source
+	s.ethLearned = true
+	s.cs.mu.Unlock()
 	return payloadStart + dgrams.SizeEthernetHeaderNoVLAN, payloadEnd + dgrams.SizeEthernetHeaderNoVLAN, nil
 }
 
+// RecvTCP processes a TCP segment over IPv4 in buf starting with its IPv4 header
+// and returns the bounds of its payload in buf. The IPv4 header and TCP
+// checksums are verified following the checksum policy of the socket.
 func (s *Socket) RecvTCP(buf []byte) (payloadStart, payloadEnd uint16, err error) {
+	return s.recvTCP(buf, false)
+}
+
+// recvTCP is RecvTCP for a packet whose checksums were already verified if
+// verified is set.
+func (s *Socket) recvTCP(buf []byte, verified bool) (payloadStart, payloadEnd uint16, err error) {
 	buflen := uint16(len(buf))
 	ip := dgrams.DecodeIPv4Header(buf[:])
 	payloadEnd = ip.TotalLength
@@ -95,125 +383,680 @@ func (s *Socket) RecvTCP(buf []byte) (payloadStart, payloadEnd uint16, err error
 		return 0, 0, fmt.Errorf("IP.TotalLength exceeds buffer size %d/%d", payloadEnd, buflen)
 	}
 	if ip.Protocol != 6 { // Ensure TCP protocol.
-		// fmt.Printf("%+v\n%s\n", ip, ip.String())
 		return 0, 0, fmt.Errorf("expected TCP protocol (6) in IP.Proto field; got %d", ip.Protocol)
 	}
-	if ip.IHL != 0 {
-		return 0, 0, errors.New("expected IP.IHL to be zero")
+	if ip.Version != 4 {
+		return 0, 0, errors.New("expected IPv4 header")
+	}
+	// The TCP header follows the options of the IP header, if any.
+	ihl := uint16(ip.IHL) * 4
+	if ihl < dgrams.SizeIPHeader || ihl > payloadEnd || ihl+dgrams.SizeTCPHeaderNoOptions > buflen {
+		return 0, 0, fmt.Errorf("bad IP header length %d", ihl)
 	}
-	tcp := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+	if !verified {
+		if err = s.verifyChecksums(buf); err != nil {
+			return 0, 0, err
+		}
+	}
+	tcp := dgrams.DecodeTCPHeader(buf[ihl:])
 	nb := tcp.OffsetInBytes()
 	if nb < 20 {
+		s.countRxError()
 		return 0, 0, errors.New("garbage TCP.Offset")
 	}
-	payloadStart = nb + dgrams.SizeIPHeader
+	payloadStart = nb + ihl
 	if payloadStart > buflen {
+		s.countRxError()
 		return 0, 0, fmt.Errorf("malformed packet, got payload offset %d/%d", payloadStart, buflen)
 	}
-	err = s.rx(&tcp)
-	if err != nil {
+	tcpOptions := buf[ihl+dgrams.SizeTCPHeaderNoOptions : payloadStart]
+	payload := buf[payloadStart:payloadEnd]
+	rxErr := s.rx(&ip, &tcp, tcpOptions, payload)
+	if rxErr != nil {
+		s.logDrop(&tcp, rxErr)
+		return 0, 0, rxErr
+	}
+	return payloadStart, payloadEnd, nil
+}
+
+// RecvICMP processes an ICMPv4 packet in buf starting with its IPv4 header.
+// Fragmentation Needed messages about a segment in flight on the connection
+// lower the path MTU as described by RFC 1191. Other messages are ignored.
+func (s *Socket) RecvICMP(buf []byte) error {
+	const quoted = dgrams.SizeIPHeader + dgrams.SizeICMPv4Header
+	if len(buf) < quoted+dgrams.SizeIPHeader+8 {
+		return errors.New("buffer too short to contain ICMP error")
+	}
+	ip := dgrams.DecodeIPv4Header(buf)
+	if ip.Protocol != 1 {
+		return fmt.Errorf("expected ICMP protocol (1) in IP.Proto field; got %d", ip.Protocol)
+	}
+	if err := s.verifyChecksums(buf); err != nil {
+		return err
+	}
+	icmp := dgrams.DecodeICMPv4Header(buf[dgrams.SizeIPHeader:])
+	if icmp.Type != dgrams.ICMPv4DestinationUnreachable || icmp.Code != dgrams.ICMPv4CodeFragmentationNeeded {
+		return nil
+	}
+	// The message quotes the IP header and first 8 octets of the segment sent.
+	orig := buf[quoted:]
+	ihl := int(orig[0]&0xf) * 4
+	if ihl < dgrams.SizeIPHeader || len(orig) < ihl+8 {
+		return errors.New("malformed datagram in ICMP error")
+	}
+	origIP := dgrams.DecodeIPv4Header(orig)
+	srcPort := binary.BigEndian.Uint16(orig[ihl:])
+	dstPort := binary.BigEndian.Uint16(orig[ihl+2:])
+	seq := Seq(binary.BigEndian.Uint32(orig[ihl+4:]))
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	// Check the quoted segment is in flight to protect against forged messages (RFC 5927).
+	if origIP.Protocol != 6 || int(srcPort) != s.us.Port || int(dstPort) != s.them.Port ||
+		!s.us.IP.Equal(origIP.Source[:]) || !s.them.IP.Equal(origIP.Destination[:]) ||
+		seq.LessThan(s.cs.snd.UNA) || !seq.LessThan(s.cs.snd.NXT) {
+		return errors.New("ICMP error does not match a segment in flight")
+	}
+	s.cs.pmtuReduce(icmp.NextHopMTU(), origIP.TotalLength)
+	return nil
+}
+
+// SendEthernet writes the next pending Ethernet frame to dst and returns the
+// number of bytes written. n is zero if there is no frame pending.
+// Hardware addresses are those of the last frame received with RecvEthernet.
+func (s *Socket) SendEthernet(dst []byte) (n int, err error) {
+	n, _, err = s.sendEthernet(dst, false)
+	return n, err
+}
+
+// sendEthernet is SendEthernet for a device offloading checksums and
+// segmentation if offload is set, see sendTCP.
+func (s *Socket) sendEthernet(dst []byte, offload bool) (n, mss int, err error) {
+	if len(dst) < dgrams.SizeEthernetHeaderNoVLAN {
+		return 0, 0, io.ErrShortBuffer
+	}
+	n, mss, err = s.sendTCP(dst[dgrams.SizeEthernetHeaderNoVLAN:], offload)
+	if err != nil || n == 0 {
 		return 0, 0, err
 	}
-	if s.cs.pendingCtlFrame == 0 {
-		return payloadStart, payloadEnd, nil
+	s.cs.mu.Lock()
+	eth := dgrams.EthernetHeader{
+		Destination:     s.ethThem,
+		Source:          s.ethUs,
+		SizeOrEtherType: uint16(dgrams.EtherTypeIPv4),
+	}
+	s.cs.mu.Unlock()
+	eth.Put(dst)
+	return n + dgrams.SizeEthernetHeaderNoVLAN, mss, nil
+}
+
+// SendTCP writes the next pending TCP+IPv4 packet to dst and returns the
+// number of bytes written. n is zero if there is no packet pending.
+// Segments due for retransmission are sent before new segments, and
+// control segments are sent before data buffered with Write.
+func (s *Socket) SendTCP(dst []byte) (n int, err error) {
+	n, _, err = s.sendTCP(dst, false)
+	return n, err
+}
+
+// sendTCP is SendTCP for a device offloading checksums and segmentation if
+// offload is set: the TCP checksum of the packet written only covers the
+// pseudo-header and new data is sent in a single packet as large as dst allows,
+// which the device splits into segments of mss bytes of data. mss is zero if
+// the packet needs not be split.
+func (s *Socket) sendTCP(dst []byte, offload bool) (n, mss int, err error) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	now := s.cs.now
+	var optBuf [40]byte
+	if s.cs.pendingCtlFrame.HasFlags(dgrams.FlagTCP_RST) {
+		// Reset <SEQ=SEG.ACK><CTL=RST> of a segment received, sent ahead of
+		// anything else and never retransmitted.
+		n, err = s.writeSegment(dst, s.cs.rstSeq, dgrams.FlagTCP_RST, nil, 0, offload)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.cs.pendingCtlFrame &^= dgrams.FlagTCP_RST
+		s.cs.stats.OutSegs++
+		s.cs.stats.OutRsts++
+		s.logSent(EventSend, dst[:n])
+		return n, 0, nil
+	}
+	if seg := s.cs.rtx.nextLost(); seg != nil && s.cs.canRetransmit() {
+		opts := s.cs.appendOptions(optBuf[:0], seg.flags)
+		datalen := seg.len - segLen(seg.flags, nil)
+		if max := s.cs.maxSegment() - uint32(len(opts)); datalen > max && s.cs.rtx.split(seg, max) {
+			// Path MTU decreased since the segment was sent.
+			datalen = max
+		}
+		n, err = s.writeSegment(dst, seg.seq, seg.flags, opts, datalen, offload)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.cs.rtx.retransmitted(seg, now)
+		s.cs.stats.RetransSegs++
+		s.logSent(EventRetransmit, dst[:n])
+		return n, 0, nil
+	}
+	if s.cs.pendingProbe {
+		s.cs.pendingProbe = false
+		if s.cs.sendable(1) == 0 {
+			// Keepalive and zero window probes carry an old sequence number
+			// so that the remote peer answers with an ACK (RFC 1122 4.2.3.6).
+			opts := s.cs.appendOptions(optBuf[:0], dgrams.FlagTCP_ACK)
+			n, err = s.writeSegment(dst, s.cs.snd.UNA-1, dgrams.FlagTCP_ACK, opts, 0, offload)
+			if err != nil {
+				return 0, 0, err
+			}
+			s.cs.pendingCtlFrame &^= dgrams.FlagTCP_ACK
+			s.cs.stats.OutSegs++
+			s.logSent(EventSend, dst[:n])
+			return n, 0, nil
+		}
+	}
+	flags := s.cs.pendingCtlFrame
+	var datalen, probe uint32
+	var small bool
+	opts := s.cs.appendOptions(optBuf[:0], flags|dgrams.FlagTCP_ACK)
+	if hdrlen := sizeTCPIPv4 + len(opts); !flags.HasFlags(dgrams.FlagTCP_SYN) && len(dst) > hdrlen {
+		max := uint32(len(dst) - hdrlen)
+		optlen := uint32(len(opts))
+		full := s.cs.maxSegment() - optlen
+		seg := full
+		if free := uint32(s.cs.rtx.Free()); offload && free > 1 {
+			// The device splits the packet into as many full sized segments
+			// as the retransmission queue can track.
+			seg = free * full
+		}
+		if seg < max {
+			max = seg
+		}
+		// Probes for a larger path MTU are only sent if full of data (RFC 4821 section 7.4).
+		probe = s.cs.probeLen(optlen)
+		if probe > 0 && probe+uint32(hdrlen) <= uint32(len(dst)) && s.cs.sendable(probe) == probe {
+			max = probe
+		} else {
+			probe = 0
+		}
+		datalen = s.cs.sendable(max)
+		if probe == 0 && s.cs.nagle(datalen, full) {
+			datalen = 0
+		}
+		small = datalen > 0 && datalen < full
+		if probe == 0 && datalen > full {
+			mss = int(full)
+		}
+		if datalen > 0 {
+			flags |= dgrams.FlagTCP_ACK
+			if datalen == s.cs.unsent() {
+				flags |= dgrams.FlagTCP_PSH // Send buffer emptied.
+			}
+		}
+		if s.cs.closing && !s.cs.finSent && datalen == s.cs.unsent() &&
+			(s.cs.state == StateFinWait1 || s.cs.state == StateLastAck) {
+			// All data written by the user is sent, FIN follows it.
+			flags |= dgrams.FlagTCP_FIN | dgrams.FlagTCP_ACK
+		}
+	}
+	if flags == 0 {
+		return 0, 0, nil
+	}
+	if !flags.HasFlags(dgrams.FlagTCP_ACK) {
+		opts = s.cs.appendOptions(optBuf[:0], flags)
 	}
-	tcpOptions := buf[dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions : payloadStart]
-	gotSum := tcp.CalculateChecksumIPv4(&ip, tcpOptions, buf[payloadStart:payloadEnd])
-	if gotSum != tcp.Checksum {
-		fmt.Println("Checksum mismatch!")
+	seglen := datalen + segLen(flags, nil)
+	if seglen > 0 && s.cs.rtx.Full() {
+		return 0, 0, nil // Wait for acknowledgments to free up queue.
 	}
-	n, err := s.writeTCPIPv4(s.staticBuf[:], nil, nil)
+	n, err = s.writeSegment(dst, s.cs.snd.NXT, flags, opts, datalen, offload)
 	if err != nil {
 		return 0, 0, err
 	}
-	fmt.Printf("[success] Wrote %d bytes: %q\n\n", n, s.staticBuf[:n])
-	return payloadStart, payloadEnd, err
+	if seglen > 0 {
+		// Data and the SYN and FIN flags occupy sequence space and must be retransmitted if lost.
+		// A packet split by the device is tracked as the segments it is split into,
+		// the last one carrying the PSH and FIN flags.
+		seq, rest := s.cs.snd.NXT, datalen
+		for mss > 0 && rest > uint32(mss) {
+			s.cs.rtx.push(rtxSegment{seq: seq, len: uint32(mss), flags: flags &^ (dgrams.FlagTCP_FIN | dgrams.FlagTCP_PSH)}, now)
+			s.cs.stats.OutSegs++
+			seq, rest = seq.Add(uint32(mss)), rest-uint32(mss)
+		}
+		s.cs.rtx.push(rtxSegment{seq: seq, len: rest + segLen(flags, nil), flags: flags}, now)
+		if probe > 0 {
+			s.cs.probeSent(s.cs.snd.NXT, datalen, uint32(len(opts)))
+		} else if small {
+			s.cs.smallEnd = s.cs.snd.NXT.Add(datalen)
+		}
+		if flags.HasFlags(dgrams.FlagTCP_FIN) {
+			s.cs.finSent = true
+			s.cs.finSeq = s.cs.snd.NXT.Add(datalen)
+		}
+		s.cs.snd.NXT = s.cs.snd.NXT.Add(seglen)
+	}
+	s.cs.pendingCtlFrame = 0
+	s.cs.stats.OutSegs++
+	s.logSent(EventSend, dst[:n])
+	return n, mss, nil
+}
+
+// Write buffers b to be sent to the remote peer with subsequent calls to SendTCP
+// or SendEthernet. It does not block; if the send buffer has not enough free
+// space to hold b the number of bytes buffered is returned along with an error.
+func (s *Socket) Write(b []byte) (int, error) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	switch {
+	case s.cs.err != nil:
+		return 0, s.cs.err
+	case s.cs.closing:
+		return 0, errors.New("write on closed connection")
+	case s.cs.state != StateSynRcvd && s.cs.state != StateEstablished && s.cs.state != StateCloseWait:
+		return 0, errors.New("write on connection in state " + s.cs.state.String())
+	}
+	return s.cs.sndBuf.Write(b)
+}
+
+// Read reads data received from the remote peer into b. It does not block;
+// if no data is available it returns zero bytes read. Once all data has been
+// read and the remote peer closed the connection io.EOF is returned.
+func (s *Socket) Read(b []byte) (int, error) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	n, err := s.cs.rcvBuf.Read(b)
+	if n > 0 {
+		s.cs.updateRcvWindow()
+		return n, err
+	}
+	switch {
+	case len(b) == 0:
+	case s.cs.err != nil:
+		err = s.cs.err
+	case s.cs.finRcvd || s.cs.state == StateClosed:
+		err = io.EOF
+	}
+	return 0, err
+}
+
+// LocalAddr returns the local address of the connection.
+func (s *Socket) LocalAddr() *net.TCPAddr {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	return &net.TCPAddr{IP: append(net.IP{}, s.us.IP...), Port: s.us.Port}
+}
+
+// RemoteAddr returns the address of the remote peer of the connection.
+func (s *Socket) RemoteAddr() *net.TCPAddr {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	return &net.TCPAddr{IP: append(net.IP{}, s.them.IP...), Port: s.them.Port}
+}
+
+// SetBuffers sets the memory backing the send and receive buffers of the socket.
+// The size of the receive buffer limits the window advertised to the remote peer.
+// SetBuffers must be called before the connection is established. If not
+// called buffers of 2048 bytes are allocated when a connection is established.
+func (s *Socket) SetBuffers(txBuf, rxBuf []byte) error {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	if s.cs.state != StateClosed && s.cs.state != StateListen {
+		return errors.New("buffers must be set before connection is established")
+	}
+	if len(txBuf) == 0 || len(rxBuf) == 0 {
+		return errors.New("zero length buffer")
+	}
+	s.cs.sndBuf = ring{buf: txBuf}
+	s.cs.rcvBuf = ring{buf: rxBuf}
+	return nil
 }
 
-func (s *Socket) rx(hdr *dgrams.TCPHeader) (err error) {
+func (s *Socket) rx(ip *dgrams.IPv4Header, hdr *dgrams.TCPHeader, tcpOptions, payload []byte) (err error) {
 	s.cs.mu.Lock()
 	defer s.cs.mu.Unlock()
+	defer s.cs.probe()
+	flags := hdr.Flags()
+	s.cs.stats.InSegs++
+	s.cs.logSegment(EventRecv, hdr, len(payload))
+	opts, err := parseOptions(tcpOptions)
+	if err != nil {
+		return err
+	}
 	switch s.cs.state {
 	case StateClosed:
 		// Ignore packet.
 		err = errors.New("connection closed")
 	case StateListen:
-		if hdr.Flags() != dgrams.FlagTCP_SYN {
+		if flags != dgrams.FlagTCP_SYN {
 			return //
 		}
-		var iss uint32 = 0 // TODO: use random start sequence when done debugging.
-		fmt.Println("SYN received!")
-		// Initialize connection state:
-		s.cs.snd = sendSpace{
-			iss: iss,
-			UNA: iss,
-			NXT: iss,
-			WND: 10,
-			// UP, WL1, WL2 defaults to zero values.
-		}
-		s.cs.rcv = rcvSpace{
-			irs: hdr.Seq,
-			NXT: hdr.Seq + 1,
-			WND: hdr.WindowSize,
+		s.them = net.TCPAddr{IP: append(s.them.IP[:0], ip.Source[:]...), Port: int(hdr.SourcePort)}
+		if s.us.IP == nil {
+			s.us.IP = append(s.us.IP[:0], ip.Destination[:]...)
 		}
+		if s.us.Port == 0 {
+			s.us.Port = int(hdr.DestinationPort)
+		}
+		s.initConn()
+		s.synRcv(hdr, &opts)
 		// We must respond with SYN|ACK frame after receiving SYN in listen state.
 		s.cs.pendingCtlFrame = dgrams.FlagTCP_ACK | dgrams.FlagTCP_SYN
+		s.cs.setState(StateSynRcvd)
+
+	case StateSynSent:
+		err = s.rxSynSent(hdr, &opts)
+		s.cs.notify()
 
-	case StateSynRcvd:
-		// Handle SynRcvd state.
-		s.cs.snd.UNA = hdr.Ack
+	case StateSynRcvd, StateEstablished, StateFinWait1, StateFinWait2,
+		StateCloseWait, StateClosing, StateLastAck, StateTimeWait:
+		err = s.rxSynchronized(hdr, &opts, payload)
+		s.cs.notify()
 
 	default:
-		err = errors.New("[ERR] unhandled state transition:" + s.cs.state.String())
-		fmt.Println("[ERR] unhandled state transition:" + s.cs.state.String())
+		err = errors.New("unhandled state " + s.cs.state.String())
+		if s.cs.logEnabled(LevelError) {
+			s.cs.logEvent(Event{Kind: EventError, Level: LevelError, Err: err})
+		}
 	}
 	return err
 }
 
-// writeTCPIPv4 writes a TCP+IPv4 packet to dst, returning the number of bytes written.
-func (s *Socket) writeTCPIPv4(dst, tcpOpts, payload []byte) (n int, err error) {
-	if len(dst) > math.MaxUint16 {
-		return 0, errors.New("buffer too long for TCP/IP")
+// initConn initializes the state of a new connection between s.us and s.them,
+// choosing our initial sequence number. s.cs.mu must be held.
+func (s *Socket) initConn() {
+	isn := s.isn
+	if isn == nil {
+		isn = defaultISNGenerator()
 	}
-	// Exclude Ethernet header and CRC in frame size.
-	payloadOffset := len(tcpOpts) + dgrams.SizeIPHeader + dgrams.SizeTCPHeaderNoOptions
-	if len(dst) < payloadOffset+len(payload) {
-		return 0, io.ErrShortBuffer
+	iss := isn.ISN(&s.us, &s.them)
+	s.setConnID()
+	s.cs.initBuffers()
+	s.cs.snd = sendSpace{
+		iss: iss,
+		UNA: iss,
+		NXT: iss,
+		// WND, UP, WL1, WL2 defaults to zero values.
 	}
-	// Limit dst to the size of the frame.
-	dst = dst[:payloadOffset+len(payload)]
+	s.cs.rcv = rcvSpace{}
+	s.cs.peerMSS = defaultMSS
+	mtu := s.mtu
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	s.cs.pmtu.reset(mtu, !s.noPLPMTUD)
+	s.cs.delack = delayedACK{quick: s.cs.delack.quick}
+	s.cs.keepalive = keepAlive{cfg: s.cs.keepalive.cfg, last: s.cs.now}
+	s.cs.smallEnd = iss
+	s.cs.ts = tsState{}
+	s.cs.dupacks = 0
+	s.cs.recovery = false
+	s.cs.resetClose()
+}
 
-	offsetBytes := len(tcpOpts) + dgrams.SizeTCPHeaderNoOptions
-	offset := offsetBytes / 4
-	if offsetBytes%4 != 0 {
-		offset++
+// synRcv initializes the receive sequence space from the SYN of the remote
+// peer and negotiates the options both ends support. s.cs.mu must be held.
+func (s *Socket) synRcv(hdr *dgrams.TCPHeader, opts *tcpOptions) {
+	s.cs.snd.WND = uint32(hdr.WindowSize) // Window in SYN segments is never scaled.
+	s.cs.rcv = rcvSpace{
+		irs: Seq(hdr.Seq),
+		NXT: Seq(hdr.Seq).Add(1),
 	}
-	if offset > 0b1111 {
-		return 0, errors.New("TCP options too large")
+	s.cs.snd.shift = 0
+	s.cs.wsOK = !s.noWS && opts.hasWS
+	if s.cs.wsOK {
+		s.cs.snd.shift = opts.wscale
+		if s.cs.snd.shift > wsMaxShift {
+			s.cs.snd.shift = wsMaxShift
+		}
+		s.cs.rcv.shift = wsShift(s.cs.rcvBuf.Size())
+	}
+	s.cs.peerMSS = defaultMSS
+	if opts.hasMSS {
+		s.cs.peerMSS = opts.mss
+		if s.cs.peerMSS < minPeerMSS {
+			s.cs.peerMSS = minPeerMSS
+		}
+	}
+	s.cs.ts = tsState{}
+	if !s.noTS && opts.hasTS {
+		s.cs.ts = tsState{
+			ok:        true,
+			offset:    uint32(s.cs.snd.iss),
+			recent:    opts.tsVal,
+			recentAge: s.cs.now,
+		}
+	}
+	s.cs.updateRcvWindow()
+	s.cs.sackOK = !s.noSACK && opts.sackPermitted
+	s.cs.initCongestion(s.cc)
+}
+
+// rxSynSent processes a segment arriving in the SYN-SENT state, which is
+// expected to be the SYN-ACK of the remote peer. s.cs.mu must be held.
+func (s *Socket) rxSynSent(hdr *dgrams.TCPHeader, opts *tcpOptions) error {
+	flags := hdr.Flags()
+	ack := Seq(hdr.Ack)
+	hasAck := flags.HasFlags(dgrams.FlagTCP_ACK)
+	if hasAck && (ack.LessThanEq(s.cs.snd.iss) || s.cs.snd.NXT.LessThan(ack)) {
+		return errAckUnsent
+	}
+	if flags.HasFlags(dgrams.FlagTCP_RST) {
+		if !hasAck {
+			return errAckNotSet
+		}
+		s.cs.abort(errConnRefused)
+		return errConnRefused
+	}
+	if !flags.HasFlags(dgrams.FlagTCP_SYN) {
+		return errors.New("expected SYN in SYN-SENT state")
+	}
+	if !hasAck {
+		return errors.New("simultaneous open not supported")
+	}
+	s.synRcv(hdr, opts)
+	s.cs.ackRcv(ack, s.cs.ts.rtt(opts, s.cs.now))
+	s.cs.snd.WL1 = Seq(hdr.Seq)
+	s.cs.snd.WL2 = ack
+	s.cs.setState(StateEstablished)
+	s.cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+	return nil
+}
+
+// rxSynchronized processes a segment arriving in one of the synchronized
+// states following the order of checks in RFC 793 "SEGMENT ARRIVES".
+// s.cs.mu must be held.
+func (s *Socket) rxSynchronized(hdr *dgrams.TCPHeader, opts *tcpOptions, payload []byte) error {
+	flags := hdr.Flags()
+	// Check timestamp of segment is not older than last in-order segment (RFC 7323).
+	if !s.cs.ts.paws(opts, flags.HasFlags(dgrams.FlagTCP_RST), s.cs.now) {
+		s.cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+		return errPAWS
+	}
+	// First, check sequence number.
+	if !s.cs.rcv.acceptable(Seq(hdr.Seq), segLen(flags, payload)) {
+		if !flags.HasFlags(dgrams.FlagTCP_RST) {
+			// Unacceptable segments are answered with an ACK unless RST is set.
+			s.cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+		}
+		s.cs.stats.OutOfWindow++
+		return errSegNotAcceptable
+	}
+	s.cs.ts.update(opts, Seq(hdr.Seq), s.cs.now)
+	s.cs.segmentRcv()
+	// Second, check the RST bit.
+	if flags.HasFlags(dgrams.FlagTCP_RST) {
+		passive := s.cs.state == StateSynRcvd && !s.cs.closing
+		s.cs.abort(errConnReset)
+		if passive {
+			// Connection was initiated with a passive OPEN, return to LISTEN.
+			s.cs.setState(StateListen)
+		}
+		return errConnReset
+	}
+	// Fifth, check the ACK field.
+	if !flags.HasFlags(dgrams.FlagTCP_ACK) {
+		return errAckNotSet
+	}
+	err := s.cs.frameRcv(hdr)
+	switch {
+	case err == nil:
+		// Our SYN is acknowledged before leaving SYN-RECEIVED, so that
+		// it is not taken for data of the send buffer.
+		s.cs.ackRcv(Seq(hdr.Ack), s.cs.ts.rtt(opts, s.cs.now))
+		if s.cs.state == StateSynRcvd {
+			s.cs.setState(StateEstablished)
+			if s.cs.closing {
+				s.cs.setState(StateFinWait1) // Closed by the user during the handshake.
+			}
+			s.cs.snd.WND = s.cs.sndWindow(hdr)
+			s.cs.snd.WL1 = Seq(hdr.Seq)
+			s.cs.snd.WL2 = Seq(hdr.Ack)
+		}
+		s.cs.dupacks = 0
+	case s.cs.state != StateSynRcvd && err == errAckOld:
+		// Old ACK, ignore the acknowledgment but process segment text.
+		// It is a duplicate ACK as defined by RFC 5681 if it carries no data
+		// nor window update while we have outstanding data.
+		if Seq(hdr.Ack) == s.cs.snd.UNA && segLen(flags, payload) == 0 &&
+			s.cs.sndWindow(hdr) == s.cs.snd.WND && s.cs.rtx.Len() > 0 {
+			s.cs.dupacks++
+		}
+	case s.cs.state == StateSynRcvd:
+		// Unacceptable ACK of our SYN, the connection stays half-open
+		// (RFC 9293 section 3.10.7.4).
+		s.cs.pendingCtlFrame |= dgrams.FlagTCP_RST
+		s.cs.rstSeq = Seq(hdr.Ack)
+		return err
+	default:
+		if err == errAckUnsent {
+			s.cs.pendingCtlFrame |= dgrams.FlagTCP_ACK
+		}
+		return err
+	}
+	if s.cs.sackOK && opts.nsack > 0 {
+		s.cs.rtx.sack(opts.sack[:opts.nsack])
+	}
+	s.cs.detectLoss()
+	s.cs.updateSndWindow(hdr)
+	// Seventh, process the segment text.
+	receiving := s.cs.state == StateEstablished || s.cs.state == StateFinWait1 || s.cs.state == StateFinWait2
+	if len(payload) > 0 && receiving {
+		s.cs.dataRcv(Seq(hdr.Seq), payload)
+	}
+	// Eighth, check the FIN bit.
+	if flags.HasFlags(dgrams.FlagTCP_FIN) && receiving {
+		s.cs.finRcv(Seq(hdr.Seq).Add(uint32(len(payload))))
+	}
+	return nil
+}
+
+// writeSegment writes a segment with sequence number seq, the given flags and
+// options and datalen bytes of data from the send buffer to dst. s.cs.mu must be held.
+func (s *Socket) writeSegment(dst []byte, seq Seq, flags dgrams.TCPFlags, tcpOpts []byte, datalen uint32, partialCsum bool) (int, error) {
+	var payload []byte
+	if datalen > 0 {
+		hdrlen := uint32(sizeTCPIPv4 + len(tcpOpts))
+		if uint32(len(dst)) < hdrlen+datalen {
+			return 0, io.ErrShortBuffer
+		}
+		// Read data directly into its place in dst.
+		payload = dst[hdrlen : hdrlen+datalen]
+		off := s.cs.sndBufStart().Sizeof(seq)
+		n := s.cs.sndBuf.ReadAt(payload, int(off))
+		payload = payload[:n]
+	}
+	return s.writeTCPIPv4(dst, seq, flags, tcpOpts, payload, partialCsum)
+}
+
+// logDrop logs the segment hdr received was dropped because of err.
+func (s *Socket) logDrop(hdr *dgrams.TCPHeader, err error) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	if s.cs.logEnabled(LevelInfo) {
+		s.cs.logEvent(Event{Kind: EventDrop, Level: LevelInfo, Seq: Seq(hdr.Seq), Ack: Seq(hdr.Ack), Flags: hdr.Flags(), Err: err})
+	}
+}
+
+// logSent logs the TCP+IPv4 packet pkt sent as an event of kind. s.cs.mu must be held.
+func (s *Socket) logSent(kind EventKind, pkt []byte) {
+	if !s.cs.logEnabled(LevelDebug) {
+		return
+	}
+	tcp := dgrams.DecodeTCPHeader(pkt[dgrams.SizeIPHeader:])
+	s.cs.logSegment(kind, &tcp, len(pkt)-dgrams.SizeIPHeader-int(tcp.OffsetInBytes()))
+}
+
+// writeTCPIPv4 writes a TCP+IPv4 packet with sequence number seq and the given
+// flags to dst, returning the number of bytes written. The acknowledgment number
+// and window are taken from the receive space. s.cs.mu must be held.
+func (s *Socket) writeTCPIPv4(dst []byte, seq Seq, flags dgrams.TCPFlags, tcpOpts, payload []byte, partialCsum bool) (n int, err error) {
+	wnd := s.cs.rcv.WND >> s.cs.rcv.shift
+	if flags.HasFlags(dgrams.FlagTCP_SYN) {
+		// Window in SYN segments is never scaled.
+		wnd = s.cs.rcv.WND
+		if wnd > math.MaxUint16 {
+			wnd = math.MaxUint16
+		}
 	}
-	payloadOffset = dgrams.SizeIPHeader + offset*4
-	ip := dgrams.IPv4Header{
-		Version:     4,
-		IHL:         dgrams.SizeIPHeader / 4,
-		TotalLength: uint16(offsetBytes+len(payload)) + dgrams.SizeIPHeader + dgrams.SizeTCPHeaderNoOptions,
-		ID:          0,
-		Flags:       0,
-		TTL:         255,
-		Protocol:    6, // 6 == TCP.
-	}
-	copy(ip.Destination[:], s.them.IP)
-	copy(ip.Source[:], s.us.IP)
 	tcp := dgrams.TCPHeader{
 		SourcePort:      s.us.AddrPort().Port(),
 		DestinationPort: s.them.AddrPort().Port(),
-		Seq:             s.cs.snd.NXT,
-		Ack:             s.cs.rcv.NXT,
-		OffsetAndFlags:  [1]uint16{uint16(s.cs.pendingCtlFrame) | uint16(offset)<<12},
-		WindowSize:      s.cs.rcv.WND,
+		Seq:             uint32(seq),
+		Ack:             uint32(s.cs.rcv.NXT),
+		OffsetAndFlags:  [1]uint16{uint16(flags)},
+		WindowSize:      uint16(wnd),
 		UrgentPtr:       0, // We do not implement urgent pointer.
 	}
+	var src, dstAddr [4]byte
+	copy(src[:], s.us.IP)
+	copy(dstAddr[:], s.them.IP)
+	n, err = putTCPIPv4(dst, &s.ipv4, src, dstAddr, &tcp, tcpOpts, payload, partialCsum)
+	if err == nil && flags.HasFlags(dgrams.FlagTCP_ACK) {
+		s.cs.ts.lastACKSent = s.cs.rcv.NXT
+		s.cs.ackSent()
+	}
+	return n, err
+}
+
+// putTCPIPv4 writes a TCP+IPv4 packet from src to dstAddr with the TCP header,
+// options and payload given to dst and returns the length of the packet. The
+// IPv4 header is written by ipv4. The data offset and checksum of tcp are set
+// by putTCPIPv4. If partialCsum is set the TCP checksum only covers the
+// pseudo-header and is completed by the device the packet is sent through, see
+// dgrams.VirtioNetNeedsCsum.
+func putTCPIPv4(dst []byte, ipv4 *dgrams.IPv4Sender, src, dstAddr [4]byte, tcp *dgrams.TCPHeader, tcpOpts, payload []byte, partialCsum bool) (int, error) {
+	if len(dst) > math.MaxUint16 {
+		return 0, errors.New("buffer too long for TCP/IP")
+	}
+	if len(tcpOpts)%tcpWordlen != 0 {
+		return 0, errors.New("TCP options not padded to 4 byte boundary")
+	}
+	offset := (len(tcpOpts) + dgrams.SizeTCPHeaderNoOptions) / tcpWordlen
+	if offset > 0b1111 {
+		return 0, errors.New("TCP options too large")
+	}
+	// Exclude Ethernet header and CRC in frame size.
+	payloadOffset := dgrams.SizeIPHeader + offset*tcpWordlen
+	if len(dst) < payloadOffset+len(payload) {
+		return 0, io.ErrShortBuffer
+	}
+	// Limit dst to the size of the frame.
+	dst = dst[:payloadOffset+len(payload)]
+	ip, err := ipv4.PutHeader(dst, src, dstAddr, 6, dgrams.ECNNotECT) // 6 == TCP.
+	if err != nil {
+		return 0, err
+	}
+	tcp.OffsetAndFlags[0] = tcp.OffsetAndFlags[0]&^(0b1111<<12) | uint16(offset)<<12
 	// Calculate TCP checksum.
-	tcp.Checksum = tcp.CalculateChecksumIPv4(&ip, tcpOpts, payload)
+	if partialCsum {
+		var pseudo [12]byte
+		ip.PutPseudo(pseudo[:])
+		crc := dgrams.CRC_RFC791{}
+		crc.Write(pseudo[:])
+		tcp.Checksum = ^crc.Sum() // Not complemented, the device sums the rest into it.
+	} else {
+		tcp.Checksum = tcp.CalculateChecksumIPv4(&ip, tcpOpts, payload)
+	}
 	// Copy TCP header+options and payload into buffer.
 	tcp.Put(dst[dgrams.SizeIPHeader:])
 	nopt := copy(dst[dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions:payloadOffset], tcpOpts)
@@ -221,10 +1064,5 @@ func (s *Socket) writeTCPIPv4(dst, tcpOpts, payload []byte) (n int, err error) {
 		panic("tcp options copy failed")
 	}
 	copy(dst[payloadOffset:], payload)
-	// Calculate IP checksum and copy IP header into buffer.
-	crc := dgrams.CRC_RFC791{}
-	crc.Write(dst[dgrams.SizeIPHeader:]) // We limited dst size above.
-	ip.Checksum = crc.Sum()
-	ip.Put(dst)
 	return len(dst), nil
 }
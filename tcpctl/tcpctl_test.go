@@ -1,8 +1,12 @@
 package tcpctl_test
 
 import (
+	"encoding/binary"
+	"math"
 	"testing"
+	"time"
 
+	"github.com/soypat/dgrams"
 	"github.com/soypat/dgrams/tcpctl"
 )
 
@@ -27,3 +31,465 @@ func TestSynReceive(t *testing.T) {
 		t.Error("expected same start/end. got ", pStart, pEnd)
 	}
 }
+
+func TestSynAckRetransmit(t *testing.T) {
+	var s tcpctl.Socket
+	s.SetMaxRetries(2)
+	now := time.Unix(0, 0)
+	s.Tick(now)
+	s.Listen()
+	_, _, err := s.RecvEthernet(packetSyn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [1500]byte
+	n, err := s.SendEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected SYN-ACK to be sent", n, err)
+	}
+	synack := dgrams.DecodeTCPHeader(buf[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader:])
+	if synack.Flags() != dgrams.FlagTCP_SYN|dgrams.FlagTCP_ACK {
+		t.Fatal("expected SYN-ACK, got", synack.Flags())
+	}
+	if n, _ = s.SendEthernet(buf[:]); n != 0 {
+		t.Fatal("expected no more segments before timeout")
+	}
+	for i, wait := range []time.Duration{time.Second, 2 * time.Second} {
+		now = now.Add(wait - time.Millisecond)
+		s.Tick(now)
+		if n, _ = s.SendEthernet(buf[:]); n != 0 {
+			t.Fatal("retransmitted before timeout", i)
+		}
+		now = now.Add(time.Millisecond)
+		s.Tick(now)
+		n, _ = s.SendEthernet(buf[:])
+		if n == 0 {
+			t.Fatal("expected retransmission", i)
+		}
+		got := dgrams.DecodeTCPHeader(buf[dgrams.SizeEthernetHeaderNoVLAN+dgrams.SizeIPHeader:])
+		if got.Seq != synack.Seq || got.Flags() != synack.Flags() {
+			t.Fatalf("retransmission %d does not match original SYN-ACK", i)
+		}
+	}
+	err = s.Tick(now.Add(4 * time.Second))
+	if err == nil || s.State() != tcpctl.StateClosed {
+		t.Fatal("expected connection abort after max retries, got state", s.State())
+	}
+}
+
+func TestSynRcvdUnacceptableAck(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	// ACKs not acknowledging our SYN are answered with a RST whose sequence
+	// number is the acknowledgment number received.
+	for _, ack := range []uint32{iss, iss + 2} {
+		if _, _, err := s.RecvTCP(tcpPacket(irs+1, ack, dgrams.FlagTCP_ACK, 100, nil, nil)); err == nil {
+			t.Fatal("expected unacceptable ACK to be dropped")
+		}
+		rst := sendTCP(t, &s, buf[:])
+		if rst.Flags() != dgrams.FlagTCP_RST || rst.Seq != ack {
+			t.Fatalf("expected RST with seq=%d, got %s seq=%d", ack-iss, rst.Flags(), rst.Seq-iss)
+		}
+		if s.State() != tcpctl.StateSynRcvd {
+			t.Fatal("expected connection to remain in SYN-RECEIVED, got", s.State())
+		}
+	}
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	if s.State() != tcpctl.StateEstablished {
+		t.Fatal("expected ESTABLISHED, got", s.State())
+	}
+}
+
+func TestSynRcvdWrite(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetNoDelay(true)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	// Data written before the handshake completes is sent once established.
+	if n, err := s.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("expected write of 5 bytes, got n=%d err=%v", n, err)
+	}
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	seg := sendTCP(t, &s, buf[:])
+	if data := tcpPayload(buf[:], &seg); seg.Seq != iss+1 || string(data) != "hello" {
+		t.Fatalf("unexpected data segment seq=%d data=%q", seg.Seq-iss, data)
+	}
+}
+
+func TestSocketReadWrite(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	err := s.SetBuffers(make([]byte, 16), make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send and acknowledge segments as soon as possible.
+	s.SetNoDelay(true)
+	s.SetQuickAck(true)
+	s.Listen()
+	_, _, err = s.RecvEthernet(packetSyn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synack := sendTCP(t, &s, buf[:])
+	if synack.WindowSize != 16 {
+		t.Errorf("expected advertised window to be receive buffer size 16, got %d", synack.WindowSize)
+	}
+	iss := synack.Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	if s.State() != tcpctl.StateEstablished {
+		t.Fatal("expected established state, got", s.State())
+	}
+
+	// Send data and check it is released from the send buffer when acknowledged.
+	n, err := s.Write([]byte("hello, world! 123"))
+	if n != 16 || err == nil {
+		t.Fatalf("expected partial write of 16 bytes with error, got n=%d err=%v", n, err)
+	}
+	seg := sendTCP(t, &s, buf[:])
+	if data := tcpPayload(buf[:], &seg); seg.Seq != iss+1 || string(data) != "hello, world! 12" {
+		t.Fatalf("unexpected data segment seq=%d data=%q", seg.Seq-iss, data)
+	}
+	recvTCP(t, &s, irs+1, iss+1+6, dgrams.FlagTCP_ACK, 100, nil)
+	n, _ = s.Write([]byte("abcdefghi"))
+	if n != 6 {
+		t.Fatalf("expected acknowledged data to free 6 bytes, got %d", n)
+	}
+	seg = sendTCP(t, &s, buf[:])
+	if data := tcpPayload(buf[:], &seg); seg.Seq != iss+1+16 || string(data) != "abcdef" {
+		t.Fatalf("unexpected data segment seq=%d data=%q", seg.Seq-iss, data)
+	}
+
+	// Receive data and check the window shrinks until read.
+	recvTCP(t, &s, irs+1, iss+1+6, dgrams.FlagTCP_ACK, 100, []byte("0123456789"))
+	seg = sendTCP(t, &s, buf[:])
+	if seg.Ack != irs+11 || seg.WindowSize != 6 {
+		t.Fatalf("expected ack=%d wnd=6, got ack=%d wnd=%d", irs+11, seg.Ack, seg.WindowSize)
+	}
+	// Data beyond the window is not acknowledged.
+	recvTCP(t, &s, irs+11, iss+1+6, dgrams.FlagTCP_ACK, 100, []byte("ABCDEFGHIJ"))
+	seg = sendTCP(t, &s, buf[:])
+	if seg.Ack != irs+17 || seg.WindowSize != 0 {
+		t.Fatalf("expected ack=%d wnd=0, got ack=%d wnd=%d", irs+17, seg.Ack, seg.WindowSize)
+	}
+	var rbuf [32]byte
+	n, _ = s.Read(rbuf[:])
+	if string(rbuf[:n]) != "0123456789ABCDEF" {
+		t.Fatalf("read unexpected data %q", rbuf[:n])
+	}
+	// Window opens, a window update is sent.
+	seg = sendTCP(t, &s, buf[:])
+	if seg.WindowSize != 16 {
+		t.Fatalf("expected window update to 16, got %d", seg.WindowSize)
+	}
+}
+
+// sendTCP calls s.SendTCP and fails the test if no packet is written.
+func sendTCP(t *testing.T, s *tcpctl.Socket, buf []byte) dgrams.TCPHeader {
+	t.Helper()
+	n, err := s.SendTCP(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected packet to be sent")
+	}
+	return dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:n])
+}
+
+// recvTCP builds a TCP+IPv4 packet from the peer of packetSyn and passes it to s.RecvTCP.
+func recvTCP(t *testing.T, s *tcpctl.Socket, seq, ack uint32, flags dgrams.TCPFlags, wnd uint16, payload []byte) {
+	t.Helper()
+	recvTCPOpts(t, s, seq, ack, flags, wnd, nil, payload)
+}
+
+// recvTCPOpts is like recvTCP but the packet carries TCP options opts, which must be 4 byte aligned.
+func recvTCPOpts(t *testing.T, s *tcpctl.Socket, seq, ack uint32, flags dgrams.TCPFlags, wnd uint16, opts, payload []byte) {
+	t.Helper()
+	_, _, err := s.RecvTCP(tcpPacket(seq, ack, flags, wnd, opts, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tcpPacket builds a TCP+IPv4 packet from the peer of packetSyn. opts must be 4 byte aligned.
+func tcpPacket(seq, ack uint32, flags dgrams.TCPFlags, wnd uint16, opts, payload []byte) []byte {
+	return tcpPacketPorts(58920, 80, seq, ack, flags, wnd, opts, payload)
+}
+
+// tcpPacketPorts is like tcpPacket but with the given source and destination ports.
+func tcpPacketPorts(srcPort, dstPort uint16, seq, ack uint32, flags dgrams.TCPFlags, wnd uint16, opts, payload []byte) []byte {
+	const sizeTCPIP = dgrams.SizeIPHeader + dgrams.SizeTCPHeaderNoOptions
+	buf := make([]byte, sizeTCPIP+len(opts)+len(payload))
+	ip := dgrams.IPv4Header{
+		Version:     4,
+		IHL:         5,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    6,
+		Source:      [4]byte{192, 168, 1, 112},
+		Destination: [4]byte{192, 168, 1, 5},
+	}
+	tcp := dgrams.TCPHeader{
+		SourcePort:      srcPort,
+		DestinationPort: dstPort,
+		Seq:             seq,
+		Ack:             ack,
+		WindowSize:      wnd,
+	}
+	tcp.SetFlags(flags)
+	tcp.SetOffset(uint8(5 + len(opts)/4))
+	ip.Put(buf)
+	tcp.Put(buf[dgrams.SizeIPHeader:])
+	copy(buf[sizeTCPIP:], opts)
+	copy(buf[sizeTCPIP+len(opts):], payload)
+	setChecksums(buf)
+	return buf
+}
+
+// setChecksums sets the header checksum of the IPv4 packet in buf and the
+// checksum of its TCP or ICMP payload.
+func setChecksums(buf []byte) {
+	var crc dgrams.CRC_RFC791
+	ip := dgrams.DecodeIPv4Header(buf)
+	ihl := int(ip.IHL) * 4
+	payload := buf[ihl:ip.TotalLength]
+	switch ip.Protocol {
+	case 1:
+		payload[2], payload[3] = 0, 0
+		crc.Write(payload)
+		binary.BigEndian.PutUint16(payload[2:], crc.Sum())
+	case 6:
+		payload[16], payload[17] = 0, 0
+		var pseudo [12]byte
+		copy(pseudo[:], buf[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(payload)))
+		crc.Write(pseudo[:])
+		crc.Write(payload)
+		binary.BigEndian.PutUint16(payload[16:], crc.Sum())
+	}
+	buf[10], buf[11] = 0, 0
+	crc.Reset()
+	crc.Write(buf[:ihl])
+	binary.BigEndian.PutUint16(buf[10:], crc.Sum())
+}
+
+// findOption returns the data of option kind of the TCP+IPv4 packet in buf with TCP header hdr.
+func findOption(buf []byte, hdr *dgrams.TCPHeader, kind dgrams.TCPOptionKind) (data []byte, ok bool) {
+	opts := buf[dgrams.SizeIPHeader+dgrams.SizeTCPHeaderNoOptions : dgrams.SizeIPHeader+hdr.OffsetInBytes()]
+	for len(opts) > 0 {
+		k, data, n, err := dgrams.DecodeTCPOption(opts)
+		if err != nil {
+			return nil, false
+		} else if k == kind {
+			return data, true
+		}
+		opts = opts[n:]
+	}
+	return nil, false
+}
+
+// tcpPayload returns the payload of the TCP+IPv4 packet in buf with TCP header hdr.
+func tcpPayload(buf []byte, hdr *dgrams.TCPHeader) []byte {
+	ip := dgrams.DecodeIPv4Header(buf)
+	return buf[dgrams.SizeIPHeader+hdr.OffsetInBytes() : ip.TotalLength]
+}
+
+func TestSocketOutOfOrder(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetBuffers(make([]byte, 16), make([]byte, 16))
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	iss := sendTCP(t, &s, buf[:]).Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, nil)
+	var rbuf [16]byte
+	// Read some data so the receive buffer wraps around.
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, []byte("xxxxxxxxxx"))
+	s.Read(rbuf[:])
+	sendTCP(t, &s, buf[:])
+
+	const nxt = irs + 11
+	recvTCP(t, &s, nxt+8, iss+1, dgrams.FlagTCP_ACK, 100, []byte("89ab"))
+	recvTCP(t, &s, nxt+4, iss+1, dgrams.FlagTCP_ACK, 100, []byte("4567"))
+	if seg := sendTCP(t, &s, buf[:]); seg.Ack != nxt {
+		t.Fatalf("out of order data should not advance ack, got %d", seg.Ack-nxt)
+	}
+	if n, _ := s.Read(rbuf[:]); n != 0 {
+		t.Fatalf("out of order data should not be readable, read %q", rbuf[:n])
+	}
+	// Overlapping segment fills the gap.
+	recvTCP(t, &s, nxt, iss+1, dgrams.FlagTCP_ACK, 100, []byte("012345"))
+	if seg := sendTCP(t, &s, buf[:]); seg.Ack != nxt+12 {
+		t.Fatalf("expected ack to cover reassembled data, got %d", seg.Ack-nxt)
+	}
+	n, _ := s.Read(rbuf[:])
+	if string(rbuf[:n]) != "0123456789ab" {
+		t.Fatalf("read unexpected data %q", rbuf[:n])
+	}
+}
+
+func TestSACK(t *testing.T) {
+	const irs = 0x3eab64f7 // Sequence number of packetSyn.
+	const mss = 1460       // MSS of packetSyn.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetBuffers(make([]byte, 4*mss), make([]byte, 64))
+	// Without timestamps SACK blocks are the only option of ACKs.
+	s.SetTimestamps(false)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	synack := sendTCP(t, &s, buf[:])
+	if !hasOption(buf[:], &synack, dgrams.TCPOptionSACKPermitted) {
+		t.Fatal("SYN-ACK should carry SACK-permitted option")
+	}
+	iss := synack.Seq
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 60000, nil)
+
+	// Receiver side: out of order data is reported in SACK blocks.
+	recvTCP(t, &s, irs+11, iss+1, dgrams.FlagTCP_ACK, 60000, []byte("0123456789"))
+	ack := sendTCP(t, &s, buf[:])
+	opts := buf[40 : 20+ack.OffsetInBytes()]
+	wantOpts := []byte{1, 1, 5, 10, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(wantOpts[4:], irs+11)
+	binary.BigEndian.PutUint32(wantOpts[8:], irs+21)
+	if ack.Ack != irs+1 || string(opts) != string(wantOpts) {
+		t.Fatalf("expected ack=%d with SACK block [%d,%d), got ack=%d options %v",
+			irs+1, irs+11, irs+21, ack.Ack, opts)
+	}
+	recvTCP(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 60000, []byte("0123456789"))
+	if ack = sendTCP(t, &s, buf[:]); ack.Ack != irs+21 || ack.OffsetInBytes() != 20 {
+		t.Fatal("expected cumulative ACK without SACK blocks once gap filled")
+	}
+	s.Read(buf[:])
+
+	// Grow the congestion window past its initial 3 segments with an
+	// acknowledged segment so that 4 segments fit in flight.
+	s.Write(make([]byte, mss))
+	sendTCP(t, &s, buf[:])
+	una := iss + 1 + mss
+	recvTCP(t, &s, irs+21, una, dgrams.FlagTCP_ACK, 60000, nil)
+
+	// Sender side: only segments not SACKed are retransmitted.
+	s.Write(make([]byte, 4*mss))
+	for i := uint32(0); i < 4; i++ {
+		if seg := sendTCP(t, &s, buf[:]); seg.Seq != una+i*mss {
+			t.Fatalf("segment %d: unexpected seq %d", i, seg.Seq-iss)
+		}
+	}
+	sack := []byte{1, 1, 5, 10, 0, 0, 0, 0, 0, 0, 0, 0}
+	for i := uint32(2); i <= 4; i++ {
+		// Segment 0 is lost, receiver SACKs segments 1 through 3.
+		binary.BigEndian.PutUint32(sack[4:], una+mss)
+		binary.BigEndian.PutUint32(sack[8:], una+i*mss)
+		recvTCPOpts(t, &s, irs+21, una, dgrams.FlagTCP_ACK, 60000, sack, nil)
+	}
+	seg := sendTCP(t, &s, buf[:])
+	if seg.Seq != una {
+		t.Fatalf("expected retransmission of first segment, got seq %d", seg.Seq-iss)
+	}
+	if n, _ := s.SendTCP(buf[:]); n != 0 {
+		seg = dgrams.DecodeTCPHeader(buf[20:])
+		t.Fatalf("SACKed segment retransmitted with seq %d", seg.Seq-iss)
+	}
+}
+
+func TestSACKDisabled(t *testing.T) {
+	var s tcpctl.Socket
+	var buf [1500]byte
+	s.SetSACK(false)
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	synack := sendTCP(t, &s, buf[:])
+	if hasOption(buf[:], &synack, dgrams.TCPOptionSACKPermitted) {
+		t.Fatal("SYN-ACK should not carry SACK-permitted option")
+	}
+}
+
+// hasOption checks if the TCP+IPv4 packet in buf with TCP header hdr carries option kind.
+func hasOption(buf []byte, hdr *dgrams.TCPHeader, kind dgrams.TCPOptionKind) bool {
+	_, ok := findOption(buf, hdr, kind)
+	return ok
+}
+
+func TestWindowScaleTimestamps(t *testing.T) {
+	const irs = 0x3eab64f7     // Sequence number of packetSyn.
+	const synTSval = 144865087 // TSval of packetSyn.
+	const peerShift = 7        // Window scale of packetSyn.
+	const rcvBufSize = 200000  // Needs a shift of 2 to be advertised.
+	var s tcpctl.Socket
+	var buf [1500]byte
+	now := time.Unix(100, 0)
+	s.Tick(now)
+	s.SetBuffers(make([]byte, 20000), make([]byte, rcvBufSize))
+	s.SetCongestionControl(fixedWindow(math.MaxUint32)) // Only limited by the peer's window.
+	s.Listen()
+	s.RecvEthernet(packetSyn)
+	synack := sendTCP(t, &s, buf[:])
+	ws, ok := findOption(buf[:], &synack, dgrams.TCPOptionWindowScale)
+	if !ok || ws[0] != 2 {
+		t.Fatalf("expected window scale option with shift 2, got %v", ws)
+	}
+	if synack.WindowSize != 0xffff {
+		t.Errorf("SYN-ACK window should be unscaled and clamped to 65535, got %d", synack.WindowSize)
+	}
+	ts, ok := findOption(buf[:], &synack, dgrams.TCPOptionTimestamps)
+	if !ok || binary.BigEndian.Uint32(ts[4:]) != synTSval {
+		t.Fatalf("expected timestamps option echoing TSval %d, got %v", uint32(synTSval), ts)
+	}
+	iss := synack.Seq
+	ourTSval := binary.BigEndian.Uint32(ts)
+	tsopt := func(val, ecr uint32) []byte {
+		opt := []byte{1, 1, 8, 10, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(opt[4:], val)
+		binary.BigEndian.PutUint32(opt[8:], ecr)
+		return opt
+	}
+	// Peer advertises window of 100<<7 = 12800 bytes.
+	recvTCPOpts(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, tsopt(synTSval+10, ourTSval), nil)
+	s.Write(make([]byte, 20000))
+	var sent uint32
+	for {
+		n, _ := s.SendTCP(buf[:])
+		if n == 0 {
+			break
+		}
+		seg := dgrams.DecodeTCPHeader(buf[dgrams.SizeIPHeader:])
+		if seg.WindowSize != rcvBufSize>>2 {
+			t.Fatalf("expected scaled window %d, got %d", rcvBufSize>>2, seg.WindowSize)
+		}
+		sent += uint32(len(tcpPayload(buf[:], &seg)))
+	}
+	if sent != 100<<peerShift {
+		t.Fatalf("expected to fill scaled peer window of %d bytes, sent %d", 100<<peerShift, sent)
+	}
+
+	// PAWS: a segment with an older timestamp is dropped.
+	recvTCPOpts(t, &s, irs+1, iss+1, dgrams.FlagTCP_ACK, 100, tsopt(synTSval+20, ourTSval), []byte("new"))
+	now = now.Add(200 * time.Millisecond) // Delayed ACK timeout.
+	s.Tick(now)
+	ack := sendTCP(t, &s, buf[:])
+	if ack.Ack != irs+4 {
+		t.Fatal("expected data to be acknowledged")
+	}
+	ts, _ = findOption(buf[:], &ack, dgrams.TCPOptionTimestamps)
+	if binary.BigEndian.Uint32(ts[4:]) != synTSval+20 {
+		t.Fatal("expected TSecr to echo latest TSval")
+	}
+	_, _, err := s.RecvTCP(tcpPacket(irs+4, iss+1, dgrams.FlagTCP_ACK, 100, tsopt(synTSval+15, ourTSval), []byte("old")))
+	if err == nil {
+		t.Fatal("expected segment with old timestamp to be rejected")
+	}
+	if ack = sendTCP(t, &s, buf[:]); ack.Ack != irs+4 {
+		t.Fatal("old duplicate should be answered with ACK without acknowledging data")
+	}
+}
@@ -0,0 +1,85 @@
+package tcpctl
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// tsRecentMaxAge is the time after which TS.Recent is considered invalid
+	// since the remote peer's timestamp clock may have wrapped around.
+	tsRecentMaxAge = 24 * 24 * time.Hour
+	// wsMaxShift is the maximum window scale shift count allowed by RFC 7323.
+	wsMaxShift = 14
+)
+
+var errPAWS = errors.New("PAWS: segment timestamp older than TS.Recent")
+
+// tsState contains the state of the Timestamps option described in RFC 7323.
+type tsState struct {
+	// ok is set when both ends agreed to use the Timestamps option.
+	ok bool
+	// offset is added to our timestamp clock so that TSval does not leak
+	// the system clock, as recommended by RFC 7323 section 7.1.
+	offset uint32
+	// recent is TS.Recent, the timestamp to be echoed in TSecr of the next segment sent.
+	recent uint32
+	// recentAge is the time TS.Recent was last updated.
+	recentAge time.Time
+	// lastACKSent is Last.ACK.sent, the ACK field of the last segment sent.
+	lastACKSent Seq
+}
+
+// val returns the TSval for a segment sent at now. The timestamp clock has
+// millisecond resolution, within the 1ms to 1s range recommended by RFC 7323.
+func (ts *tsState) val(now time.Time) uint32 {
+	return uint32(now.UnixMilli()) + ts.offset
+}
+
+// paws implements the Protection Against Wrapped Sequences test (RFC 7323
+// section 5.3 R1). It returns false if the segment is an old duplicate and
+// must be dropped.
+func (ts *tsState) paws(opts *tcpOptions, rst bool, now time.Time) bool {
+	if !ts.ok || !opts.hasTS || rst {
+		return true
+	}
+	if int32(opts.tsVal-ts.recent) >= 0 {
+		return true
+	}
+	// If the connection has been idle for more than 24 days TS.Recent is invalid.
+	return now.Sub(ts.recentAge) > tsRecentMaxAge
+}
+
+// update records the TSval of an acceptable segment starting at seq to be echoed
+// back to the remote peer (RFC 7323 section 4.3).
+func (ts *tsState) update(opts *tcpOptions, seq Seq, now time.Time) {
+	if !ts.ok || !opts.hasTS {
+		return
+	}
+	if seq.LessThanEq(ts.lastACKSent) && (int32(opts.tsVal-ts.recent) >= 0 || now.Sub(ts.recentAge) > tsRecentMaxAge) {
+		ts.recent = opts.tsVal
+		ts.recentAge = now
+	}
+}
+
+// rtt returns the round trip time measured from the TSecr of a segment
+// acknowledging new data, or zero if no measurement can be made.
+func (ts *tsState) rtt(opts *tcpOptions, now time.Time) time.Duration {
+	if !ts.ok || !opts.hasTS || opts.tsEcr == 0 {
+		return 0
+	}
+	ms := int32(ts.val(now) - opts.tsEcr)
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// wsShift returns the window scale shift count needed to advertise
+// a receive buffer of the given size.
+func wsShift(bufsize int) (shift uint8) {
+	for shift < wsMaxShift && bufsize>>shift > 0xffff {
+		shift++
+	}
+	return shift
+}
@@ -0,0 +1,216 @@
+package tcpctl
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Probe is a sample of the state variables of a connection, see Tracer.
+type Probe struct {
+	// Time is the time of the socket when the sample was taken.
+	Time time.Time
+	// Addresses and ports of the connection.
+	LocalAddr, RemoteAddr [4]byte
+	LocalPort, RemotePort uint16
+	State                 State
+	// Send and receive sequence space variables. Windows are in bytes,
+	// already scaled.
+	SndUna, SndNxt Seq
+	SndWnd         uint32
+	RcvNxt         Seq
+	RcvWnd         uint32
+	// Cwnd and Ssthresh are the congestion window and slow start threshold
+	// in bytes, zero before the connection is synchronized.
+	Cwnd, Ssthresh uint32
+	// SRTT is the smoothed round trip time, zero until measured. RTO is the
+	// retransmission timeout including backoff.
+	SRTT, RTO time.Duration
+}
+
+// Tracer receives a Probe of the state variables of a connection every time
+// one of them changes, which is enough to plot time-sequence graphs of the
+// connection like those of Linux's tcp_probe. Trace is called with the socket
+// locked and must not call methods of the socket. See TraceWriter.
+type Tracer interface {
+	Trace(p Probe)
+}
+
+// SetTracer sets the tracer receiving probes of the connection of the socket.
+// Nil, the default, disables tracing.
+func (s *Socket) SetTracer(t Tracer) {
+	s.cs.mu.Lock()
+	defer s.cs.mu.Unlock()
+	s.cs.tracer = t
+	s.cs.traced = Probe{}
+}
+
+// probe passes a Probe of the connection to the tracer if the state variables
+// changed since the last one. It must be called after the connection state
+// may have changed. cs.mu must be held.
+func (cs *connState) probe() {
+	if cs.tracer == nil {
+		return
+	}
+	p := Probe{
+		LocalAddr:  cs.id.local,
+		RemoteAddr: cs.id.remote,
+		LocalPort:  cs.id.lport,
+		RemotePort: cs.id.rport,
+		State:      cs.state,
+		SndUna:     cs.snd.UNA,
+		SndNxt:     cs.snd.NXT,
+		SndWnd:     cs.snd.WND,
+		RcvNxt:     cs.rcv.NXT,
+		RcvWnd:     cs.rcv.WND,
+		SRTT:       cs.rtx.est.srtt,
+		RTO:        cs.rtx.timeout(),
+	}
+	if cs.cc != nil {
+		p.Cwnd, p.Ssthresh = cs.cc.Cwnd(), cs.cc.Ssthresh()
+	}
+	if p == cs.traced {
+		return
+	}
+	cs.traced = p
+	p.Time = cs.now
+	cs.tracer.Trace(p)
+}
+
+// TraceFormat is the output format of a TraceWriter.
+type TraceFormat uint8
+
+const (
+	// TraceCSV writes probes as comma separated values following a header line.
+	TraceCSV TraceFormat = iota
+	// TraceJSON writes probes as JSON objects, one per line.
+	TraceJSON
+)
+
+// traceColumns are the names of the columns of TraceCSV and keys of TraceJSON.
+var traceColumns = [...]string{
+	"time", "local", "remote", "state", "snd_una", "snd_nxt", "snd_wnd",
+	"rcv_nxt", "rcv_wnd", "cwnd", "ssthresh", "srtt_us", "rto_us",
+}
+
+// TraceWriter is a Tracer writing probes to an io.Writer, one per line, for
+// plotting. Time is in seconds since the first probe written, SRTT and RTO in
+// microseconds. A TraceWriter may be shared by sockets used concurrently.
+type TraceWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format TraceFormat
+	// start is the time of the first probe written, once started is set.
+	start   time.Time
+	started bool
+	buf     []byte
+	err     error
+}
+
+var _ Tracer = (*TraceWriter)(nil)
+
+// NewTraceWriter returns a TraceWriter writing probes to w in format.
+func NewTraceWriter(w io.Writer, format TraceFormat) *TraceWriter {
+	return &TraceWriter{w: w, format: format}
+}
+
+// Trace writes p. Once a write fails no more probes are written, see Err.
+func (tw *TraceWriter) Trace(p Probe) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.err != nil {
+		return
+	}
+	b := tw.buf[:0]
+	if !tw.started {
+		tw.start, tw.started = p.Time, true
+		if tw.format == TraceCSV {
+			for i, col := range traceColumns {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				b = append(b, col...)
+			}
+			b = append(b, '\n')
+		}
+	}
+	if tw.format == TraceJSON {
+		b = append(b, '{')
+	}
+	for i := range traceColumns {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		if tw.format == TraceJSON {
+			b = append(b, '"')
+			b = append(b, traceColumns[i]...)
+			b = append(b, '"', ':')
+		}
+		quote := tw.format == TraceJSON && i >= 1 && i <= 3 // Addresses and state are strings.
+		if quote {
+			b = append(b, '"')
+		}
+		b = tw.appendColumn(b, i, &p)
+		if quote {
+			b = append(b, '"')
+		}
+	}
+	if tw.format == TraceJSON {
+		b = append(b, '}')
+	}
+	b = append(b, '\n')
+	tw.buf = b
+	_, tw.err = tw.w.Write(b)
+}
+
+// appendColumn appends the value of column i of p to b.
+func (tw *TraceWriter) appendColumn(b []byte, i int, p *Probe) []byte {
+	switch i {
+	case 0:
+		return strconv.AppendFloat(b, p.Time.Sub(tw.start).Seconds(), 'f', 6, 64)
+	case 1:
+		return appendAddrPort(b, p.LocalAddr, p.LocalPort)
+	case 2:
+		return appendAddrPort(b, p.RemoteAddr, p.RemotePort)
+	case 3:
+		return append(b, p.State.String()...)
+	case 4:
+		return strconv.AppendUint(b, uint64(p.SndUna), 10)
+	case 5:
+		return strconv.AppendUint(b, uint64(p.SndNxt), 10)
+	case 6:
+		return strconv.AppendUint(b, uint64(p.SndWnd), 10)
+	case 7:
+		return strconv.AppendUint(b, uint64(p.RcvNxt), 10)
+	case 8:
+		return strconv.AppendUint(b, uint64(p.RcvWnd), 10)
+	case 9:
+		return strconv.AppendUint(b, uint64(p.Cwnd), 10)
+	case 10:
+		return strconv.AppendUint(b, uint64(p.Ssthresh), 10)
+	case 11:
+		return strconv.AppendInt(b, p.SRTT.Microseconds(), 10)
+	default:
+		return strconv.AppendInt(b, p.RTO.Microseconds(), 10)
+	}
+}
+
+// Err returns the error of the write which failed, if any.
+func (tw *TraceWriter) Err() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.err
+}
+
+// appendAddrPort appends addr and port in the form 192.168.1.1:80 to b.
+func appendAddrPort(b []byte, addr [4]byte, port uint16) []byte {
+	for i, v := range addr {
+		if i > 0 {
+			b = append(b, '.')
+		}
+		b = strconv.AppendUint(b, uint64(v), 10)
+	}
+	b = append(b, ':')
+	return strconv.AppendUint(b, uint64(port), 10)
+}
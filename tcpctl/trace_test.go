@@ -0,0 +1,98 @@
+package tcpctl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soypat/dgrams"
+	"github.com/soypat/dgrams/tcpctl"
+)
+
+type probeLog []tcpctl.Probe
+
+func (l *probeLog) Trace(p tcpctl.Probe) { *l = append(*l, p) }
+
+func TestSocketTracer(t *testing.T) {
+	const irs = irsEstablished
+	var s tcpctl.Socket
+	var probes probeLog
+	s.SetTracer(&probes)
+	var buf [1500]byte
+	now := time.Unix(100, 0)
+	iss := establish(t, &s, now)
+	probes = probes[:0]
+	now = now.Add(10 * time.Millisecond)
+	s.Tick(now)
+	s.Write([]byte("hello"))
+	sendTCP(t, &s, buf[:])
+	if len(probes) != 1 || probes[0].SndNxt != tcpctl.Seq(iss+1+5) || probes[0].SndUna != tcpctl.Seq(iss+1) || !probes[0].Time.Equal(now) {
+		t.Fatalf("expected probe of data sent, got %+v", probes)
+	}
+	now = now.Add(10 * time.Millisecond)
+	s.Tick(now)
+	recvTCP(t, &s, irs+1, iss+1+5, dgrams.FlagTCP_ACK, 100, []byte("world"))
+	if len(probes) != 2 {
+		t.Fatalf("expected probe of ACK received, got %+v", probes)
+	}
+	p := probes[1]
+	// The handshake completed without delay, so SRTT is 0*7/8 + 10ms/8.
+	if p.SndUna != tcpctl.Seq(iss+1+5) || p.RcvNxt != irs+1+5 || p.RcvWnd != 8000-5 || p.SRTT != 10*time.Millisecond/8 {
+		t.Fatalf("probe does not match ACK received: %+v", p)
+	}
+	if p.Cwnd == 0 || p.Ssthresh == 0 || p.RTO < time.Second || p.State != tcpctl.StateEstablished {
+		t.Fatalf("probe missing congestion state: %+v", p)
+	}
+	// Nothing changed, nothing traced.
+	s.Tick(now)
+	if len(probes) != 2 {
+		t.Fatalf("unexpected probe %+v", probes[2:])
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	start := time.Unix(100, 0)
+	probes := []tcpctl.Probe{
+		{Time: start, LocalAddr: [4]byte{10, 0, 0, 1}, LocalPort: 80, RemoteAddr: [4]byte{10, 0, 0, 2}, RemotePort: 1234, State: tcpctl.StateEstablished, SndUna: 1, SndNxt: 2, Cwnd: 14600, RTO: time.Second},
+		{Time: start.Add(1500 * time.Microsecond), State: tcpctl.StateFinWait1, SRTT: 250 * time.Microsecond},
+	}
+	var out bytes.Buffer
+	tw := tcpctl.NewTraceWriter(&out, tcpctl.TraceCSV)
+	for _, p := range probes {
+		tw.Trace(p)
+	}
+	want := "time,local,remote,state,snd_una,snd_nxt,snd_wnd,rcv_nxt,rcv_wnd,cwnd,ssthresh,srtt_us,rto_us\n" +
+		"0.000000,10.0.0.1:80,10.0.0.2:1234,StateEstablished,1,2,0,0,0,14600,0,0,1000000\n" +
+		"0.001500,0.0.0.0:0,0.0.0.0:0,StateFinWait1,0,0,0,0,0,0,0,250,0\n"
+	if out.String() != want {
+		t.Fatalf("got CSV\n%s\nwant\n%s", out.String(), want)
+	}
+	out.Reset()
+	tw = tcpctl.NewTraceWriter(&out, tcpctl.TraceJSON)
+	for _, p := range probes {
+		tw.Trace(p)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON lines, got %q", out.String())
+	}
+	var got struct {
+		Time   float64 `json:"time"`
+		Local  string  `json:"local"`
+		State  string  `json:"state"`
+		Cwnd   uint32  `json:"cwnd"`
+		RTO    int64   `json:"rto_us"`
+		SndNxt uint32  `json:"snd_nxt"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err, lines[0])
+	}
+	if got.Local != "10.0.0.1:80" || got.State != "StateEstablished" || got.Cwnd != 14600 || got.RTO != 1e6 || got.SndNxt != 2 {
+		t.Fatalf("unexpected JSON probe %+v", got)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil || got.Time != 0.0015 {
+		t.Fatal("unexpected JSON probe", lines[1], err)
+	}
+}
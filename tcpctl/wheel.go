@@ -0,0 +1,237 @@
+package tcpctl
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+	// wheelLevels is the number of levels of timerWheel. Timers up to
+	// 2**24 ticks away, about 4.6 hours, are placed directly, later ones
+	// are placed in the last level and moved down as time passes.
+	wheelLevels = 4
+	// wheelSpan is the number of ticks covered by all levels.
+	wheelSpan = 1 << (wheelBits * wheelLevels)
+	// expiredLevel is the level of timers in the expired list of timerWheel.
+	expiredLevel = -1
+)
+
+// timer is an entry of timerWheel, embedded in the structure it is the timer of
+// so that the wheel does not allocate.
+type timer struct {
+	// when is the tick the timer expires at.
+	when       int64
+	next, prev *timer
+	level      int8
+	slot       uint8
+	linked     bool
+	// id identifies the owner of the timer.
+	id int
+}
+
+// timerWheel is a hierarchical timing wheel as described by Varghese and Lauck.
+// Time is counted in ticks. Each level has wheelSlots slots, a slot of level l
+// spanning wheelSlots**l ticks. Timers are placed in the level whose span covers
+// their distance to the current tick and moved to lower levels once the current
+// tick reaches the start of their slot, until they expire from level 0. Starting,
+// stopping and expiring a timer take constant time and advancing the wheel skips
+// over empty slots, so the cost of running timers does not depend on how many
+// there are or how often time advances. Time only advances when told to, which
+// makes the wheel deterministic.
+type timerWheel struct {
+	// slots are the lists of timers of each slot.
+	slots [wheelLevels][wheelSlots]*timer
+	// occupied has bit i of level l set if slots[l][i] is not empty.
+	occupied [wheelLevels]uint64
+	// expired is the list of timers expired and not yet returned by expire.
+	expired *timer
+	// now is the next tick to process, timers expiring before it have expired.
+	now     int64
+	started bool
+}
+
+// start sets the current tick of a wheel without timers.
+func (w *timerWheel) start(now int64) {
+	w.now = now
+	w.started = true
+}
+
+// schedule starts t to expire at tick when, stopping it first if running.
+// Timers scheduled to expire at a tick already processed by expire expire at
+// the next tick, so that a timer restarted by its owner as it expires does not
+// expire again at the same tick.
+func (w *timerWheel) schedule(t *timer, when int64) {
+	w.stop(t)
+	t.when = when
+	w.place(t)
+}
+
+// place links t into the slot of its expiry time.
+func (w *timerWheel) place(t *timer) {
+	when := t.when
+	delta := when - w.now
+	if delta < 0 {
+		delta, when = 0, w.now
+	}
+	if delta >= wheelSpan {
+		// Too far away, place it at the end of the last level until it is closer.
+		delta, when = wheelSpan-1, w.now+wheelSpan-1
+	}
+	level := 0
+	for delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	slot := uint8(when>>(wheelBits*level)) & wheelMask
+	w.link(t, level, slot)
+}
+
+// stop stops t. Stopping a timer which is not running does nothing.
+func (w *timerWheel) stop(t *timer) {
+	if !t.linked {
+		return
+	}
+	head := w.head(t.level, t.slot)
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		*head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	if *head == nil && t.level != expiredLevel {
+		w.occupied[t.level] &^= 1 << t.slot
+	}
+	t.next, t.prev, t.linked = nil, nil, false
+}
+
+// expire advances the wheel up to tick now and returns a timer which expired,
+// which is stopped. It returns nil once no more timers expired by now.
+func (w *timerWheel) expire(now int64) *timer {
+	for w.expired == nil {
+		tick, ok := w.next()
+		if !ok || tick > now {
+			if w.now <= now {
+				w.now = now + 1
+			}
+			return nil
+		}
+		w.now = tick
+		if tick&wheelMask == 0 {
+			w.cascade(1)
+		}
+		slot := uint8(tick) & wheelMask
+		for t := w.slots[0][slot]; t != nil; t = w.slots[0][slot] {
+			w.stop(t)
+			w.link(t, expiredLevel, 0)
+		}
+		w.now = tick + 1
+	}
+	t := w.expired
+	w.stop(t)
+	return t
+}
+
+// next returns the earliest tick at which timers expire or move down a level,
+// no later than any timer expires. ok is false if no timer is running.
+func (w *timerWheel) next() (tick int64, ok bool) { return w.earliest(false) }
+
+// nextExpiry returns the earliest tick a timer expires at. ok is false if no timer is running.
+func (w *timerWheel) nextExpiry() (tick int64, ok bool) { return w.earliest(true) }
+
+// earliest returns the earliest tick at which timers move down a level or
+// expire, or only expire if exact is set.
+func (w *timerWheel) earliest(exact bool) (tick int64, ok bool) {
+	if w.expired != nil {
+		return w.now, true
+	}
+	for level := 0; level < wheelLevels; level++ {
+		shift := wheelBits * level
+		base := w.now >> shift
+		// Slots are visited in order starting at the current one. The current slot
+		// of upper levels holds timers a whole turn away and is visited last, unless
+		// the current tick starts it and it has yet to be moved down.
+		off := int64(0)
+		if level > 0 && w.now&(1<<shift-1) != 0 {
+			off = 1
+		}
+		// Bit j of rotated is set if the j-th slot from base+off is occupied.
+		rotated := bits.RotateLeft64(w.occupied[level], -int((base+off)&wheelMask))
+		for ; rotated != 0; rotated &= rotated - 1 {
+			slot := base + off + int64(bits.TrailingZeros64(rotated))
+			start := slot << shift
+			if ok && start >= tick {
+				break // Timers of later slots expire later.
+			}
+			if !exact {
+				tick, ok = start, true
+				break
+			}
+			for t := w.slots[level][slot&wheelMask]; t != nil; t = t.next {
+				when := t.when
+				if when < w.now {
+					when = w.now // Scheduled after its tick was processed.
+				}
+				if !ok || when < tick {
+					tick, ok = when, true
+				}
+			}
+		}
+	}
+	return tick, ok
+}
+
+// cascade moves the timers of the current slot of level down to lower levels,
+// after doing so for upper levels whose current slot starts at the current tick.
+func (w *timerWheel) cascade(level int) {
+	shift := wheelBits * level
+	slot := uint8(w.now>>shift) & wheelMask
+	if slot == 0 && level+1 < wheelLevels {
+		w.cascade(level + 1)
+	}
+	t := w.slots[level][slot]
+	w.slots[level][slot] = nil
+	w.occupied[level] &^= 1 << slot
+	for t != nil {
+		next := t.next
+		t.next, t.prev = nil, nil
+		w.place(t)
+		t = next
+	}
+}
+
+// link adds t to the list of slot of level.
+func (w *timerWheel) link(t *timer, level int, slot uint8) {
+	head := w.head(int8(level), slot)
+	t.level, t.slot, t.linked = int8(level), slot, true
+	t.prev, t.next = nil, *head
+	if t.next != nil {
+		t.next.prev = t
+	}
+	*head = t
+	if level != expiredLevel {
+		w.occupied[level] |= 1 << slot
+	}
+}
+
+// head returns the head of the list of slot of level.
+func (w *timerWheel) head(level int8, slot uint8) **timer {
+	if level == expiredLevel {
+		return &w.expired
+	}
+	return &w.slots[level][slot]
+}
+
+// wheelTick returns the tick of timerWheel t falls in. Ticks are milliseconds
+// since the Unix epoch, the resolution of the timers of a Stack.
+func wheelTick(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// wheelTime returns the time tick of timerWheel starts at.
+func wheelTime(tick int64) time.Time {
+	return time.UnixMilli(tick)
+}
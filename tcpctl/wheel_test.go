@@ -0,0 +1,82 @@
+package tcpctl
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTimerWheel(t *testing.T) {
+	const ntimers = 100
+	rng := rand.New(rand.NewSource(1))
+	var w timerWheel
+	start := int64(1_700_000_000_123)
+	w.start(start)
+	timers := make([]timer, ntimers)
+	running := make(map[int]int64) // Expiry of running timers by id.
+	randDelay := func() int64 {
+		switch rng.Intn(4) {
+		case 0:
+			return rng.Int63n(wheelSlots)
+		case 1:
+			return rng.Int63n(wheelSlots * wheelSlots * 2)
+		case 2:
+			return rng.Int63n(wheelSpan)
+		default:
+			return wheelSpan + rng.Int63n(wheelSpan)
+		}
+	}
+	for i := range timers {
+		timers[i].id = i
+	}
+	now := start
+	for step := 0; step < 5000; step++ {
+		// Start, restart and stop random timers.
+		for i := 0; i < 3; i++ {
+			tm := &timers[rng.Intn(ntimers)]
+			if rng.Intn(4) == 0 {
+				w.stop(tm)
+				delete(running, tm.id)
+				continue
+			}
+			when := now + randDelay() - 10 // Some expire at the next tick.
+			w.schedule(tm, when)
+			if when < w.now {
+				when = w.now
+			}
+			running[tm.id] = when
+		}
+		next, ok := w.nextExpiry()
+		if ok != (len(running) > 0) {
+			t.Fatalf("nextExpiry reports running=%v with %d timers running", ok, len(running))
+		}
+		for id, when := range running {
+			if when < next {
+				t.Fatalf("next expiry %d after expiry %d of timer %d", next, when, id)
+			} else if when == next {
+				ok = false
+			}
+		}
+		if ok {
+			t.Fatalf("no timer expires at next expiry %d", next)
+		}
+		if rng.Intn(100) == 0 {
+			now += rng.Int63n(2 * wheelSpan)
+		} else {
+			now += rng.Int63n(3 * wheelSlots)
+		}
+		for tm := w.expire(now); tm != nil; tm = w.expire(now) {
+			when, ok := running[tm.id]
+			if !ok {
+				t.Fatalf("timer %d expired while not running", tm.id)
+			} else if when > now {
+				t.Fatalf("timer %d expired at %d before %d", tm.id, now, when)
+			}
+			delete(running, tm.id)
+		}
+		for id, when := range running {
+			if when <= now {
+				t.Fatalf("timer %d did not expire at %d by %d", id, when, now)
+			}
+		}
+	}
+}
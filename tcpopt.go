@@ -0,0 +1,45 @@
+package dgrams
+
+import "errors"
+
+// TCPOptionKind is the first octet of a TCP option which identifies it.
+// See https://www.iana.org/assignments/tcp-parameters/tcp-parameters.xhtml
+type TCPOptionKind uint8
+
+const (
+	// End of option list. Only used as padding at the end of the options.
+	TCPOptionEnd TCPOptionKind = 0
+	// No-Operation, single octet option used to align options on word boundaries.
+	TCPOptionNop TCPOptionKind = 1
+	// Maximum Segment Size, RFC 9293. Only sent in SYN segments.
+	TCPOptionMSS TCPOptionKind = 2
+	// Window Scale, RFC 7323. Only sent in SYN segments.
+	TCPOptionWindowScale TCPOptionKind = 3
+	// SACK Permitted, RFC 2018. Only sent in SYN segments.
+	TCPOptionSACKPermitted TCPOptionKind = 4
+	// Selective Acknowledgment blocks, RFC 2018.
+	TCPOptionSACK TCPOptionKind = 5
+	// Timestamps, RFC 7323.
+	TCPOptionTimestamps TCPOptionKind = 8
+)
+
+var errBadTCPOption = errors.New("malformed TCP option")
+
+// DecodeTCPOption decodes the first TCP option in b. It returns the option's
+// kind, its data (not including kind and length octets) and the number
+// of octets the option occupies in b. The single octet End and Nop options
+// are returned with no data and n=1.
+func DecodeTCPOption(b []byte) (kind TCPOptionKind, data []byte, n int, err error) {
+	if len(b) == 0 {
+		return 0, nil, 0, errBadTCPOption
+	}
+	kind = TCPOptionKind(b[0])
+	if kind == TCPOptionEnd || kind == TCPOptionNop {
+		return kind, nil, 1, nil
+	}
+	if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+		return kind, nil, 0, errBadTCPOption
+	}
+	n = int(b[1])
+	return kind, b[2:n], n, nil
+}
@@ -13,8 +13,8 @@ DEV=tun0
 sudo ip addr add 192.168.0.2/24 dev $DEV # ip addr will now show our tun0 interface after this command.
 
 sudo ip link set up dev $DEV # This links our tun0 with another interface causing it to read data.
-# nc 192.168.0.2:80 & # Start pinging on the tun0 device.
-curl http://192.168.0.2:80 & # Start TCP connection on the tun0 device.
+# nc 192.168.0.3:80 & # Start pinging on the tun0 device.
+curl http://192.168.0.3:80 & # Start TCP connection on the tun0 device.
 
 trap "kill $pid" INT TERM
 wait $pid
\ No newline at end of file
@@ -0,0 +1,93 @@
+package dgrams
+
+import "encoding/binary"
+
+// SizeVirtioNetHeader is the size of the virtio-net header preceding packets
+// exchanged with a Linux TUN or TAP interface opened with IFF_VNET_HDR.
+const SizeVirtioNetHeader = 10
+
+// VirtioNetFlags are the flags of a virtio-net header.
+type VirtioNetFlags uint8
+
+const (
+	// VirtioNetNeedsCsum is set on packets whose transport checksum only covers
+	// the pseudo-header. The rest of the packet from CsumStart must be summed
+	// into the checksum at CsumStart+CsumOffset.
+	VirtioNetNeedsCsum VirtioNetFlags = 1
+	// VirtioNetDataValid is set on packets received whose checksums were
+	// verified by the device.
+	VirtioNetDataValid VirtioNetFlags = 2
+)
+
+// VirtioGSOType is the kind of segmentation offload requested by a virtio-net header.
+type VirtioGSOType uint8
+
+const (
+	// VirtioGSONone marks packets which are not to be segmented.
+	VirtioGSONone VirtioGSOType = 0
+	// VirtioGSOTCPv4 marks TCP segments over IPv4 larger than GSOSize, to be split
+	// into segments of GSOSize bytes of data each (TSO).
+	VirtioGSOTCPv4 VirtioGSOType = 1
+	// VirtioGSOUDP marks UDP datagrams to be fragmented (UFO).
+	VirtioGSOUDP VirtioGSOType = 3
+	// VirtioGSOTCPv6 is VirtioGSOTCPv4 over IPv6.
+	VirtioGSOTCPv6 VirtioGSOType = 4
+	// VirtioGSOECN is set along a TCP GSO type if the segment has the CWR flag set.
+	VirtioGSOECN VirtioGSOType = 0x80
+)
+
+// VirtioNetHeader is the 10 byte header of the virtio-net specification,
+// struct virtio_net_hdr, describing the checksum and segmentation offloads of
+// a packet. Fields are little-endian as in virtio 1.0, see DecodeVirtioNetHeader.
+type VirtioNetHeader struct {
+	Flags   VirtioNetFlags // 0:1
+	GSOType VirtioGSOType  // 1:2
+	// HdrLen is the length of the headers copied to each segment, up to the end
+	// of the TCP header.
+	HdrLen uint16 // 2:4
+	// GSOSize is the size of the data of each segment.
+	GSOSize uint16 // 4:6
+	// CsumStart is the offset of the transport header and CsumOffset that of
+	// the checksum field within it.
+	CsumStart  uint16 // 6:8
+	CsumOffset uint16 // 8:10
+}
+
+// DecodeVirtioNetHeader decodes a 10 byte virtio-net header from buf. Linux TUN
+// interfaces use the byte order of the host unless set to little-endian
+// with the TUNSETVNETLE ioctl.
+func DecodeVirtioNetHeader(buf []byte) (vnet VirtioNetHeader) {
+	_ = buf[9]
+	vnet.Flags = VirtioNetFlags(buf[0])
+	vnet.GSOType = VirtioGSOType(buf[1])
+	vnet.HdrLen = binary.LittleEndian.Uint16(buf[2:])
+	vnet.GSOSize = binary.LittleEndian.Uint16(buf[4:])
+	vnet.CsumStart = binary.LittleEndian.Uint16(buf[6:])
+	vnet.CsumOffset = binary.LittleEndian.Uint16(buf[8:])
+	return vnet
+}
+
+// Put marshals the virtio-net header onto buf. buf needs to be 10 bytes in length or Put panics.
+func (vnet *VirtioNetHeader) Put(buf []byte) {
+	_ = buf[9]
+	buf[0] = byte(vnet.Flags)
+	buf[1] = byte(vnet.GSOType)
+	binary.LittleEndian.PutUint16(buf[2:], vnet.HdrLen)
+	binary.LittleEndian.PutUint16(buf[4:], vnet.GSOSize)
+	binary.LittleEndian.PutUint16(buf[6:], vnet.CsumStart)
+	binary.LittleEndian.PutUint16(buf[8:], vnet.CsumOffset)
+}
+
+// CompleteChecksum computes the checksum of the packet in buf whose header vnet
+// has VirtioNetNeedsCsum set, summing buf from CsumStart into the partial
+// checksum at CsumStart+CsumOffset. It returns false if the offsets are out of buf.
+func (vnet *VirtioNetHeader) CompleteChecksum(buf []byte) bool {
+	start, field := int(vnet.CsumStart), int(vnet.CsumStart)+int(vnet.CsumOffset)
+	if start > len(buf) || field+2 > len(buf) {
+		return false
+	}
+	var crc CRC_RFC791
+	crc.Write(buf[start:])
+	binary.BigEndian.PutUint16(buf[field:], crc.Sum())
+	return true
+}